@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sync/atomic"
+)
+
+// auditLog records every Kubernetes mutation when an audit log is
+// configured, and is nil otherwise.
+var auditLog *slog.Logger
+
+// openAuditLog points auditLog at path, appending JSON records. The path
+// "stdout" writes to standard output, apart from the regular logs on
+// standard error. An empty path disables auditing.
+func openAuditLog(path string) (io.Closer, error) {
+	if path == "" {
+		auditLog = nil
+		return nopWriteCloser{io.Discard}, nil
+	}
+	var w io.WriteCloser = nopWriteCloser{os.Stdout}
+	if path != "stdout" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, fmt.Errorf("open audit log: %w", err)
+		}
+		w = f
+	}
+	auditLog = slog.New(slog.NewJSONHandler(w, nil))
+	return w, nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// changeCount counts the successful Kubernetes mutations and Ceph
+// configuration changes, so that a run can report whether it changed
+// anything.
+var changeCount atomic.Int64
+
+// auditMutation records a create, apply, update or delete of a Kubernetes
+// object along with a summary of the change and its outcome.
+func auditMutation(kube *kubeClient, verb, resource, namespace, name, manager string, diff []any, err error) {
+	if err == nil {
+		changeCount.Add(1)
+	}
+	logMutation(kube, verb, resource, namespace, name, manager, diff, err)
+}
+
+// auditStatusUpdate records an apply to a status subresource. Status updates
+// report on a reconcile rather than change what is published, so unlike
+// auditMutation it does not count as a change.
+func auditStatusUpdate(kube *kubeClient, resource, namespace, name, manager string, diff []any, err error) {
+	logMutation(kube, "apply", resource, namespace, name, manager, diff, err)
+}
+
+func logMutation(kube *kubeClient, verb, resource, namespace, name, manager string, diff []any, err error) {
+	if auditLog == nil {
+		return
+	}
+	attrs := []any{
+		"cluster", kube.name,
+		"verb", verb,
+		"resource", resource,
+		"namespace", namespace,
+		"name", name,
+		"fieldManager", manager,
+	}
+	if len(diff) > 0 {
+		attrs = append(attrs, slog.Group("diff", diff...))
+	}
+	if err != nil {
+		attrs = append(attrs, "outcome", "failure", "error", err)
+	} else {
+		attrs = append(attrs, "outcome", "success")
+	}
+	auditLog.Info("kubernetes mutation", attrs...)
+}
+
+// changedKeys summarises a ConfigMap or Secret update by the keys that were
+// added, changed or removed, never their values.
+func changedKeys[V any](before, after map[string]V, equal func(V, V) bool) []any {
+	var added, changed, removed []string
+	for key, value := range after {
+		old, ok := before[key]
+		switch {
+		case !ok:
+			added = append(added, key)
+		case !equal(old, value):
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	var attrs []any
+	for _, group := range []struct {
+		name string
+		keys []string
+	}{{"added", added}, {"changed", changed}, {"removed", removed}} {
+		if len(group.keys) > 0 {
+			slices.Sort(group.keys)
+			attrs = append(attrs, group.name, group.keys)
+		}
+	}
+	return attrs
+}
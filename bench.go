@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"slices"
+	"time"
+)
+
+type benchOptions struct {
+	module     string
+	iterations int
+}
+
+// parseBenchOptions parses the flags of the bench command.
+func parseBenchOptions(args []string) (benchOptions, error) {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	opts := benchOptions{}
+	flags.StringVar(&opts.module, "module", "prometheus", "mgr module to publish")
+	flags.IntVar(&opts.iterations, "iterations", 20, "number of measured iterations")
+	if err := flags.Parse(args); err != nil {
+		return opts, err
+	}
+	if opts.iterations < 1 {
+		return opts, fmt.Errorf("iterations must be positive: %d", opts.iterations)
+	}
+	return opts, nil
+}
+
+// latencies collects the durations of one phase.
+type latencies []time.Duration
+
+func (l latencies) percentile(p int) time.Duration {
+	sorted := slices.Sorted(slices.Values(l))
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func (l latencies) mean() time.Duration {
+	var total time.Duration
+	for _, d := range l {
+		total += d
+	}
+	return total / time.Duration(len(l))
+}
+
+// runBench measures the phases of a reconcile of the mgr module over
+// opts.iterations runs: discovery of the mgr services, parsing them into
+// endpoints, and applying the EndpointSlices to a Service in a temporary
+// namespace, once unchanged and once with a changed port. It prints a
+// summary to out and returns the exit code.
+func runBench(ctx context.Context, cfg config, conn discoverer, kube *kubeClient, opts benchOptions, out io.Writer) (code int) {
+	ns, err := createScratchNamespace(ctx, kube, "ceph-mgr-endpoint-bench-")
+	if err != nil {
+		fmt.Fprintf(out, "create namespace: %v\n", err)
+		return 1
+	}
+	defer func() {
+		if err := deleteScratchNamespace(ctx, kube, ns); err != nil {
+			fmt.Fprintf(out, "delete namespace %s: %v\n", ns.Name, err)
+			code = 1
+		}
+	}()
+	m := mapping{module: opts.module, namespace: ns.Name, serviceName: e2eServiceName, slice: e2eServiceName + "-" + opts.module, onDisable: "keep"}
+
+	var mgr *mgrMap
+	if cfg.dualStack {
+		if mgr, err = getMgrMap(conn); err != nil {
+			fmt.Fprintf(out, "get mgr map: %v\n", err)
+			return 1
+		}
+	}
+
+	phases := []string{"discover", "parse", "apply unchanged", "apply changed"}
+	results := make(map[string]latencies)
+	var svcCreated bool
+	// The first iteration warms up connections and creates the slices, and
+	// is not measured.
+	for i := 0; i <= opts.iterations; i++ {
+		start := time.Now()
+		services, err := getMgrServices(conn)
+		if err == nil && services[m.module] == "" {
+			err = fmt.Errorf("%s service URL not found in ceph mgr services", m.module)
+		}
+		if err != nil {
+			fmt.Fprintf(out, "discover: %v\n", err)
+			return 1
+		}
+		discovered := time.Since(start)
+
+		start = time.Now()
+		groups, err := discoverGroups(ctx, cfg, conn, newHostResolver(cfg.resolve), m, services, mgr, make(map[string][]*endpointAddress))
+		if err != nil {
+			fmt.Fprintf(out, "parse: %v\n", err)
+			return 1
+		}
+		groups = desiredGroups(cfg, m, groups, nil)
+		parsed := time.Since(start)
+
+		if !svcCreated {
+			if _, err := createScratchService(ctx, kube, m, groups[0].addrs[0].port); err != nil {
+				fmt.Fprintf(out, "create Service: %v\n", err)
+				return 1
+			}
+			svcCreated = true
+		}
+		changed := mapEndpointGroups(m.slice, groups, func(addr *endpointAddress) { addr.port++ })
+		var applied [2]time.Duration
+		for j, g := range [][]endpointGroup{groups, changed} {
+			start = time.Now()
+			if err := publishEndpointSlices(ctx, cfg, kube, m, g); err != nil {
+				fmt.Fprintf(out, "apply: %v\n", err)
+				return 1
+			}
+			applied[j] = time.Since(start)
+		}
+		// Restore the slices, so the next unchanged apply finds them
+		// current.
+		if err := publishEndpointSlices(ctx, cfg, kube, m, groups); err != nil {
+			fmt.Fprintf(out, "apply: %v\n", err)
+			return 1
+		}
+		if i == 0 {
+			continue
+		}
+		for phase, d := range map[string]time.Duration{"discover": discovered, "parse": parsed, "apply unchanged": applied[0], "apply changed": applied[1]} {
+			results[phase] = append(results[phase], d)
+		}
+	}
+
+	fmt.Fprintf(out, "%-16s %10s %10s %10s %10s %10s\n", "phase", "min", "mean", "p50", "p95", "max")
+	for _, phase := range phases {
+		l := results[phase]
+		fmt.Fprintf(out, "%-16s %10s %10s %10s %10s %10s\n", phase,
+			l.percentile(0).Round(time.Microsecond), l.mean().Round(time.Microsecond),
+			l.percentile(50).Round(time.Microsecond), l.percentile(95).Round(time.Microsecond),
+			l.percentile(100).Round(time.Microsecond))
+	}
+	return 0
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+// discoverer is the Ceph side of a reconcile: the mon and mgr commands that
+// mgr services and daemons are discovered through. A rados connection
+// implements it, and tests substitute canned responses.
+type discoverer interface {
+	MonCommand(args []byte) ([]byte, string, error)
+	MgrCommand(args [][]byte) ([]byte, string, error)
+}
+
+type monCommand struct {
+	Prefix string `json:"prefix"`
+	Format string `json:"format"`
+}
+
+type mgrServices map[string]string
+
+type endpointAddress struct {
+	ip   net.IP
+	port int32
+	url  string
+	path string
+	// extraPorts are published by name alongside the module's port.
+	extraPorts map[string]int32
+	// nodeName is the Kubernetes Node the address belongs to, if known.
+	nodeName string
+	// staleSince is set for last-known addresses restored from the state file.
+	staleSince time.Time
+}
+
+// scheme returns the scheme of the address's URL.
+func (a *endpointAddress) scheme() string {
+	scheme, _, _ := strings.Cut(a.url, "://")
+	return scheme
+}
+
+type mgrModuleCommand struct {
+	Prefix string `json:"prefix"`
+	Module string `json:"module"`
+}
+
+type configGetCommand struct {
+	Prefix string `json:"prefix"`
+	Who    string `json:"who"`
+	Key    string `json:"key"`
+	Format string `json:"format"`
+}
+
+type configSetCommand struct {
+	Prefix string `json:"prefix"`
+	Who    string `json:"who"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+}
+
+type mgrModules struct {
+	AlwaysOnModules []string         `json:"always_on_modules"`
+	EnabledModules  []string         `json:"enabled_modules"`
+	DisabledModules []disabledModule `json:"disabled_modules"`
+}
+
+type disabledModule struct {
+	Name        string `json:"name"`
+	CanRun      bool   `json:"can_run"`
+	ErrorString string `json:"error_string"`
+}
+
+type mgrMap struct {
+	Epoch      int               `json:"epoch"`
+	ActiveName string            `json:"active_name"`
+	ActiveAddr string            `json:"active_addr"`
+	Available  bool              `json:"available"`
+	Services   map[string]string `json:"services"`
+	Standbys   []struct {
+		Name string `json:"name"`
+	} `json:"standbys"`
+	ActiveAddrs struct {
+		Addrvec []struct {
+			Type string `json:"type"`
+			Addr string `json:"addr"`
+		} `json:"addrvec"`
+	} `json:"active_addrs"`
+}
+
+type mgrMetadata struct {
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+var (
+	mgrServicesCommand = monCommand{Prefix: "mgr services", Format: "json"}
+	mgrDumpCommand     = monCommand{Prefix: "mgr dump", Format: "json"}
+	mgrMetadataCommand = monCommand{Prefix: "mgr metadata", Format: "json"}
+	mgrModuleLsCommand = monCommand{Prefix: "mgr module ls", Format: "json"}
+	fsidCommand        = monCommand{Prefix: "fsid", Format: "json"}
+	versionCommand     = monCommand{Prefix: "version", Format: "json"}
+)
+
+func execMonCommand(conn discoverer, command any) ([]byte, error) {
+	cmd, err := json.Marshal(command)
+	if err != nil {
+		return nil, fmt.Errorf("marshal command: %w", err)
+	}
+
+	buf, info, err := conn.MonCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("mon command: %w", err)
+	}
+	if info != "" {
+		slog.Debug("mon command info", "info", info)
+	}
+
+	return buf, nil
+}
+
+func execMgrCommand(conn discoverer, command any) ([]byte, error) {
+	cmd, err := json.Marshal(command)
+	if err != nil {
+		return nil, fmt.Errorf("marshal command: %w", err)
+	}
+
+	buf, info, err := conn.MgrCommand([][]byte{cmd})
+	if err != nil {
+		return nil, fmt.Errorf("mgr command: %w", err)
+	}
+	if info != "" {
+		slog.Debug("mgr command info", "info", info)
+	}
+
+	return buf, nil
+}
+
+func getMgrServices(conn discoverer) (mgrServices, error) {
+	services, _, err := getMgrServicesJSON(conn)
+	return services, err
+}
+
+// getMgrServicesJSON returns the mgr services map along with the raw
+// response it was decoded from.
+func getMgrServicesJSON(conn discoverer) (mgrServices, []byte, error) {
+	buf, err := execMonCommand(conn, mgrServicesCommand)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	services := mgrServices{}
+	if err := json.Unmarshal(buf, &services); err != nil {
+		return nil, nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	return services, buf, nil
+}
+
+func getMgrMap(conn discoverer) (*mgrMap, error) {
+	buf, err := execMonCommand(conn, mgrDumpCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	var mgr mgrMap
+	if err := json.Unmarshal(buf, &mgr); err != nil {
+		return nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	return &mgr, nil
+}
+
+// activeIPs returns the addresses the active mgr binds to.
+func (m *mgrMap) activeIPs() ([]net.IP, error) {
+	addrs := []string{m.ActiveAddr}
+	if len(m.ActiveAddrs.Addrvec) > 0 {
+		addrs = addrs[:0]
+		for _, entry := range m.ActiveAddrs.Addrvec {
+			addrs = append(addrs, entry.Addr)
+		}
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		addr, _, _ = strings.Cut(addr, "/")
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("parse active mgr address %q: %w", addr, err)
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid active mgr address: %s", addr)
+		}
+		ips = append(ips, ip)
+	}
+	return ips, nil
+}
+
+// activeIP returns the address of the active mgr, choosing among the
+// addresses it binds to by preferred networks.
+func (m *mgrMap) activeIP(networks []*net.IPNet) (net.IP, error) {
+	ips, err := m.activeIPs()
+	if err != nil {
+		return nil, err
+	}
+	return preferNetworks(ips, networks)[0], nil
+}
+
+// dualStackAddresses adds to active an address of each family the active
+// mgr binds to but active lacks, with the same port and path. Within a
+// family, the address is chosen by preferred networks.
+func (m *mgrMap) dualStackAddresses(active []*endpointAddress, networks []*net.IPNet) ([]*endpointAddress, error) {
+	ips, err := m.activeIPs()
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(active[0].url)
+	if err != nil {
+		return nil, fmt.Errorf("parse URL: %w", err)
+	}
+	addrs := slices.Clone(active)
+	for _, family := range []discoveryv1.AddressType{discoveryv1.AddressTypeIPv4, discoveryv1.AddressTypeIPv6} {
+		if slices.ContainsFunc(addrs, func(a *endpointAddress) bool { return addressTypeFor(a.ip) == family }) {
+			continue
+		}
+		var candidates []net.IP
+		for _, ip := range ips {
+			if addressTypeFor(ip) == family {
+				candidates = append(candidates, ip)
+			}
+		}
+		if len(candidates) == 0 {
+			continue
+		}
+		ip := preferNetworks(candidates, networks)[0]
+		familyURL := *u
+		familyURL.Host = net.JoinHostPort(ip.String(), strconv.Itoa(int(active[0].port)))
+		addrs = append(addrs, &endpointAddress{
+			ip:   ip,
+			port: active[0].port,
+			url:  familyURL.String(),
+			path: active[0].path,
+		})
+	}
+	return addrs, nil
+}
+
+func getMgrMetadata(conn discoverer) (map[string]mgrMetadata, error) {
+	buf, err := execMonCommand(conn, mgrMetadataCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []mgrMetadata
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	metadata := make(map[string]mgrMetadata, len(entries))
+	for _, entry := range entries {
+		name := entry.Name
+		if name == "" {
+			name = entry.ID
+		}
+		metadata[name] = entry
+	}
+	return metadata, nil
+}
+
+func parseMgrAddr(addr string) net.IP {
+	addr, _, _ = strings.Cut(addr, "/")
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+func getMgrInstanceAddresses(conn discoverer, module string, active []*endpointAddress) ([]*endpointAddress, error) {
+	mgr, err := getMgrMap(conn)
+	if err != nil {
+		return nil, fmt.Errorf("get mgr map: %w", err)
+	}
+	metadata, err := getMgrMetadata(conn)
+	if err != nil {
+		return nil, fmt.Errorf("get mgr metadata: %w", err)
+	}
+
+	u, err := url.Parse(active[0].url)
+	if err != nil {
+		return nil, fmt.Errorf("parse URL: %w", err)
+	}
+
+	_, portKey, err := mgrPortKey(conn, module)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := slices.Clone(active)
+	for _, standby := range mgr.Standbys {
+		ip := parseMgrAddr(metadata[standby.Name].Addr)
+		if ip == nil {
+			slog.Warn("no address for standby mgr", "mgr", standby.Name, "addr", metadata[standby.Name].Addr)
+			continue
+		}
+		value, err := getMgrConfig(conn, "mgr."+standby.Name, "mgr/"+module+"/"+portKey)
+		if err != nil {
+			return nil, fmt.Errorf("get %s %s for mgr.%s: %w", module, portKey, standby.Name, err)
+		}
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid %s %s for mgr.%s: %s", module, portKey, standby.Name, value)
+		}
+		instanceURL := *u
+		instanceURL.Host = net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		addrs = append(addrs, &endpointAddress{
+			ip:   ip,
+			port: int32(port),
+			url:  instanceURL.String(),
+			path: active[0].path,
+		})
+	}
+	return addrs, nil
+}
+
+func verifyActiveMgr(conn discoverer, before *mgrMap, services mgrServices) (string, error) {
+	after, err := getMgrMap(conn)
+	if err != nil {
+		return "", fmt.Errorf("get mgr map: %w", err)
+	}
+	if before.Epoch != after.Epoch {
+		return fmt.Sprintf("mgr map epoch changed from %d to %d during discovery", before.Epoch, after.Epoch), nil
+	}
+	if before.ActiveName != after.ActiveName {
+		return fmt.Sprintf("active mgr changed from %s to %s during discovery", before.ActiveName, after.ActiveName), nil
+	}
+	if !after.Available && len(services) > 0 {
+		return "mgr services reported but no active mgr is available", nil
+	}
+	for _, module := range slices.Sorted(maps.Keys(services)) {
+		if expected := after.Services[module]; expected != services[module] {
+			return fmt.Sprintf("%s URL %s does not match active mgr %s (epoch %d): %s", module, services[module], after.ActiveName, after.Epoch, expected), nil
+		}
+	}
+	return "", nil
+}
+
+func fillServicesFromConfig(conn discoverer, services mgrServices, mappings []mapping, networks []*net.IPNet) error {
+	var mgr *mgrMap
+	for _, m := range mappings {
+		if !m.fromMgrServices() || services[m.module] != "" {
+			continue
+		}
+		if mgr == nil {
+			var err error
+			if mgr, err = getMgrMap(conn); err != nil {
+				return fmt.Errorf("get mgr map: %w", err)
+			}
+			if !mgr.Available {
+				return fmt.Errorf("no active mgr available")
+			}
+		}
+		rawURL, err := mgrServiceURLFromConfig(conn, mgr, m.module, networks)
+		if err != nil {
+			return fmt.Errorf("%s: %w", m.module, err)
+		}
+		slog.Warn("service missing from mgr services, using configured port", "service", m.module, "url", rawURL, "mgr", mgr.ActiveName)
+		services[m.module] = rawURL
+	}
+	return nil
+}
+
+// mgrPortKey returns the scheme a module serves and the config key of its
+// port: ssl_server_port for the dashboard with mgr/dashboard/ssl set, and
+// server_port otherwise.
+func mgrPortKey(conn discoverer, module string) (string, string, error) {
+	if module == "dashboard" {
+		ssl, err := getMgrConfig(conn, "mgr", "mgr/dashboard/ssl")
+		if err != nil {
+			return "", "", fmt.Errorf("get ssl: %w", err)
+		}
+		if enabled, _ := strconv.ParseBool(ssl); enabled {
+			return "https", "ssl_server_port", nil
+		}
+	}
+	return "http", "server_port", nil
+}
+
+func mgrServiceURLFromConfig(conn discoverer, mgr *mgrMap, module string, networks []*net.IPNet) (string, error) {
+	scheme, portKey, err := mgrPortKey(conn, module)
+	if err != nil {
+		return "", err
+	}
+
+	port, err := getMgrConfig(conn, "mgr", "mgr/"+module+"/"+portKey)
+	if err != nil {
+		return "", fmt.Errorf("get %s: %w", portKey, err)
+	}
+	if port == "" {
+		return "", fmt.Errorf("%s not configured", portKey)
+	}
+
+	path := "/"
+	if module == "dashboard" {
+		prefix, err := getMgrConfig(conn, "mgr", "mgr/dashboard/url_prefix")
+		if err != nil {
+			return "", fmt.Errorf("get url_prefix: %w", err)
+		}
+		if prefix = strings.Trim(prefix, "/"); prefix != "" {
+			path = "/" + prefix + "/"
+		}
+	}
+
+	ip, err := mgr.activeIP(networks)
+	if err != nil {
+		return "", err
+	}
+	if addr, err := getMgrConfig(conn, "mgr", "mgr/"+module+"/server_addr"); err == nil {
+		if configured := net.ParseIP(addr); configured != nil && !configured.IsUnspecified() {
+			ip = configured
+		}
+	}
+
+	return (&url.URL{Scheme: scheme, Host: net.JoinHostPort(ip.String(), port), Path: path}).String(), nil
+}
+
+// getDashboardPorts returns the dashboard's HTTP and HTTPS ports, named http
+// and https.
+func getDashboardPorts(conn discoverer) (map[string]int32, error) {
+	ports := make(map[string]int32)
+	for name, key := range map[string]string{"http": "server_port", "https": "ssl_server_port"} {
+		value, err := getMgrConfig(conn, "mgr", "mgr/dashboard/"+key)
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %w", key, err)
+		}
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid dashboard %s: %s", key, value)
+		}
+		ports[name] = int32(port)
+	}
+	return ports, nil
+}
+
+// getCephVersion returns the version of the Ceph cluster, for example
+// 18.2.4, as reported by the mon answering the command.
+func getCephVersion(conn discoverer) (string, error) {
+	buf, err := execMonCommand(conn, versionCommand)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(buf, &resp); err != nil {
+		return "", fmt.Errorf("unmarshal response: %w", err)
+	}
+	// "ceph version 18.2.4 (<commit>) reef (stable)"
+	fields := strings.Fields(resp.Version)
+	if len(fields) < 3 || fields[0] != "ceph" || fields[1] != "version" {
+		return "", fmt.Errorf("unexpected version: %q", resp.Version)
+	}
+	return fields[2], nil
+}
+
+func getMgrModules(conn discoverer) (*mgrModules, error) {
+	buf, err := execMonCommand(conn, mgrModuleLsCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	var modules mgrModules
+	if err := json.Unmarshal(buf, &modules); err != nil {
+		return nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	return &modules, nil
+}
+
+func getMgrConfig(conn discoverer, who, key string) (string, error) {
+	buf, err := execMonCommand(conn, configGetCommand{Prefix: "config get", Who: who, Key: key, Format: "json"})
+	if err != nil {
+		return "", err
+	}
+
+	var value string
+	if err := json.Unmarshal(buf, &value); err != nil {
+		return strings.TrimSpace(string(buf)), nil
+	}
+	return value, nil
+}
+
+func applyMgrOptions(conn discoverer, options []mgrOption) error {
+	for _, opt := range options {
+		current, err := getMgrConfig(conn, "mgr", opt.name)
+		if err != nil {
+			return fmt.Errorf("get %s: %w", opt.name, err)
+		}
+		if current == opt.value {
+			continue
+		}
+		if _, err := execMonCommand(conn, configSetCommand{Prefix: "config set", Who: "mgr", Name: opt.name, Value: opt.value}); err != nil {
+			return fmt.Errorf("set %s: %w", opt.name, err)
+		}
+		changeCount.Add(1)
+		slog.Info("updated mgr config", "name", opt.name, "from", current, "to", opt.value)
+	}
+	return nil
+}
+
+func enableMgrModules(conn discoverer, mappings []mapping) error {
+	modules, err := getMgrModules(conn)
+	if err != nil {
+		return fmt.Errorf("list mgr modules: %w", err)
+	}
+
+	for _, m := range mappings {
+		if !m.fromMgrServices() || slices.Contains(modules.EnabledModules, m.module) {
+			continue
+		}
+		if _, err := execMonCommand(conn, mgrModuleCommand{Prefix: "mgr module enable", Module: m.module}); err != nil {
+			return fmt.Errorf("enable %s module: %w", m.module, err)
+		}
+		changeCount.Add(1)
+		slog.Info("enabled mgr module", "module", m.module)
+		modules.EnabledModules = append(modules.EnabledModules, m.module)
+	}
+
+	return nil
+}
+
+// parseServiceURL parses a mgr service URL into its endpoint addresses. A
+// hostname is resolved with resolver, and rejected when resolver is nil; it
+// yields its first address, or all of them when the resolver is set to.
+func parseServiceURL(ctx context.Context, rawURL string, resolver *hostResolver) ([]*endpointAddress, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parse URL: %w", err)
+	}
+
+	host := u.Hostname()
+	portStr := u.Port()
+
+	if portStr == "" {
+		switch u.Scheme {
+		case "https":
+			portStr = "443"
+		case "http":
+			portStr = "80"
+		default:
+			return nil, fmt.Errorf("no port specified and unknown scheme: %s", u.Scheme)
+		}
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %w", err)
+	}
+	if port < 1 || port > 65535 {
+		return nil, fmt.Errorf("port out of range: %d", port)
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if resolver == nil {
+			return nil, fmt.Errorf("expected IP address, got hostname: %s", host)
+		}
+		ips, err = resolver.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if !resolver.all {
+			ips = ips[:1]
+		}
+	}
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	addrs := make([]*endpointAddress, len(ips))
+	for i, ip := range ips {
+		addrs[i] = &endpointAddress{
+			ip:   ip,
+			port: int32(port),
+			url:  u.String(),
+			path: path,
+		}
+	}
+	return addrs, nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+const certExpiryAnnotation = "ceph.io/dashboard-cert-expiry-timestamp"
+
+// inspectCertificate connects to an HTTPS endpoint and returns the leaf
+// certificate it serves. The certificate is only read, not trusted, so the
+// dashboard's usual self-signed certificate is inspected too.
+func inspectCertificate(ctx context.Context, addr *endpointAddress) (*x509.Certificate, error) {
+	u, err := url.Parse(addr.url)
+	if err != nil {
+		return nil, fmt.Errorf("parse URL: %w", err)
+	}
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 10 * time.Second},
+		Config: &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: true,
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.ip.String(), strconv.Itoa(int(addr.port))))
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	defer conn.Close()
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificate served")
+	}
+	return certs[0], nil
+}
+
+// reportCertExpiry records the expiry of the dashboard certificate on the
+// mapping's Service as a Unix timestamp, and emits a warning Event when it
+// expires within warnBefore.
+func reportCertExpiry(ctx context.Context, kube *kubeClient, m mapping, cert *x509.Certificate, warnBefore time.Duration) error {
+	svc, err := kube.getService(ctx, m.namespace, m.serviceName)
+	if err != nil {
+		return fmt.Errorf("get Service: %w", err)
+	}
+	if remaining := time.Until(cert.NotAfter); warnBefore > 0 && remaining < warnBefore {
+		slog.WarnContext(ctx, "dashboard certificate expires soon", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "notAfter", cert.NotAfter, "subject", cert.Subject.String())
+		kube.recorder.Eventf(svc, corev1.EventTypeWarning, "CertificateExpiring", "Dashboard certificate %s expires at %s", cert.Subject.String(), cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	expiry := strconv.FormatInt(cert.NotAfter.Unix(), 10)
+	if svc.Annotations[certExpiryAnnotation] == expiry {
+		return nil
+	}
+	manager := fieldManager + "-cert"
+	service := corev1apply.Service(m.serviceName, m.namespace).WithAnnotations(map[string]string{certExpiryAnnotation: expiry})
+	_, err = kube.clientset.CoreV1().Services(m.namespace).Apply(ctx, service, metav1.ApplyOptions{FieldManager: manager})
+	auditMutation(kube, "apply", "services", m.namespace, m.serviceName, manager, []any{"annotations", []string{certExpiryAnnotation}}, err)
+	if err != nil {
+		return fmt.Errorf("apply Service: %w", err)
+	}
+	slog.InfoContext(ctx, "recorded dashboard certificate expiry", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "notAfter", cert.NotAfter)
+	return nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// checkNames lists the checks of `check` in the order they run.
+var checkNames = []string{"ceph", "kubernetes", "rbac", "service", "modules", "drift", "probe"}
+
+// checkEnv holds what the checks share: the configuration and the Ceph and
+// Kubernetes clients, connected on first use.
+type checkEnv struct {
+	cfg      config
+	timeout  time.Duration
+	caFile   string
+	insecure bool
+	conn     discoverer
+	connErr  error
+	shutdown []func()
+	kubes    []*kubeClient
+}
+
+// ceph returns the Ceph connection, connecting on first use; a failure to
+// connect is returned to every later check too. With a timeout, librados
+// gives up on mon commands after it as well.
+func (e *checkEnv) ceph(ctx context.Context) (discoverer, error) {
+	if e.conn == nil && e.connErr == nil {
+		e.conn, e.connErr = e.connect(ctx)
+	}
+	return e.conn, e.connErr
+}
+
+func (e *checkEnv) connect(ctx context.Context) (discoverer, error) {
+	conn, err := newRadosConn(e.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("create rados connection: %w", err)
+	}
+	e.shutdown = append(e.shutdown, conn.Shutdown)
+	if e.timeout > 0 {
+		seconds := strconv.Itoa(max(1, int(e.timeout.Seconds())))
+		for _, option := range []string{"client_mount_timeout", "rados_mon_op_timeout"} {
+			if err := conn.SetConfigOption(option, seconds); err != nil {
+				return nil, fmt.Errorf("set %s: %w", option, err)
+			}
+		}
+	}
+	if connected, err := waitForCeph(ctx, e.cfg, conn, conn.Connect); !connected {
+		return nil, withCategory(errCephUnreachable, fmt.Errorf("connect to cluster: %w", err))
+	}
+	return conn, nil
+}
+
+// kubeClients returns the Kubernetes clients, creating them on first use.
+func (e *checkEnv) kubeClients() ([]*kubeClient, error) {
+	if e.kubes != nil {
+		return e.kubes, nil
+	}
+	kubes, err := newKubeClients(e.cfg)
+	if err != nil {
+		return nil, withCategory(errKubernetes, err)
+	}
+	e.shutdown = append(e.shutdown, func() { shutdownKubeClients(kubes) })
+	e.kubes = kubes
+	return kubes, nil
+}
+
+func (e *checkEnv) close() {
+	for _, fn := range slices.Backward(e.shutdown) {
+		fn()
+	}
+}
+
+// runCheck runs the check called name. It returns whether the check found a
+// problem.
+func (e *checkEnv) runCheck(ctx context.Context, name string) (bool, error) {
+	switch name {
+	case "ceph":
+		conn, err := e.ceph(ctx)
+		if err != nil {
+			return false, err
+		}
+		services, err := getMgrServices(conn)
+		if err != nil {
+			return false, withCategory(errCephUnreachable, fmt.Errorf("get mgr services: %w", err))
+		}
+		slog.Info("Ceph reachable", "services", len(services))
+		return false, nil
+	case "kubernetes":
+		return checkKubernetes(e.cfg, e.timeout)
+	case "rbac":
+		return checkRBAC(ctx, e.cfg, os.Stdout)
+	case "service":
+		conn, err := e.ceph(ctx)
+		if err != nil {
+			return false, err
+		}
+		kubes, err := e.kubeClients()
+		if err != nil {
+			return false, err
+		}
+		return checkServices(ctx, e.cfg, conn, kubes)
+	case "modules":
+		conn, err := e.ceph(ctx)
+		if err != nil {
+			return false, err
+		}
+		return checkMgrModules(conn, e.cfg)
+	case "drift":
+		conn, err := e.ceph(ctx)
+		if err != nil {
+			return false, err
+		}
+		kubes, err := e.kubeClients()
+		if err != nil {
+			return false, err
+		}
+		return checkDrift(ctx, e.cfg, conn, kubes)
+	case "probe":
+		tlsConfig, err := probeTLSConfig(e.caFile, e.insecure)
+		if err != nil {
+			return false, err
+		}
+		conn, err := e.ceph(ctx)
+		if err != nil {
+			return false, err
+		}
+		return probeServiceURLs(ctx, e.cfg, conn, tlsConfig)
+	}
+	return false, fmt.Errorf("unknown check %q", name)
+}
+
+// checkKubernetes asks the API server of every cluster for its version,
+// waiting up to timeout when set. It returns an error for the first cluster
+// that does not answer.
+func checkKubernetes(cfg config, timeout time.Duration) (bool, error) {
+	for _, cl := range cfg.clusters {
+		config, err := restConfig(cfg, cl)
+		if err != nil {
+			return false, fmt.Errorf("cluster %s: %w", cl.name, err)
+		}
+		config.Timeout = timeout
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return false, fmt.Errorf("cluster %s: create clientset: %w", cl.name, err)
+		}
+		version, err := clientset.Discovery().ServerVersion()
+		if err != nil {
+			return false, withCategory(errKubernetes, fmt.Errorf("cluster %s: get server version: %w", cl.name, err))
+		}
+		slog.Info("Kubernetes reachable", "cluster", cl.name, "version", version.GitVersion)
+	}
+	return false, nil
+}
+
+// check runs the checks selected by args and returns the exit code: 0 when
+// every check passed, 1 when the checks timed out, and otherwise that of the
+// first check that did not pass, 1 for a problem or the exit code of the
+// failure category when it could not run.
+func check(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	only := flags.String("only", "", "comma-separated checks to run, out of "+strings.Join(checkNames, ", ")+"; all when empty")
+	timeout := flags.Duration("timeout", 0, "give up on the checks after this long, 0 for no limit")
+	selected := make(map[string]*bool)
+	for name, usage := range map[string]string{
+		"rbac":    "report missing RBAC permissions and print a Role and RoleBinding granting them",
+		"service": "report mapping Services that are missing, have a selector or lack a port for the published endpoints",
+		"modules": "report mgr modules of the configured mappings that are disabled, failed or publish no URL",
+		"drift":   "report managed EndpointSlices that differ from what would be published now",
+		"probe":   "request the discovered service URLs and report whether they answer",
+	} {
+		selected[name] = flags.Bool(name, false, usage+"; same as --only "+name)
+	}
+	caFile := flags.String("ca-file", "", "CA certificates to trust in addition to the system roots when probing")
+	insecure := flags.Bool("insecure-skip-verify", false, "do not verify certificates when probing")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() > 0 || *timeout < 0 {
+		flags.Usage()
+		return 2
+	}
+	var names []string
+	if *only != "" {
+		for _, name := range strings.Split(*only, ",") {
+			if name = strings.TrimSpace(name); !slices.Contains(checkNames, name) {
+				fmt.Fprintf(os.Stderr, "unknown check %q, want one of %s\n", name, strings.Join(checkNames, ", "))
+				return 2
+			}
+			names = append(names, name)
+		}
+	}
+	for name, set := range selected {
+		if *set {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = checkNames
+	}
+	names = slices.DeleteFunc(slices.Clone(checkNames), func(name string) bool { return !slices.Contains(names, name) })
+
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("failed to load config", "error", err)
+		return exitCode(err)
+	}
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+
+	env := &checkEnv{cfg: cfg, timeout: *timeout, caFile: *caFile, insecure: *insecure}
+	var current atomic.Value
+	current.Store(names[0])
+	done := make(chan int, 1)
+	go func() {
+		defer env.close()
+		code := 0
+		for _, name := range names {
+			current.Store(name)
+			problem, err := env.runCheck(ctx, name)
+			if err != nil {
+				slog.Error("check failed", "check", name, "error", err)
+				if code == 0 {
+					code = exitCode(err)
+				}
+				continue
+			}
+			if problem && code == 0 {
+				code = 1
+			}
+		}
+		done <- code
+	}()
+	select {
+	case code := <-done:
+		if ctx.Err() == nil {
+			return code
+		}
+	case <-ctx.Done():
+	}
+	slog.Error("checks timed out", "timeout", *timeout, "check", current.Load())
+	return 1
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+// ciliumGlobalAnnotations mark a Service as a Cilium cluster-mesh global
+// service whose backends are shared with the other meshed clusters.
+var ciliumGlobalAnnotations = map[string]string{
+	"service.cilium.io/global": "true",
+	"service.cilium.io/shared": "true",
+}
+
+// annotateCiliumGlobal stamps the mapping's Service with the Cilium global
+// service annotations.
+func annotateCiliumGlobal(ctx context.Context, kube *kubeClient, m mapping) error {
+	svc, err := kube.getService(ctx, m.namespace, m.serviceName)
+	if err != nil {
+		return fmt.Errorf("get Service: %w", err)
+	}
+	current := make(map[string]string)
+	for key := range ciliumGlobalAnnotations {
+		if value, ok := svc.Annotations[key]; ok {
+			current[key] = value
+		}
+	}
+	diff := changedKeys(current, ciliumGlobalAnnotations, func(a, b string) bool { return a == b })
+	if len(diff) == 0 {
+		return nil
+	}
+	manager := fieldManager + "-cilium"
+	service := corev1apply.Service(m.serviceName, m.namespace).WithAnnotations(ciliumGlobalAnnotations)
+	_, err = kube.clientset.CoreV1().Services(m.namespace).Apply(ctx, service, metav1.ApplyOptions{FieldManager: manager})
+	auditMutation(kube, "apply", "services", m.namespace, m.serviceName, manager, []any{"annotations", diff}, err)
+	if err != nil {
+		return fmt.Errorf("apply Service: %w", err)
+	}
+	slog.InfoContext(ctx, "annotated Service as Cilium global service", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName)
+	return nil
+}
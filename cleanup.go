@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+var (
+	configMapResource = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+	secretResource    = schema.GroupVersionResource{Version: "v1", Resource: "secrets"}
+	leaseResource     = schema.GroupVersionResource{Group: "coordination.k8s.io", Version: "v1", Resource: "leases"}
+)
+
+// deleteManagedObject deletes an object the controller created. Objects
+// without the controller's managed-by label are left alone.
+func deleteManagedObject(ctx context.Context, kube *kubeClient, gvr schema.GroupVersionResource, namespace, name string) error {
+	client := kube.dynamic.Resource(gvr).Namespace(namespace)
+	obj, err := client.Get(ctx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get %s %s/%s: %w", gvr.Resource, namespace, name, err)
+	}
+	if obj.GetLabels()["app.kubernetes.io/managed-by"] != fieldManager {
+		return nil
+	}
+	err = client.Delete(ctx, name, metav1.DeleteOptions{})
+	auditMutation(kube, "delete", gvr.Resource, namespace, name, fieldManager, nil, err)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("delete %s %s/%s: %w", gvr.Resource, namespace, name, err)
+	}
+	slog.Info("deleted managed object", "cluster", kube.name, "resource", gvr.Resource, "namespace", namespace, "name", name)
+	return nil
+}
+
+// releaseServiceFields removes the labels and annotations that manager set on
+// the mapping's Service by applying an empty configuration.
+func releaseServiceFields(ctx context.Context, kube *kubeClient, m mapping, manager string) error {
+	svc, err := kube.clientset.CoreV1().Services(m.namespace).Get(ctx, m.serviceName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get Service: %w", err)
+	}
+	if !slices.ContainsFunc(svc.ManagedFields, func(f metav1.ManagedFieldsEntry) bool { return f.Manager == manager }) {
+		return nil
+	}
+	_, err = kube.clientset.CoreV1().Services(m.namespace).Apply(ctx, corev1apply.Service(m.serviceName, m.namespace), metav1.ApplyOptions{FieldManager: manager})
+	auditMutation(kube, "apply", "services", m.namespace, m.serviceName, manager, []any{"released", true}, err)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("release Service fields of %s: %w", manager, err)
+	}
+	slog.Info("released Service fields", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "manager", manager)
+	return nil
+}
+
+// objectRef identifies an object the controller creates.
+type objectRef struct {
+	gvr       schema.GroupVersionResource
+	namespace string
+	name      string
+}
+
+// mappingObjects lists the objects cfg makes the controller create for m,
+// besides its EndpointSlices.
+func mappingObjects(cfg config, m mapping) []objectRef {
+	var refs []objectRef
+	add := func(gvr schema.GroupVersionResource, name string) {
+		refs = append(refs, objectRef{gvr: gvr, namespace: m.namespace, name: name})
+	}
+	if cfg.serviceExport {
+		add(serviceExportResource, m.serviceName)
+	}
+	if m.module == "dashboard" && cfg.route.termination != "" {
+		add(routeResource, m.serviceName)
+	}
+	if m.module == "dashboard" && cfg.traefik.host != "" {
+		if cfg.traefik.passthrough {
+			add(ingressRouteTCPResource, m.serviceName)
+		} else {
+			add(ingressRouteResource, m.serviceName)
+		}
+	}
+	if m.module == "prometheus" && cfg.vmScrape.enabled {
+		add(vmServiceScrapeResource, m.serviceName)
+	}
+	if m.module == "prometheus" && cfg.grafana.enabled {
+		add(grafanaDatasourceResource, m.serviceName)
+	}
+	if m.module == "prometheus" && cfg.scrapeConfig.jobName != "" {
+		add(configMapResource, scrapeConfigMapName(m))
+	}
+	if m.module == "restful" && cfg.restfulSecret != "" {
+		add(secretResource, cfg.restfulSecret)
+	}
+	return refs
+}
+
+// globalConfigMaps lists the ConfigMaps the controller publishes in its own
+// namespace, apart from the per-replica status ConfigMap.
+func globalConfigMaps(cfg config) []objectRef {
+	var refs []objectRef
+	for _, name := range []string{cfg.moduleTargets, cfg.serviceURLs} {
+		if name != "" {
+			refs = append(refs, objectRef{gvr: configMapResource, namespace: cfg.namespace, name: name})
+		}
+	}
+	return refs
+}
+
+// cleanupMapping deletes the EndpointSlices and generated objects of m and
+// releases the Service metadata the controller set.
+func cleanupMapping(ctx context.Context, cfg config, kube *kubeClient, m mapping) error {
+	if err := deleteStaleEndpointSlices(ctx, kube, m, nil); err != nil {
+		return err
+	}
+	for _, ref := range mappingObjects(cfg, m) {
+		if err := deleteManagedObject(ctx, kube, ref.gvr, ref.namespace, ref.name); err != nil {
+			return err
+		}
+	}
+
+	managers := []string{fieldManager + "-" + m.module}
+	if m.module == "dashboard" && cfg.dashboardCert.enabled {
+		managers = append(managers, fieldManager+"-cert")
+	}
+	if cfg.ciliumGlobal {
+		managers = append(managers, fieldManager+"-cilium")
+	}
+	if cfg.linkerdExport != "" {
+		managers = append(managers, fieldManager+"-linkerd")
+	}
+	for _, manager := range managers {
+		if err := releaseServiceFields(ctx, kube, m, manager); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanupOnExit removes everything the controller created, for ephemeral
+// environments where stopping the controller should leave no trace.
+func cleanupOnExit(ctx context.Context, cfg config, kubes []*kubeClient, state *runState) {
+	for _, m := range append(slices.Clone(cfg.mappings), state.serviceMappings...) {
+		for _, kube := range state.shards.targets(cfg, m, kubes) {
+			if err := cleanupMapping(ctx, cfg, kube, m); err != nil {
+				slog.Error("failed to clean up mapping", "cluster", kube.name, "namespace", m.namespace, "slice", m.slice, "error", err)
+			}
+		}
+	}
+	if !state.shards.ownsGlobal(cfg) {
+		return
+	}
+	refs := globalConfigMaps(cfg)
+	if cfg.statusConfigMap != "" {
+		refs = append(refs, objectRef{gvr: configMapResource, namespace: cfg.namespace, name: statusConfigMapName(cfg, state)})
+	}
+	for _, kube := range kubes {
+		for _, ref := range refs {
+			if err := deleteManagedObject(ctx, kube, ref.gvr, ref.namespace, ref.name); err != nil {
+				slog.Error("failed to clean up ConfigMap", "cluster", kube.name, "error", err)
+			}
+		}
+		if cfg.heartbeatLease != "" {
+			if err := deleteManagedObject(ctx, kube, leaseResource, cfg.namespace, heartbeatLeaseName(cfg, state)); err != nil {
+				slog.Error("failed to clean up heartbeat Lease", "cluster", kube.name, "error", err)
+			}
+		}
+	}
+}
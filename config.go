@@ -0,0 +1,1298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/rest"
+)
+
+type rawConfig struct {
+	Debug           *bool           `json:"debug,omitempty"`
+	RepeatInterval  string          `json:"repeatedErrorInterval,omitempty"`
+	LogFile         *rawLogFile     `json:"logFile,omitempty"`
+	Interval        string          `json:"interval,omitempty"`
+	Jitter          int             `json:"jitter,omitempty"`
+	Timeout         string          `json:"timeout,omitempty"`
+	FullResync      string          `json:"fullResyncInterval,omitempty"`
+	StartupTimeout  string          `json:"startupTimeout,omitempty"`
+	StartupRetries  int             `json:"startupRetries,omitempty"`
+	MarkTerminating bool            `json:"markTerminatingOnShutdown,omitempty"`
+	FailFast        *rawFailFast    `json:"failFast,omitempty"`
+	StateFile       string          `json:"stateFile,omitempty"`
+	Sharding        *rawSharding    `json:"sharding,omitempty"`
+	ServiceSelector *rawSelector    `json:"serviceSelector,omitempty"`
+	Annotated       *rawAnnotated   `json:"annotatedServices,omitempty"`
+	Resources       *rawAnnotated   `json:"endpointResources,omitempty"`
+	Webhook         *rawWebhook     `json:"webhook,omitempty"`
+	DryRunDiff      bool            `json:"dryRunDiff,omitempty"`
+	ConflictPolicy  string          `json:"conflictPolicy,omitempty"`
+	ManageModules   bool            `json:"manageModules,omitempty"`
+	MgrBind         *rawMgrBind     `json:"mgrBind,omitempty"`
+	ConfigFallback  bool            `json:"configFallback,omitempty"`
+	Resolve         *rawResolve     `json:"resolveHostnames,omitempty"`
+	Simulation      *rawSimulation  `json:"failoverSimulation,omitempty"`
+	PreferredNets   []string        `json:"preferredNetworks,omitempty"`
+	AddressMap      []rawRewrite    `json:"addressMap,omitempty"`
+	AllowedCIDRs    []string        `json:"allowedCIDRs,omitempty"`
+	NodeAddresses   bool            `json:"nodeAddresses,omitempty"`
+	DualStack       bool            `json:"dualStack,omitempty"`
+	DashboardPorts  bool            `json:"dashboardPorts,omitempty"`
+	CleanupOnExit   bool            `json:"cleanupOnExit,omitempty"`
+	MigrateManagers []string        `json:"migrateFieldManagers,omitempty"`
+	MetricsAddr     string          `json:"metricsAddr,omitempty"`
+	MetricsTLS      *rawMetricsTLS  `json:"metricsTLS,omitempty"`
+	MetricsToken    string          `json:"metricsTokenFile,omitempty"`
+	Pushgateway     *rawPushgateway `json:"pushgateway,omitempty"`
+	OTLP            *rawOTLP        `json:"otlp,omitempty"`
+	VerifyActiveMgr bool            `json:"verifyActiveMgr,omitempty"`
+	SkipUnchanged   bool            `json:"skipUnchanged,omitempty"`
+	ModuleTargets   string          `json:"moduleTargets,omitempty"`
+	ServiceURLs     string          `json:"serviceURLs,omitempty"`
+	StatusConfigMap string          `json:"statusConfigMap,omitempty"`
+	HeartbeatLease  string          `json:"heartbeatLease,omitempty"`
+	AuditLog        string          `json:"auditLog,omitempty"`
+	DashboardCert   *rawCertCheck   `json:"dashboardCert,omitempty"`
+	ServiceExport   bool            `json:"serviceExport,omitempty"`
+	CiliumGlobal    bool            `json:"ciliumGlobalService,omitempty"`
+	LinkerdExport   string          `json:"linkerdExport,omitempty"`
+	Route           *rawRoute       `json:"route,omitempty"`
+	Traefik         *rawTraefik     `json:"traefik,omitempty"`
+	ScrapeConfig    *rawScrape      `json:"scrapeConfig,omitempty"`
+	VMServiceScrape *rawVMScrape    `json:"vmServiceScrape,omitempty"`
+	Grafana         *rawGrafana     `json:"grafana,omitempty"`
+	RestfulSecret   string          `json:"restfulSecret,omitempty"`
+	RestfulUser     string          `json:"restfulUser,omitempty"`
+	Namespace       string          `json:"namespace,omitempty"`
+	ServiceName     string          `json:"serviceName,omitempty"`
+	DashboardSlice  string          `json:"dashboardSlice,omitempty"`
+	PrometheusSlice string          `json:"prometheusSlice,omitempty"`
+	Mappings        []rawMapping    `json:"mappings,omitempty"`
+	Clusters        []rawCluster    `json:"clusters,omitempty"`
+	Impersonate     *rawImpersonate `json:"impersonate,omitempty"`
+	Retry           *rawRetry       `json:"retry,omitempty"`
+}
+
+type rawTraefik struct {
+	Host             string   `json:"host"`
+	EntryPoints      []string `json:"entryPoints,omitempty"`
+	Passthrough      bool     `json:"passthrough,omitempty"`
+	SecretName       string   `json:"secretName,omitempty"`
+	CertResolver     string   `json:"certResolver,omitempty"`
+	ServersTransport string   `json:"serversTransport,omitempty"`
+}
+
+type rawScrape struct {
+	JobName            string `json:"jobName,omitempty"`
+	CAFile             string `json:"caFile,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+type rawVMScrape struct {
+	Interval           string `json:"interval,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
+}
+
+type rawGrafana struct {
+	InstanceSelector          map[string]string `json:"instanceSelector"`
+	AllowCrossNamespaceImport bool              `json:"allowCrossNamespaceImport,omitempty"`
+	InsecureSkipVerify        bool              `json:"insecureSkipVerify,omitempty"`
+}
+
+type rawResolve struct {
+	Resolver  string `json:"resolver,omitempty"`
+	Timeout   string `json:"timeout,omitempty"`
+	TTL       string `json:"ttl,omitempty"`
+	Addresses string `json:"addresses,omitempty"`
+	Prefer    string `json:"prefer,omitempty"`
+}
+
+type rawSimulation struct {
+	Addresses []string `json:"addresses"`
+	Interval  string   `json:"interval,omitempty"`
+}
+
+type rawRewrite struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type rawRoute struct {
+	Host          string `json:"host,omitempty"`
+	Termination   string `json:"termination,omitempty"`
+	DestinationCA string `json:"destinationCACertificate,omitempty"`
+}
+
+type rawCertCheck struct {
+	WarnBefore string `json:"warnBefore,omitempty"`
+}
+
+type rawWebhook struct {
+	Addr     string `json:"addr,omitempty"`
+	CertDir  string `json:"certDir,omitempty"`
+	ClientCA string `json:"clientCA,omitempty"`
+}
+
+type rawMetricsTLS struct {
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+	ClientCA string `json:"clientCA,omitempty"`
+}
+
+type rawPushgateway struct {
+	URL string `json:"url"`
+	Job string `json:"job,omitempty"`
+}
+
+type rawLogFile struct {
+	Path       string `json:"path"`
+	MaxSizeMB  int    `json:"maxSizeMB,omitempty"`
+	MaxAge     string `json:"maxAge,omitempty"`
+	MaxBackups *int   `json:"maxBackups,omitempty"`
+}
+
+type rawOTLP struct {
+	Endpoint   string `json:"endpoint"`
+	Interval   string `json:"interval,omitempty"`
+	HeadersDir string `json:"headersDir,omitempty"`
+}
+
+// rawAnnotated lists the namespaces watched for Services or resources that
+// opt in to publishing.
+type rawAnnotated struct {
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+type rawSelector struct {
+	Selector   string   `json:"selector"`
+	Namespaces []string `json:"namespaces,omitempty"`
+}
+
+type rawSharding struct {
+	Shards        int    `json:"shards"`
+	By            string `json:"by,omitempty"`
+	Lease         string `json:"lease,omitempty"`
+	LeaseDuration string `json:"leaseDuration,omitempty"`
+}
+
+type rawFailFast struct {
+	Attempts int    `json:"attempts,omitempty"`
+	Window   string `json:"window,omitempty"`
+}
+
+type rawRetry struct {
+	Ceph *rawRetryPolicy `json:"ceph,omitempty"`
+	Kube *rawRetryPolicy `json:"kube,omitempty"`
+}
+
+type rawRetryPolicy struct {
+	InitialDelay string  `json:"initialDelay,omitempty"`
+	Multiplier   float64 `json:"multiplier,omitempty"`
+	MaxDelay     string  `json:"maxDelay,omitempty"`
+	MaxAttempts  int     `json:"maxAttempts,omitempty"`
+}
+
+type rawMapping struct {
+	Module      string `json:"module"`
+	Namespace   string `json:"namespace,omitempty"`
+	ServiceName string `json:"serviceName"`
+	Slice       string `json:"slice"`
+	AllMgrs     bool   `json:"allMgrs,omitempty"`
+	DaemonType  string `json:"daemonType,omitempty"`
+	Interval    string `json:"interval,omitempty"`
+	Disabled    bool   `json:"disabled,omitempty"`
+	OnDisable   string `json:"onDisable,omitempty"`
+	Port        int    `json:"port,omitempty"`
+}
+
+type rawCluster struct {
+	Name       string `json:"name"`
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+	Context    string `json:"context,omitempty"`
+}
+
+type rawMgrBind struct {
+	DashboardServerAddr    string `json:"dashboardServerAddr,omitempty"`
+	DashboardSSLServerPort int    `json:"dashboardSSLServerPort,omitempty"`
+	PrometheusServerPort   int    `json:"prometheusServerPort,omitempty"`
+}
+
+type rawImpersonate struct {
+	User   string              `json:"user,omitempty"`
+	UID    string              `json:"uid,omitempty"`
+	Groups []string            `json:"groups,omitempty"`
+	Extra  map[string][]string `json:"extra,omitempty"`
+}
+
+type config struct {
+	debug           bool
+	repeatInterval  time.Duration
+	logFile         logFileConfig
+	interval        time.Duration
+	jitter          int
+	timeout         time.Duration
+	fullResync      time.Duration
+	startupTimeout  time.Duration
+	startupRetries  int
+	markTerminating bool
+	failFast        failFastPolicy
+	stateFile       string
+	shards          int
+	shardBy         string
+	shardLease      string
+	leaseDuration   time.Duration
+	selector        serviceSelector
+	watchNamespaces []string
+	crdNamespaces   []string
+	webhook         webhookConfig
+	dryRunDiff      bool
+	conflictPolicy  string
+	manageModules   bool
+	mgrBind         []mgrOption
+	configFallback  bool
+	resolve         resolveConfig
+	simulation      failoverSimulation
+	preferredNets   []*net.IPNet
+	addressMap      []addressRewrite
+	allowedNets     []*net.IPNet
+	nodeAddresses   bool
+	dualStack       bool
+	dashboardPorts  bool
+	cleanupOnExit   bool
+	migrateManagers []string
+	metricsAddr     string
+	metricsTLS      metricsTLSConfig
+	// metricsToken is the file holding the bearer token /metrics requires.
+	metricsToken    string
+	pushgateway     pushgatewayConfig
+	otlp            otlpConfig
+	verifyActiveMgr bool
+	skipUnchanged   bool
+	moduleTargets   string
+	serviceURLs     string
+	statusConfigMap string
+	heartbeatLease  string
+	auditLog        string
+	dashboardCert   certCheck
+	serviceExport   bool
+	ciliumGlobal    bool
+	linkerdExport   string
+	route           routeConfig
+	traefik         traefikConfig
+	scrapeConfig    scrapeConfig
+	vmScrape        vmScrapeConfig
+	grafana         grafanaConfig
+	restfulSecret   string
+	restfulUser     string
+	namespace       string
+	mappings        []mapping
+	clusters        []cluster
+	impersonate     rest.ImpersonationConfig
+	cephRetry       retryPolicy
+	kubeRetry       retryPolicy
+	cephID          string
+	cephKey         string
+}
+
+// serviceSelector selects Services whose ports are published without a
+// configured mapping. An empty selector disables it.
+type serviceSelector struct {
+	selector   string
+	namespaces []string
+}
+
+// webhookConfig enables the CephMgrEndpoint admission webhook when addr is
+// set.
+type webhookConfig struct {
+	addr     string
+	certDir  string
+	clientCA string
+}
+
+// metricsTLSConfig serves /metrics over HTTPS when certFile is set. With a
+// client CA, scrapers must present a certificate signed by it.
+type metricsTLSConfig struct {
+	certFile string
+	keyFile  string
+	clientCA string
+}
+
+// pushgatewayConfig pushes the metrics of a --once run to a Prometheus
+// Pushgateway when url is set.
+type pushgatewayConfig struct {
+	url string
+	job string
+}
+
+// logFileConfig writes the logs to path instead of standard error when set,
+// rotating the file once it reaches maxSize bytes or maxAge.
+type logFileConfig struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+}
+
+// resolveConfig resolves hostnames in mgr service URLs when enabled, with the
+// DNS server at address or the system resolver, caching addresses for ttl.
+// all publishes every address of a hostname rather than the first, prefer
+// orders addresses of one family (ipv4 or ipv6) first, and networks narrows
+// them to those in preferred networks.
+type resolveConfig struct {
+	enabled  bool
+	address  string
+	timeout  time.Duration
+	ttl      time.Duration
+	all      bool
+	prefer   string
+	networks []*net.IPNet
+}
+
+// otlpConfig exports the metrics to an OTLP/HTTP collector every interval
+// when endpoint is set, with the headers in the files of headersDir.
+type otlpConfig struct {
+	endpoint   string
+	interval   time.Duration
+	headersDir string
+}
+
+// routeConfig exposes dashboard mappings through an OpenShift Route when
+// termination is set.
+type routeConfig struct {
+	host          string
+	termination   string
+	destinationCA string
+}
+
+// scrapeConfig publishes a Prometheus scrape_configs fragment for prometheus
+// mappings when jobName is set.
+type scrapeConfig struct {
+	jobName  string
+	caFile   string
+	insecure bool
+}
+
+// vmScrapeConfig creates VictoriaMetrics VMServiceScrapes for prometheus
+// mappings when enabled.
+type vmScrapeConfig struct {
+	enabled  bool
+	interval string
+	insecure bool
+}
+
+// grafanaConfig creates Grafana Operator GrafanaDatasources for prometheus
+// mappings, matching Grafana instances by instanceLabels, when enabled.
+type grafanaConfig struct {
+	enabled        bool
+	instanceLabels map[string]string
+	crossNamespace bool
+	insecure       bool
+}
+
+// traefikConfig exposes dashboard mappings through Traefik IngressRoute or
+// IngressRouteTCP resources when host is set.
+type traefikConfig struct {
+	host             string
+	entryPoints      []string
+	passthrough      bool
+	secretName       string
+	certResolver     string
+	serversTransport string
+}
+
+// certCheck enables inspection of the dashboard certificate. Expiry within
+// warnBefore emits a warning Event; zero disables the warning.
+type certCheck struct {
+	enabled    bool
+	warnBefore time.Duration
+}
+
+// failFastPolicy makes the controller exit when it cannot complete a first
+// reconcile. A zero value disables it.
+type failFastPolicy struct {
+	attempts int
+	window   time.Duration
+}
+
+type mgrOption struct {
+	name  string
+	value string
+}
+
+type cluster struct {
+	name       string
+	kubeconfig string
+	context    string
+}
+
+type mapping struct {
+	module      string
+	namespace   string
+	serviceName string
+	slice       string
+	allMgrs     bool
+	daemonType  string
+	// cluster restricts the mapping to one Kubernetes cluster when its slice
+	// name was rendered from a template referencing the cluster.
+	cluster string
+	// discovered marks mappings derived from Services rather than the
+	// configuration; they are skipped when the module is not available.
+	discovered bool
+	// resource names the CephMgrEndpoint a mapping was derived from.
+	resource string
+	// interval overrides the global reconcile interval when set.
+	interval time.Duration
+	// disabled stops publishing the mapping; onDisable is what happens to
+	// its slices meanwhile: keep, not-ready or delete.
+	disabled  bool
+	onDisable string
+	// port overrides the published port when set.
+	port int32
+}
+
+// appliesTo reports whether the mapping publishes into the named cluster.
+func (m mapping) appliesTo(cluster string) bool {
+	return m.cluster == "" || m.cluster == cluster
+}
+
+// key identifies the mapping across runs.
+func (m mapping) key() string {
+	return m.namespace + "/" + m.slice + "/" + m.cluster
+}
+
+type sliceNameData struct {
+	Service   string
+	Module    string
+	Namespace string
+	Cluster   string
+}
+
+// expandSliceTemplates renders slice names written as Go templates. A name
+// that depends on the cluster yields one mapping per cluster.
+func expandSliceTemplates(mappings []mapping, clusters []cluster) ([]mapping, error) {
+	var expanded []mapping
+	for _, m := range mappings {
+		if !strings.Contains(m.slice, "{{") {
+			expanded = append(expanded, m)
+			continue
+		}
+		tmpl, err := template.New("slice").Option("missingkey=error").Parse(m.slice)
+		if err != nil {
+			return nil, fmt.Errorf("slice template %q: %w", m.slice, err)
+		}
+		names := make(map[string]string)
+		for _, cl := range clusters {
+			var b strings.Builder
+			data := sliceNameData{Service: m.serviceName, Module: m.module, Namespace: m.namespace, Cluster: cl.name}
+			if err := tmpl.Execute(&b, data); err != nil {
+				return nil, fmt.Errorf("slice template %q: %w", m.slice, err)
+			}
+			if errs := validation.IsDNS1123Subdomain(b.String()); len(errs) > 0 {
+				return nil, fmt.Errorf("slice template %q renders invalid name %q: %s", m.slice, b.String(), strings.Join(errs, ", "))
+			}
+			names[cl.name] = b.String()
+		}
+		if len(slices.Compact(slices.Sorted(maps.Values(names)))) == 1 {
+			m.slice = names[clusters[0].name]
+			expanded = append(expanded, m)
+			continue
+		}
+		for _, cl := range clusters {
+			cm := m
+			cm.slice = names[cl.name]
+			cm.cluster = cl.name
+			expanded = append(expanded, cm)
+		}
+	}
+	return expanded, nil
+}
+
+// mappingNamespaces returns the sorted set of namespaces targeted by the
+// configured mappings, the service selector, annotated Services and
+// CephMgrEndpoint resources.
+func (c config) mappingNamespaces() []string {
+	var namespaces []string
+	for _, namespace := range slices.Concat(c.selector.namespaces, c.watchNamespaces, c.crdNamespaces) {
+		if !slices.Contains(namespaces, namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	for _, m := range c.mappings {
+		if !slices.Contains(namespaces, m.namespace) {
+			namespaces = append(namespaces, m.namespace)
+		}
+	}
+	slices.Sort(namespaces)
+	return namespaces
+}
+
+// runTimeout returns the deadline for a single reconcile, defaulting to the
+// polling interval so that a hung run cannot overlap the next tick.
+func (c config) runTimeout() time.Duration {
+	if c.timeout > 0 {
+		return c.timeout
+	}
+	return c.tickInterval()
+}
+
+// metricsEnabled reports whether metrics are served or pushed, so that
+// reconciles gather the data behind them.
+func (c config) metricsEnabled() bool {
+	return c.metricsAddr != "" || c.pushgateway.url != "" || c.otlp.endpoint != ""
+}
+
+// tickInterval returns how often the controller wakes up: the shortest of the
+// global and per-mapping intervals. All mappings share this one tick, so a
+// slow mapping delays the others that are due with it.
+func (c config) tickInterval() time.Duration {
+	tick := c.interval
+	for _, m := range c.mappings {
+		if m.interval > 0 && (tick == 0 || m.interval < tick) {
+			tick = m.interval
+		}
+	}
+	return tick
+}
+
+// mappingInterval returns how often mapping m is reconciled.
+func (c config) mappingInterval(m mapping) time.Duration {
+	if m.interval > 0 {
+		return m.interval
+	}
+	return c.interval
+}
+
+// fromMgrServices reports whether the mapping is resolved from the mgr
+// services map rather than from orchestrator daemons.
+func (m mapping) fromMgrServices() bool {
+	return m.daemonType == ""
+}
+
+// loadConfig reads and validates the configuration file.
+func loadConfig() (config, error) {
+	cfg, err := readConfig()
+	return cfg, withCategory(errInvalidConfig, err)
+}
+
+func readConfig() (config, error) {
+	var cephID string
+	if data, err := os.ReadFile("/var/run/secrets/ceph/userID"); err == nil {
+		cephID = strings.TrimSpace(string(data))
+	}
+
+	var cephKey string
+	if data, err := os.ReadFile("/var/run/secrets/ceph/userKey"); err == nil {
+		cephKey = strings.TrimSpace(string(data))
+	}
+
+	path := "/etc/ceph-mgr-endpoint-controller/config.json"
+	if v := os.Getenv("CEPH_MGR_CONFIG_PATH"); v != "" {
+		path = v
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return config{
+				cephRetry: defaultRetryPolicy,
+				kubeRetry: defaultRetryPolicy,
+				cephID:    cephID,
+				cephKey:   cephKey,
+			}, nil
+		}
+		return config{}, fmt.Errorf("open config file: %w", err)
+	}
+	defer f.Close()
+	var raw rawConfig
+	if err := json.NewDecoder(f).Decode(&raw); err != nil {
+		return config{}, fmt.Errorf("decode config file: %w", err)
+	}
+	var interval time.Duration
+	if raw.Interval != "" {
+		parsed, err := time.ParseDuration(raw.Interval)
+		if err != nil {
+			return config{}, fmt.Errorf("invalid duration in config: %w", err)
+		}
+		if parsed <= 0 {
+			return config{}, fmt.Errorf("interval must be positive: %s", raw.Interval)
+		}
+		interval = parsed
+	}
+	var timeout time.Duration
+	if raw.Timeout != "" {
+		parsed, err := time.ParseDuration(raw.Timeout)
+		if err != nil {
+			return config{}, fmt.Errorf("invalid timeout in config: %w", err)
+		}
+		if parsed <= 0 {
+			return config{}, fmt.Errorf("timeout must be positive: %s", raw.Timeout)
+		}
+		timeout = parsed
+	}
+	repeatInterval := 5 * time.Minute
+	if raw.RepeatInterval != "" {
+		parsed, err := time.ParseDuration(raw.RepeatInterval)
+		if err != nil {
+			return config{}, fmt.Errorf("invalid repeatedErrorInterval in config: %w", err)
+		}
+		if parsed < 0 {
+			return config{}, fmt.Errorf("repeatedErrorInterval must not be negative: %s", raw.RepeatInterval)
+		}
+		repeatInterval = parsed
+	}
+	var logFile logFileConfig
+	if raw.LogFile != nil {
+		if raw.LogFile.Path == "" {
+			return config{}, fmt.Errorf("logFile path is required")
+		}
+		logFile = logFileConfig{path: raw.LogFile.Path, maxSize: 100 << 20, maxBackups: 5}
+		if raw.LogFile.MaxSizeMB < 0 {
+			return config{}, fmt.Errorf("logFile maxSizeMB must not be negative: %d", raw.LogFile.MaxSizeMB)
+		}
+		if raw.LogFile.MaxSizeMB > 0 {
+			logFile.maxSize = int64(raw.LogFile.MaxSizeMB) << 20
+		}
+		if raw.LogFile.MaxAge != "" {
+			parsed, err := time.ParseDuration(raw.LogFile.MaxAge)
+			if err != nil {
+				return config{}, fmt.Errorf("invalid logFile maxAge in config: %w", err)
+			}
+			if parsed <= 0 {
+				return config{}, fmt.Errorf("logFile maxAge must be positive: %s", raw.LogFile.MaxAge)
+			}
+			logFile.maxAge = parsed
+		}
+		if raw.LogFile.MaxBackups != nil {
+			if *raw.LogFile.MaxBackups < 0 {
+				return config{}, fmt.Errorf("logFile maxBackups must not be negative: %d", *raw.LogFile.MaxBackups)
+			}
+			logFile.maxBackups = *raw.LogFile.MaxBackups
+		}
+	}
+	var fullResync time.Duration
+	if raw.FullResync != "" {
+		parsed, err := time.ParseDuration(raw.FullResync)
+		if err != nil {
+			return config{}, fmt.Errorf("invalid fullResyncInterval in config: %w", err)
+		}
+		if parsed <= 0 {
+			return config{}, fmt.Errorf("fullResyncInterval must be positive: %s", raw.FullResync)
+		}
+		fullResync = parsed
+	}
+	var startupTimeout time.Duration
+	if raw.StartupTimeout != "" {
+		parsed, err := time.ParseDuration(raw.StartupTimeout)
+		if err != nil {
+			return config{}, fmt.Errorf("invalid startupTimeout in config: %w", err)
+		}
+		if parsed <= 0 {
+			return config{}, fmt.Errorf("startupTimeout must be positive: %s", raw.StartupTimeout)
+		}
+		startupTimeout = parsed
+	}
+	if raw.StartupRetries < 0 {
+		return config{}, fmt.Errorf("startupRetries must not be negative: %d", raw.StartupRetries)
+	}
+	if raw.Jitter < 0 || raw.Jitter >= 100 {
+		return config{}, fmt.Errorf("jitter must be between 0 and 99 percent: %d", raw.Jitter)
+	}
+	debug := false
+	if raw.Debug != nil {
+		debug = *raw.Debug
+	}
+	namespace := raw.Namespace
+	if namespace == "" {
+		if data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+			namespace = strings.TrimSpace(string(data))
+		}
+	}
+	if (raw.DashboardSlice != "" || raw.PrometheusSlice != "") && namespace == "" {
+		return config{}, fmt.Errorf("namespace is required when creating EndpointSlices")
+	}
+	if (raw.DashboardSlice != "" || raw.PrometheusSlice != "") && raw.ServiceName == "" {
+		return config{}, fmt.Errorf("service name is required when creating EndpointSlices")
+	}
+	if raw.ModuleTargets != "" && namespace == "" {
+		return config{}, fmt.Errorf("namespace is required when publishing module targets")
+	}
+	if raw.StatusConfigMap != "" && namespace == "" {
+		return config{}, fmt.Errorf("namespace is required when reporting status")
+	}
+	if raw.HeartbeatLease != "" && namespace == "" {
+		return config{}, fmt.Errorf("namespace is required when renewing a heartbeat Lease")
+	}
+	restfulUser := raw.RestfulUser
+	if restfulUser == "" {
+		restfulUser = "ceph-mgr-endpoint-controller"
+	}
+	var mappings []mapping
+	if raw.DashboardSlice != "" {
+		mappings = append(mappings, mapping{module: "dashboard", namespace: namespace, serviceName: raw.ServiceName, slice: raw.DashboardSlice})
+	}
+	if raw.PrometheusSlice != "" {
+		mappings = append(mappings, mapping{module: "prometheus", namespace: namespace, serviceName: raw.ServiceName, slice: raw.PrometheusSlice})
+	}
+	for i, rm := range raw.Mappings {
+		m := mapping{module: rm.Module, namespace: rm.Namespace, serviceName: rm.ServiceName, slice: rm.Slice, allMgrs: rm.AllMgrs, daemonType: rm.DaemonType}
+		if m.namespace == "" {
+			m.namespace = namespace
+		}
+		if m.daemonType != "" {
+			if m.module != "" || m.allMgrs {
+				return config{}, fmt.Errorf("mapping %d: daemonType cannot be combined with module or allMgrs", i)
+			}
+			m.module = m.daemonType
+		}
+		if m.module == "" {
+			return config{}, fmt.Errorf("mapping %d: module or daemonType is required", i)
+		}
+		if m.namespace == "" {
+			return config{}, fmt.Errorf("mapping %d: namespace is required", i)
+		}
+		if m.serviceName == "" {
+			return config{}, fmt.Errorf("mapping %d: service name is required", i)
+		}
+		if m.slice == "" {
+			return config{}, fmt.Errorf("mapping %d: slice is required", i)
+		}
+		if rm.Interval != "" {
+			parsed, err := time.ParseDuration(rm.Interval)
+			if err != nil {
+				return config{}, fmt.Errorf("mapping %d: invalid interval: %w", i, err)
+			}
+			if parsed <= 0 {
+				return config{}, fmt.Errorf("mapping %d: interval must be positive: %s", i, rm.Interval)
+			}
+			m.interval = parsed
+		}
+		if rm.Port < 0 || rm.Port > 65535 {
+			return config{}, fmt.Errorf("mapping %d: port out of range: %d", i, rm.Port)
+		}
+		m.port = int32(rm.Port)
+		m.disabled = rm.Disabled
+		m.onDisable = rm.OnDisable
+		if m.onDisable == "" {
+			m.onDisable = "keep"
+		}
+		if !slices.Contains([]string{"keep", "not-ready", "delete"}, m.onDisable) {
+			return config{}, fmt.Errorf("mapping %d: invalid onDisable policy: %s", i, m.onDisable)
+		}
+		mappings = append(mappings, m)
+	}
+	clusters := []cluster{{name: "in-cluster"}}
+	if len(raw.Clusters) > 0 {
+		clusters = nil
+		names := make(map[string]bool)
+		for i, rc := range raw.Clusters {
+			if rc.Name == "" {
+				return config{}, fmt.Errorf("cluster %d: name is required", i)
+			}
+			if names[rc.Name] {
+				return config{}, fmt.Errorf("duplicate cluster name: %s", rc.Name)
+			}
+			names[rc.Name] = true
+			clusters = append(clusters, cluster{name: rc.Name, kubeconfig: rc.Kubeconfig, context: rc.Context})
+		}
+	}
+	mappings, err = expandSliceTemplates(mappings, clusters)
+	if err != nil {
+		return config{}, err
+	}
+	seen := make(map[string]bool)
+	for _, m := range mappings {
+		for _, cl := range clusters {
+			if !m.appliesTo(cl.name) {
+				continue
+			}
+			key := m.namespace + "/" + m.slice
+			if seen[cl.name+"/"+key] {
+				return config{}, fmt.Errorf("duplicate EndpointSlice in mappings: %s", key)
+			}
+			seen[cl.name+"/"+key] = true
+		}
+	}
+	var metricsTLS metricsTLSConfig
+	if raw.MetricsTLS != nil {
+		if raw.MetricsTLS.CertFile == "" || raw.MetricsTLS.KeyFile == "" {
+			return config{}, fmt.Errorf("metricsTLS requires certFile and keyFile")
+		}
+		metricsTLS = metricsTLSConfig{certFile: raw.MetricsTLS.CertFile, keyFile: raw.MetricsTLS.KeyFile, clientCA: raw.MetricsTLS.ClientCA}
+	}
+	if (raw.MetricsTLS != nil || raw.MetricsToken != "") && raw.MetricsAddr == "" {
+		return config{}, fmt.Errorf("metricsTLS and metricsTokenFile require metricsAddr")
+	}
+	var pushgateway pushgatewayConfig
+	if raw.Pushgateway != nil {
+		u, err := url.Parse(raw.Pushgateway.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return config{}, fmt.Errorf("pushgateway url must be an http or https URL: %q", raw.Pushgateway.URL)
+		}
+		pushgateway = pushgatewayConfig{url: strings.TrimSuffix(raw.Pushgateway.URL, "/"), job: raw.Pushgateway.Job}
+		if pushgateway.job == "" {
+			pushgateway.job = "ceph-mgr-endpoint-controller"
+		}
+	}
+	var otlp otlpConfig
+	if raw.OTLP != nil {
+		u, err := url.Parse(raw.OTLP.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return config{}, fmt.Errorf("otlp endpoint must be an http or https URL: %q", raw.OTLP.Endpoint)
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/metrics"
+		}
+		otlp = otlpConfig{endpoint: u.String(), interval: time.Minute, headersDir: raw.OTLP.HeadersDir}
+		if raw.OTLP.Interval != "" {
+			parsed, err := time.ParseDuration(raw.OTLP.Interval)
+			if err != nil {
+				return config{}, fmt.Errorf("invalid otlp interval in config: %w", err)
+			}
+			if parsed <= 0 {
+				return config{}, fmt.Errorf("otlp interval must be positive: %s", raw.OTLP.Interval)
+			}
+			otlp.interval = parsed
+		}
+	}
+	for _, manager := range raw.MigrateManagers {
+		if manager == "" || strings.HasPrefix(manager, fieldManager) {
+			return config{}, fmt.Errorf("invalid field manager to migrate: %q", manager)
+		}
+	}
+	conflictPolicy := raw.ConflictPolicy
+	switch conflictPolicy {
+	case "":
+		conflictPolicy = "abort"
+	case "abort", "adopt", "ignore":
+	default:
+		return config{}, fmt.Errorf("invalid conflict policy: %s", raw.ConflictPolicy)
+	}
+	var mgrBind []mgrOption
+	if raw.MgrBind != nil {
+		if raw.MgrBind.DashboardServerAddr != "" {
+			if net.ParseIP(raw.MgrBind.DashboardServerAddr) == nil {
+				return config{}, fmt.Errorf("invalid dashboard server address: %s", raw.MgrBind.DashboardServerAddr)
+			}
+			mgrBind = append(mgrBind, mgrOption{name: "mgr/dashboard/server_addr", value: raw.MgrBind.DashboardServerAddr})
+		}
+		for name, port := range map[string]int{
+			"mgr/dashboard/ssl_server_port": raw.MgrBind.DashboardSSLServerPort,
+			"mgr/prometheus/server_port":    raw.MgrBind.PrometheusServerPort,
+		} {
+			if port == 0 {
+				continue
+			}
+			if port < 1 || port > 65535 {
+				return config{}, fmt.Errorf("%s out of range: %d", name, port)
+			}
+			mgrBind = append(mgrBind, mgrOption{name: name, value: strconv.Itoa(port)})
+		}
+		slices.SortFunc(mgrBind, func(a, b mgrOption) int { return strings.Compare(a.name, b.name) })
+	}
+	var impersonate rest.ImpersonationConfig
+	if raw.Impersonate != nil {
+		if raw.Impersonate.User == "" {
+			return config{}, fmt.Errorf("impersonate user is required when impersonation is configured")
+		}
+		impersonate = rest.ImpersonationConfig{
+			UserName: raw.Impersonate.User,
+			UID:      raw.Impersonate.UID,
+			Groups:   raw.Impersonate.Groups,
+			Extra:    raw.Impersonate.Extra,
+		}
+	}
+	var failFast failFastPolicy
+	if raw.FailFast != nil {
+		if raw.FailFast.Attempts < 0 {
+			return config{}, fmt.Errorf("fail-fast attempts must not be negative: %d", raw.FailFast.Attempts)
+		}
+		failFast.attempts = raw.FailFast.Attempts
+		if raw.FailFast.Window != "" {
+			parsed, err := time.ParseDuration(raw.FailFast.Window)
+			if err != nil {
+				return config{}, fmt.Errorf("invalid fail-fast window: %w", err)
+			}
+			if parsed <= 0 {
+				return config{}, fmt.Errorf("fail-fast window must be positive: %s", raw.FailFast.Window)
+			}
+			failFast.window = parsed
+		} else if failFast.attempts == 0 {
+			failFast.attempts = 1
+		}
+	}
+	var shards int
+	var shardBy, shardLease string
+	var leaseDuration time.Duration
+	if raw.Sharding != nil && raw.Sharding.Shards != 0 {
+		shards = raw.Sharding.Shards
+		if shards < 0 {
+			return config{}, fmt.Errorf("shards must not be negative: %d", shards)
+		}
+		if namespace == "" {
+			return config{}, fmt.Errorf("namespace is required when sharding")
+		}
+		shardBy = raw.Sharding.By
+		switch shardBy {
+		case "":
+			shardBy = "mapping"
+		case "mapping", "cluster":
+		default:
+			return config{}, fmt.Errorf("invalid shard key: %s", raw.Sharding.By)
+		}
+		shardLease = raw.Sharding.Lease
+		if shardLease == "" {
+			shardLease = fieldManager
+		}
+		leaseDuration = max(3*interval, 15*time.Second)
+		if raw.Sharding.LeaseDuration != "" {
+			parsed, err := time.ParseDuration(raw.Sharding.LeaseDuration)
+			if err != nil {
+				return config{}, fmt.Errorf("invalid shard lease duration: %w", err)
+			}
+			if parsed < time.Second {
+				return config{}, fmt.Errorf("shard lease duration must be at least 1s: %s", raw.Sharding.LeaseDuration)
+			}
+			leaseDuration = parsed
+		}
+	}
+	var selector serviceSelector
+	if raw.ServiceSelector != nil {
+		if _, err := labels.Parse(raw.ServiceSelector.Selector); err != nil {
+			return config{}, fmt.Errorf("invalid service selector: %w", err)
+		}
+		if raw.ServiceSelector.Selector == "" {
+			return config{}, fmt.Errorf("service selector must not be empty")
+		}
+		selector = serviceSelector{selector: raw.ServiceSelector.Selector, namespaces: raw.ServiceSelector.Namespaces}
+		if len(selector.namespaces) == 0 {
+			if namespace == "" {
+				return config{}, fmt.Errorf("namespace is required for the service selector")
+			}
+			selector.namespaces = []string{namespace}
+		}
+	}
+	var watchNamespaces []string
+	if raw.Annotated != nil {
+		watchNamespaces = raw.Annotated.Namespaces
+		if len(watchNamespaces) == 0 {
+			if namespace == "" {
+				return config{}, fmt.Errorf("namespace is required for annotated Services")
+			}
+			watchNamespaces = []string{namespace}
+		}
+	}
+	var crdNamespaces []string
+	if raw.Resources != nil {
+		crdNamespaces = raw.Resources.Namespaces
+		if len(crdNamespaces) == 0 {
+			if namespace == "" {
+				return config{}, fmt.Errorf("namespace is required for CephMgrEndpoint resources")
+			}
+			crdNamespaces = []string{namespace}
+		}
+	}
+	var webhook webhookConfig
+	if raw.Webhook != nil {
+		if len(crdNamespaces) == 0 {
+			return config{}, fmt.Errorf("the webhook requires endpointResources")
+		}
+		webhook = webhookConfig{addr: raw.Webhook.Addr, certDir: raw.Webhook.CertDir, clientCA: raw.Webhook.ClientCA}
+		if webhook.addr == "" {
+			webhook.addr = ":9443"
+		}
+		if webhook.certDir == "" {
+			webhook.certDir = "/var/run/secrets/webhook"
+		}
+	}
+	preferredNets, err := parseCIDRs(raw.PreferredNets)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid preferredNetworks: %w", err)
+	}
+	allowedNets, err := parseCIDRs(raw.AllowedCIDRs)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid allowedCIDRs: %w", err)
+	}
+	var addressMap []addressRewrite
+	for i, rw := range raw.AddressMap {
+		rewrite, err := parseAddressRewrite(rw.From, rw.To)
+		if err != nil {
+			return config{}, fmt.Errorf("addressMap[%d]: %w", i, err)
+		}
+		addressMap = append(addressMap, rewrite)
+	}
+	var resolve resolveConfig
+	if raw.Resolve != nil {
+		timeout := 5 * time.Second
+		if raw.Resolve.Timeout != "" {
+			parsed, err := time.ParseDuration(raw.Resolve.Timeout)
+			if err != nil {
+				return config{}, fmt.Errorf("invalid resolve timeout: %w", err)
+			}
+			if parsed <= 0 {
+				return config{}, fmt.Errorf("resolve timeout must be positive: %s", raw.Resolve.Timeout)
+			}
+			timeout = parsed
+		}
+		ttl := time.Minute
+		if raw.Resolve.TTL != "" {
+			parsed, err := time.ParseDuration(raw.Resolve.TTL)
+			if err != nil {
+				return config{}, fmt.Errorf("invalid resolve ttl: %w", err)
+			}
+			if parsed <= 0 {
+				return config{}, fmt.Errorf("resolve ttl must be positive: %s", raw.Resolve.TTL)
+			}
+			ttl = parsed
+		}
+		address := raw.Resolve.Resolver
+		if address != "" {
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				address = net.JoinHostPort(address, "53")
+			}
+		}
+		if !slices.Contains([]string{"", "first", "all"}, raw.Resolve.Addresses) {
+			return config{}, fmt.Errorf("invalid resolve addresses: %s", raw.Resolve.Addresses)
+		}
+		if !slices.Contains([]string{"", "ipv4", "ipv6"}, raw.Resolve.Prefer) {
+			return config{}, fmt.Errorf("invalid resolve prefer: %s", raw.Resolve.Prefer)
+		}
+		resolve = resolveConfig{
+			enabled:  true,
+			address:  address,
+			timeout:  timeout,
+			ttl:      ttl,
+			all:      raw.Resolve.Addresses == "all",
+			prefer:   raw.Resolve.Prefer,
+			networks: preferredNets,
+		}
+	}
+	var simulation failoverSimulation
+	if raw.Simulation != nil {
+		if len(raw.Simulation.Addresses) < 2 {
+			return config{}, fmt.Errorf("failover simulation needs at least two addresses")
+		}
+		for _, addr := range raw.Simulation.Addresses {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return config{}, fmt.Errorf("invalid failover simulation address: %s", addr)
+			}
+			simulation.addresses = append(simulation.addresses, ip)
+		}
+		simulation.interval = 5 * time.Minute
+		if raw.Simulation.Interval != "" {
+			parsed, err := time.ParseDuration(raw.Simulation.Interval)
+			if err != nil {
+				return config{}, fmt.Errorf("invalid failover simulation interval: %w", err)
+			}
+			if parsed <= 0 {
+				return config{}, fmt.Errorf("failover simulation interval must be positive: %s", raw.Simulation.Interval)
+			}
+			simulation.interval = parsed
+		}
+	}
+	var route routeConfig
+	if raw.Route != nil {
+		route = routeConfig{host: raw.Route.Host, termination: raw.Route.Termination, destinationCA: raw.Route.DestinationCA}
+		if route.termination == "" {
+			route.termination = "passthrough"
+		}
+		if !slices.Contains([]string{"passthrough", "reencrypt", "edge"}, route.termination) {
+			return config{}, fmt.Errorf("invalid route termination: %s", route.termination)
+		}
+		if route.destinationCA != "" && route.termination != "reencrypt" {
+			return config{}, fmt.Errorf("route destination CA requires reencrypt termination")
+		}
+	}
+	var scrape scrapeConfig
+	if raw.ScrapeConfig != nil {
+		scrape = scrapeConfig{jobName: raw.ScrapeConfig.JobName, caFile: raw.ScrapeConfig.CAFile, insecure: raw.ScrapeConfig.InsecureSkipVerify}
+		if scrape.jobName == "" {
+			scrape.jobName = "ceph"
+		}
+	}
+	var vmScrape vmScrapeConfig
+	if raw.VMServiceScrape != nil {
+		vmScrape = vmScrapeConfig{enabled: true, interval: raw.VMServiceScrape.Interval, insecure: raw.VMServiceScrape.InsecureSkipVerify}
+		if vmScrape.interval != "" {
+			if _, err := time.ParseDuration(vmScrape.interval); err != nil {
+				return config{}, fmt.Errorf("invalid VMServiceScrape interval: %w", err)
+			}
+		}
+	}
+	var grafana grafanaConfig
+	if raw.Grafana != nil {
+		grafana = grafanaConfig{
+			enabled:        true,
+			instanceLabels: raw.Grafana.InstanceSelector,
+			crossNamespace: raw.Grafana.AllowCrossNamespaceImport,
+			insecure:       raw.Grafana.InsecureSkipVerify,
+		}
+		if len(grafana.instanceLabels) == 0 {
+			return config{}, fmt.Errorf("grafana instanceSelector is required")
+		}
+	}
+	if raw.LinkerdExport != "" && raw.LinkerdExport != "true" && raw.LinkerdExport != "remote-discovery" {
+		return config{}, fmt.Errorf("invalid linkerdExport: %s", raw.LinkerdExport)
+	}
+	var traefik traefikConfig
+	if raw.Traefik != nil {
+		traefik = traefikConfig{
+			host:             raw.Traefik.Host,
+			entryPoints:      raw.Traefik.EntryPoints,
+			passthrough:      raw.Traefik.Passthrough,
+			secretName:       raw.Traefik.SecretName,
+			certResolver:     raw.Traefik.CertResolver,
+			serversTransport: raw.Traefik.ServersTransport,
+		}
+		if traefik.host == "" {
+			return config{}, fmt.Errorf("traefik host is required")
+		}
+		if traefik.passthrough && (traefik.secretName != "" || traefik.certResolver != "" || traefik.serversTransport != "") {
+			return config{}, fmt.Errorf("traefik passthrough cannot be combined with TLS options")
+		}
+	}
+	var dashboardCert certCheck
+	if raw.DashboardCert != nil {
+		dashboardCert.enabled = true
+		if raw.DashboardCert.WarnBefore != "" {
+			parsed, err := time.ParseDuration(raw.DashboardCert.WarnBefore)
+			if err != nil {
+				return config{}, fmt.Errorf("invalid dashboard certificate warning: %w", err)
+			}
+			if parsed < 0 {
+				return config{}, fmt.Errorf("dashboard certificate warning must not be negative: %s", raw.DashboardCert.WarnBefore)
+			}
+			dashboardCert.warnBefore = parsed
+		}
+	}
+	cephRetry, kubeRetry := defaultRetryPolicy, defaultRetryPolicy
+	if raw.Retry != nil {
+		if cephRetry, err = parseRetryPolicy(raw.Retry.Ceph); err != nil {
+			return config{}, fmt.Errorf("ceph retry policy: %w", err)
+		}
+		if kubeRetry, err = parseRetryPolicy(raw.Retry.Kube); err != nil {
+			return config{}, fmt.Errorf("kube retry policy: %w", err)
+		}
+	}
+	return config{
+		debug:           debug,
+		repeatInterval:  repeatInterval,
+		logFile:         logFile,
+		interval:        interval,
+		jitter:          raw.Jitter,
+		timeout:         timeout,
+		fullResync:      fullResync,
+		startupTimeout:  startupTimeout,
+		startupRetries:  raw.StartupRetries,
+		markTerminating: raw.MarkTerminating,
+		failFast:        failFast,
+		stateFile:       raw.StateFile,
+		shards:          shards,
+		shardBy:         shardBy,
+		shardLease:      shardLease,
+		leaseDuration:   leaseDuration,
+		selector:        selector,
+		watchNamespaces: watchNamespaces,
+		crdNamespaces:   crdNamespaces,
+		webhook:         webhook,
+		dryRunDiff:      raw.DryRunDiff,
+		conflictPolicy:  conflictPolicy,
+		manageModules:   raw.ManageModules,
+		mgrBind:         mgrBind,
+		configFallback:  raw.ConfigFallback,
+		verifyActiveMgr: raw.VerifyActiveMgr,
+		skipUnchanged:   raw.SkipUnchanged,
+		moduleTargets:   raw.ModuleTargets,
+		serviceURLs:     raw.ServiceURLs,
+		statusConfigMap: raw.StatusConfigMap,
+		heartbeatLease:  raw.HeartbeatLease,
+		auditLog:        raw.AuditLog,
+		dashboardCert:   dashboardCert,
+		serviceExport:   raw.ServiceExport,
+		ciliumGlobal:    raw.CiliumGlobal,
+		linkerdExport:   raw.LinkerdExport,
+		route:           route,
+		resolve:         resolve,
+		simulation:      simulation,
+		preferredNets:   preferredNets,
+		addressMap:      addressMap,
+		allowedNets:     allowedNets,
+		nodeAddresses:   raw.NodeAddresses,
+		dualStack:       raw.DualStack,
+		dashboardPorts:  raw.DashboardPorts,
+		cleanupOnExit:   raw.CleanupOnExit,
+		migrateManagers: raw.MigrateManagers,
+		metricsAddr:     raw.MetricsAddr,
+		metricsTLS:      metricsTLS,
+		metricsToken:    raw.MetricsToken,
+		pushgateway:     pushgateway,
+		otlp:            otlp,
+		traefik:         traefik,
+		scrapeConfig:    scrape,
+		vmScrape:        vmScrape,
+		grafana:         grafana,
+		restfulSecret:   raw.RestfulSecret,
+		restfulUser:     restfulUser,
+		namespace:       namespace,
+		mappings:        mappings,
+		clusters:        clusters,
+		impersonate:     impersonate,
+		cephRetry:       cephRetry,
+		kubeRetry:       kubeRetry,
+		cephID:          cephID,
+		cephKey:         cephKey,
+	}, nil
+}
+
+// parseRetryPolicy fills the unset fields of raw from defaultRetryPolicy.
+func parseRetryPolicy(raw *rawRetryPolicy) (retryPolicy, error) {
+	p := defaultRetryPolicy
+	if raw == nil {
+		return p, nil
+	}
+	for _, d := range []struct {
+		value string
+		dst   *time.Duration
+	}{
+		{raw.InitialDelay, &p.initialDelay},
+		{raw.MaxDelay, &p.maxDelay},
+	} {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(d.value)
+		if err != nil {
+			return retryPolicy{}, fmt.Errorf("invalid duration: %w", err)
+		}
+		if parsed <= 0 {
+			return retryPolicy{}, fmt.Errorf("delay must be positive: %s", d.value)
+		}
+		*d.dst = parsed
+	}
+	if raw.Multiplier != 0 {
+		if raw.Multiplier < 1 {
+			return retryPolicy{}, fmt.Errorf("multiplier must be at least 1: %g", raw.Multiplier)
+		}
+		p.multiplier = raw.Multiplier
+	}
+	if raw.MaxAttempts < 0 {
+		return retryPolicy{}, fmt.Errorf("max attempts must not be negative: %d", raw.MaxAttempts)
+	}
+	if raw.MaxAttempts != 0 {
+		p.maxAttempts = raw.MaxAttempts
+	}
+	if p.maxDelay < p.initialDelay {
+		return retryPolicy{}, fmt.Errorf("max delay %s is shorter than initial delay %s", p.maxDelay, p.initialDelay)
+	}
+	return p, nil
+}
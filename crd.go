@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+var cephMgrEndpointResource = schema.GroupVersionResource{Group: "ceph.io", Version: "v1alpha1", Resource: "cephmgrendpoints"}
+
+// cephMgrEndpoint declares a mapping as a namespaced resource. The slice is
+// published into the resource's namespace.
+type cephMgrEndpoint struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              cephMgrEndpointSpec   `json:"spec"`
+	Status            cephMgrEndpointStatus `json:"status,omitempty"`
+}
+
+type cephMgrEndpointSpec struct {
+	Module      string `json:"module,omitempty"`
+	DaemonType  string `json:"daemonType,omitempty"`
+	ServiceName string `json:"serviceName"`
+	Slice       string `json:"slice,omitempty"`
+	AllMgrs     bool   `json:"allMgrs,omitempty"`
+}
+
+type cephMgrEndpointStatus struct {
+	ObservedGeneration int64               `json:"observedGeneration,omitempty"`
+	Endpoints          []publishedEndpoint `json:"endpoints,omitempty"`
+	ActiveMgr          string              `json:"activeMgr,omitempty"`
+	LastSyncTime       *metav1.Time        `json:"lastSyncTime,omitempty"`
+	Conditions         []metav1.Condition  `json:"conditions,omitempty"`
+}
+
+type publishedEndpoint struct {
+	Slice string `json:"slice"`
+	IP    string `json:"ip"`
+	Port  int32  `json:"port"`
+	URL   string `json:"url,omitempty"`
+}
+
+// sliceName returns the EndpointSlice name of res, which defaults to the
+// resource name.
+func (res *cephMgrEndpoint) sliceName() string {
+	if res.Spec.Slice != "" {
+		return res.Spec.Slice
+	}
+	return res.Name
+}
+
+// validateCephMgrEndpoint returns the reasons res cannot be published into
+// cluster: an invalid spec, a namespace the controller does not watch, or a
+// slice already published there by the configuration or by one of others.
+// Both the admission webhook and the reconciler use it, so that a resource
+// the webhook admits is one the reconciler publishes.
+func validateCephMgrEndpoint(cfg config, cluster string, res *cephMgrEndpoint, others []*cephMgrEndpoint) []string {
+	var problems []string
+	if (res.Spec.Module == "") == (res.Spec.DaemonType == "") {
+		problems = append(problems, "exactly one of spec.module and spec.daemonType is required")
+	}
+	if res.Spec.DaemonType != "" && res.Spec.AllMgrs {
+		problems = append(problems, "spec.allMgrs cannot be combined with spec.daemonType")
+	}
+	if res.Spec.ServiceName == "" {
+		problems = append(problems, "spec.serviceName is required")
+	}
+	slice := res.sliceName()
+	if errs := validation.IsDNS1123Subdomain(slice); len(errs) > 0 {
+		problems = append(problems, fmt.Sprintf("invalid slice name %q: %s", slice, strings.Join(errs, ", ")))
+	}
+	if !slices.Contains(cfg.crdNamespaces, res.Namespace) {
+		problems = append(problems, fmt.Sprintf("namespace %s is not watched by the controller", res.Namespace))
+	}
+	for _, m := range cfg.mappings {
+		if m.appliesTo(cluster) && m.namespace == res.Namespace && m.slice == slice {
+			problems = append(problems, fmt.Sprintf("EndpointSlice %s/%s is already published by the controller configuration", res.Namespace, slice))
+			break
+		}
+	}
+	for _, other := range others {
+		if other.Name != res.Name && other.Namespace == res.Namespace && other.sliceName() == slice {
+			problems = append(problems, fmt.Sprintf("EndpointSlice %s/%s is already published by CephMgrEndpoint %s", res.Namespace, slice, other.Name))
+		}
+	}
+	return problems
+}
+
+func resourceKey(cluster, namespace, name string) string {
+	return cluster + "/" + namespace + "/" + name
+}
+
+// rejectedResource is a CephMgrEndpoint that failed validation in a cluster.
+type rejectedResource struct {
+	kube     *kubeClient
+	res      *cephMgrEndpoint
+	problems []string
+}
+
+// discoverResourceMappings lists the CephMgrEndpoint resources in the
+// configured namespaces and returns a mapping for each valid one, the
+// resources keyed by cluster, namespace and name, and the invalid ones. It
+// only reads, leaving it to the caller to report the invalid resources.
+func discoverResourceMappings(ctx context.Context, cfg config, kubes []*kubeClient) ([]mapping, map[string]*cephMgrEndpoint, []rejectedResource, error) {
+	var mappings []mapping
+	var rejected []rejectedResource
+	resources := make(map[string]*cephMgrEndpoint)
+	for _, kube := range kubes {
+		for _, namespace := range cfg.crdNamespaces {
+			list, err := kube.dynamic.Resource(cephMgrEndpointResource).Namespace(namespace).List(ctx, metav1.ListOptions{})
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("list CephMgrEndpoints in %s/%s: %w", kube.name, namespace, err)
+			}
+			var decoded []*cephMgrEndpoint
+			for _, item := range list.Items {
+				res := &cephMgrEndpoint{}
+				if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, res); err != nil {
+					slog.WarnContext(ctx, "failed to decode CephMgrEndpoint", "cluster", kube.name, "namespace", item.GetNamespace(), "name", item.GetName(), "error", err)
+					continue
+				}
+				decoded = append(decoded, res)
+			}
+			// The oldest resource keeps a contested slice, as the webhook
+			// would have rejected the later ones.
+			slices.SortStableFunc(decoded, func(a, b *cephMgrEndpoint) int {
+				if c := a.CreationTimestamp.Compare(b.CreationTimestamp.Time); c != 0 {
+					return c
+				}
+				return strings.Compare(a.Name, b.Name)
+			})
+			var accepted []*cephMgrEndpoint
+			for _, res := range decoded {
+				resources[resourceKey(kube.name, res.Namespace, res.Name)] = res
+				if problems := validateCephMgrEndpoint(cfg, kube.name, res, accepted); len(problems) > 0 {
+					rejected = append(rejected, rejectedResource{kube: kube, res: res, problems: problems})
+					continue
+				}
+				accepted = append(accepted, res)
+				m := mapping{
+					module:      res.Spec.Module,
+					namespace:   res.Namespace,
+					serviceName: res.Spec.ServiceName,
+					slice:       res.sliceName(),
+					allMgrs:     res.Spec.AllMgrs,
+					daemonType:  res.Spec.DaemonType,
+					cluster:     kube.name,
+					discovered:  true,
+					resource:    res.Name,
+				}
+				if m.daemonType != "" {
+					m.module = m.daemonType
+				}
+				mappings = append(mappings, m)
+			}
+		}
+	}
+	return mappings, resources, rejected, nil
+}
+
+// lastSyncRefresh bounds how stale lastSyncTime gets while successful
+// reconciles leave the rest of a CephMgrEndpoint status unchanged.
+const lastSyncRefresh = 5 * time.Minute
+
+// setResourceStatus records the outcome of publishing a CephMgrEndpoint in
+// its status subresource. The status is only written when it differs from
+// the current one other than in lastSyncTime, or when a successful reconcile
+// finds lastSyncTime older than lastSyncRefresh. Failures are logged rather
+// than returned so that status reporting never blocks publishing.
+func setResourceStatus(ctx context.Context, kube *kubeClient, res *cephMgrEndpoint, ready metav1.ConditionStatus, reason, message string, groups []endpointGroup, activeMgr string) {
+	status := res.Status
+	status.Conditions = slices.Clone(res.Status.Conditions)
+	status.ObservedGeneration = res.Generation
+	meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               "Ready",
+		Status:             ready,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: res.Generation,
+	})
+	if ready == metav1.ConditionTrue {
+		status.Endpoints = nil
+		for _, group := range groups {
+			for _, a := range group.addrs {
+				status.Endpoints = append(status.Endpoints, publishedEndpoint{Slice: group.name, IP: a.ip.String(), Port: a.port, URL: a.url})
+			}
+		}
+		status.ActiveMgr = activeMgr
+	}
+	current := res.Status
+	current.LastSyncTime = status.LastSyncTime
+	stale := status.LastSyncTime == nil || time.Since(status.LastSyncTime.Time) >= lastSyncRefresh
+	if equality.Semantic.DeepEqual(current, status) && (ready != metav1.ConditionTrue || !stale) {
+		return
+	}
+	if ready == metav1.ConditionTrue {
+		now := metav1.NewTime(time.Now())
+		status.LastSyncTime = &now
+	}
+	res.Status = status
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&status)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to encode CephMgrEndpoint status", "error", err)
+		return
+	}
+	obj := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": cephMgrEndpointResource.GroupVersion().String(),
+		"kind":       "CephMgrEndpoint",
+		"metadata": map[string]any{
+			"name":      res.Name,
+			"namespace": res.Namespace,
+		},
+		"status": content,
+	}}
+	_, err = kube.dynamic.Resource(cephMgrEndpointResource).Namespace(res.Namespace).ApplyStatus(ctx, res.Name, obj, metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+	auditStatusUpdate(kube, "cephmgrendpoints/status", res.Namespace, res.Name, fieldManager, []any{"ready", ready, "reason", reason}, err)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to update CephMgrEndpoint status", "cluster", kube.name, "namespace", res.Namespace, "name", res.Name, "error", err)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+// newLogger returns the logger for cfg: text on logOutput, at debug
+// level when enabled, with the attributes attached to the context and with
+// repeated errors deduplicated.
+func newLogger(cfg config) *slog.Logger {
+	opts := &slog.HandlerOptions{}
+	if cfg.debug {
+		opts.Level = slog.LevelDebug
+	}
+	var handler slog.Handler = slog.NewTextHandler(logOutput, opts)
+	if cfg.repeatInterval > 0 {
+		handler = &dedupHandler{Handler: handler, window: cfg.repeatInterval, repeats: make(map[string]*repeatedRecord)}
+	}
+	return slog.New(contextHandler{handler})
+}
+
+// repeatedRecord is an error record that was logged, and how often it
+// recurred since.
+type repeatedRecord struct {
+	record slog.Record
+	count  int
+	since  time.Time
+}
+
+// dedupHandler logs the first of a run of identical error records and
+// suppresses the rest, logging how many were suppressed once per window.
+// Records are identical when their level, message and attributes match.
+type dedupHandler struct {
+	slog.Handler
+	window  time.Duration
+	mu      sync.Mutex
+	repeats map[string]*repeatedRecord
+}
+
+func (h *dedupHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &dedupHandler{Handler: h.Handler.WithAttrs(attrs), window: h.window, repeats: make(map[string]*repeatedRecord)}
+}
+
+func (h *dedupHandler) WithGroup(name string) slog.Handler {
+	return &dedupHandler{Handler: h.Handler.WithGroup(name), window: h.window, repeats: make(map[string]*repeatedRecord)}
+}
+
+func (h *dedupHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := r.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	key := ""
+	if r.Level >= slog.LevelError {
+		key = recordKey(r)
+	}
+	// Runs whose window has passed are summarized and forgotten, so an
+	// error that stopped recurring is reported with its final count.
+	for k, rep := range h.repeats {
+		if k == key || now.Sub(rep.since) < h.window {
+			continue
+		}
+		if rep.count > 0 {
+			_ = h.Handler.Handle(ctx, h.summary(rep, now))
+		}
+		delete(h.repeats, k)
+	}
+	if key == "" {
+		return h.Handler.Handle(ctx, r)
+	}
+	rep, ok := h.repeats[key]
+	if !ok {
+		h.repeats[key] = &repeatedRecord{record: r.Clone(), since: now}
+		return h.Handler.Handle(ctx, r)
+	}
+	rep.count++
+	if now.Sub(rep.since) < h.window {
+		return nil
+	}
+	err := h.Handler.Handle(ctx, h.summary(rep, now))
+	rep.count = 0
+	rep.since = now
+	return err
+}
+
+// summary returns the record reporting how often rep recurred.
+func (h *dedupHandler) summary(rep *repeatedRecord, now time.Time) slog.Record {
+	r := slog.NewRecord(now, rep.record.Level, fmt.Sprintf("same error repeated %d times in the last %s", rep.count, shortDuration(now.Sub(rep.since))), rep.record.PC)
+	r.AddAttrs(slog.String("repeated", rep.record.Message))
+	rep.record.Attrs(func(a slog.Attr) bool {
+		r.AddAttrs(a)
+		return true
+	})
+	return r
+}
+
+func recordKey(r slog.Record) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\x00%s", r.Level, r.Message)
+	r.Attrs(func(a slog.Attr) bool {
+		fmt.Fprintf(&b, "\x00%s=%s", a.Key, a.Value.Resolve())
+		return true
+	})
+	return b.String()
+}
+
+// shortDuration formats d rounded to the second, without trailing zero
+// units: 5m rather than 5m0s.
+func shortDuration(d time.Duration) string {
+	s := d.Round(time.Second).String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1apply "k8s.io/client-go/applyconfigurations/discovery/v1"
+)
+
+// mappingPlan is what a reconcile does with a mapping given the data read
+// for it: publish groups, or publish nothing for reason, explained by
+// message. err is set when that fails the mapping, and refused is the
+// address that kept it from being published under allowedCIDRs.
+type mappingPlan struct {
+	groups  []endpointGroup
+	reason  string
+	message string
+	err     error
+	refused net.IP
+}
+
+// planService decides whether m can be discovered from services, and
+// returns the plan for it when it cannot. A mapping derived from a Service
+// port that no mgr module serves is skipped, while a configured mapping
+// whose module is missing fails.
+func planService(m mapping, services mgrServices) (mappingPlan, bool) {
+	if !m.fromMgrServices() || services[m.module] != "" {
+		return mappingPlan{}, true
+	}
+	message := fmt.Sprintf("%s service URL not found in ceph mgr services", m.module)
+	plan := mappingPlan{reason: "ServiceNotFound", message: message}
+	if !m.discovered {
+		plan.err = withCategory(errServiceMissing, errors.New(message))
+	}
+	return plan, false
+}
+
+// planMapping decides what to publish for m from the groups discovered for
+// it. Address rewrites, port overrides and dashboard ports are applied, and
+// nothing is published when an address is outside allowedCIDRs or no daemon
+// was found. It does no I/O, so that a reconcile and the commands that show
+// what a reconcile would do agree.
+func planMapping(cfg config, m mapping, groups []endpointGroup, dashboardPorts map[string]int32) mappingPlan {
+	groups = desiredGroups(cfg, m, groups, dashboardPorts)
+	if addr := disallowedAddress(groups, cfg.allowedNets); addr != nil {
+		return mappingPlan{
+			reason:  "AddressNotAllowed",
+			message: fmt.Sprintf("refusing to publish %s, which is outside allowedCIDRs", addr.ip),
+			refused: addr.ip,
+		}
+	}
+	if len(groups) == 0 {
+		message := fmt.Sprintf("no running %s daemons", m.daemonType)
+		return mappingPlan{reason: "NoEndpoints", message: message, err: withCategory(errNoEndpoints, errors.New(message))}
+	}
+	return mappingPlan{groups: groups}
+}
+
+// desiredGroups applies the configured address rewrites and port overrides
+// to the groups discovered for m. dashboardPorts are added to dashboard
+// addresses when configured.
+func desiredGroups(cfg config, m mapping, groups []endpointGroup, dashboardPorts map[string]int32) []endpointGroup {
+	groups = rewriteGroups(m.slice, groups, cfg.addressMap)
+	if m.port != 0 {
+		groups = mapEndpointGroups(m.slice, groups, func(addr *endpointAddress) { addr.port = m.port })
+	}
+	if m.module == "dashboard" && cfg.dashboardPorts {
+		groups = mapEndpointGroups(m.slice, groups, func(addr *endpointAddress) { addr.extraPorts = dashboardPorts })
+	}
+	return groups
+}
+
+// endpointSliceApply returns the EndpointSlice publishing addrs for m under
+// name. It has no owner reference, which needs the UID of the Service.
+func endpointSliceApply(m mapping, name string, addrs []*endpointAddress) *discoveryv1apply.EndpointSliceApplyConfiguration {
+	addr := addrs[0]
+	var endpoints []*discoveryv1apply.EndpointApplyConfiguration
+	for _, a := range addrs {
+		endpoint := discoveryv1apply.Endpoint().WithAddresses(a.ip.String())
+		if a.nodeName != "" {
+			endpoint.WithNodeName(a.nodeName)
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+
+	annotations := map[string]string{
+		urlAnnotation:       addr.url,
+		urlPrefixAnnotation: addr.path,
+		urlSchemeAnnotation: addr.scheme(),
+	}
+	if !addr.staleSince.IsZero() {
+		annotations[staleAnnotation] = addr.staleSince.Format(time.RFC3339)
+	}
+
+	return discoveryv1apply.EndpointSlice(name, m.namespace).
+		WithLabels(map[string]string{
+			"kubernetes.io/service-name": m.serviceName,
+			managedByLabel:               fieldManager,
+			sliceGroupLabel:              m.slice,
+		}).
+		WithAnnotations(annotations).
+		WithAddressType(addressTypeFor(addr.ip)).
+		WithEndpoints(endpoints...).
+		WithPorts(endpointPorts(m, addr)...)
+}
+
+// endpointPorts returns the slice ports for addr: the module's port, followed
+// by its extra ports sorted by name.
+func endpointPorts(m mapping, addr *endpointAddress) []*discoveryv1apply.EndpointPortApplyConfiguration {
+	ports := []*discoveryv1apply.EndpointPortApplyConfiguration{
+		discoveryv1apply.EndpointPort().
+			WithName(m.module).
+			WithPort(addr.port).
+			WithProtocol(corev1.ProtocolTCP),
+	}
+	for _, name := range slices.Sorted(maps.Keys(addr.extraPorts)) {
+		ports = append(ports, discoveryv1apply.EndpointPort().
+			WithName(name).
+			WithPort(addr.extraPorts[name]).
+			WithProtocol(corev1.ProtocolTCP))
+	}
+	return ports
+}
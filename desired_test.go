@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func mustCIDR(t *testing.T, s string) *net.IPNet {
+	t.Helper()
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func TestPlanService(t *testing.T) {
+	services := mgrServices{"dashboard": "https://10.0.0.1:8443/"}
+	tests := []struct {
+		name    string
+		m       mapping
+		ok      bool
+		reason  string
+		wantErr error
+	}{
+		{name: "module served", m: mapping{module: "dashboard"}, ok: true},
+		{name: "daemon type", m: mapping{module: "rgw", daemonType: "rgw"}, ok: true},
+		{name: "configured module missing", m: mapping{module: "prometheus"}, reason: "ServiceNotFound", wantErr: errServiceMissing},
+		{name: "discovered module missing", m: mapping{module: "prometheus", discovered: true}, reason: "ServiceNotFound"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, ok := planService(tt.m, services)
+			if ok != tt.ok {
+				t.Fatalf("ok = %t, want %t", ok, tt.ok)
+			}
+			if plan.reason != tt.reason {
+				t.Errorf("reason = %q, want %q", plan.reason, tt.reason)
+			}
+			if tt.wantErr == nil && plan.err != nil || tt.wantErr != nil && !errors.Is(plan.err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", plan.err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPlanMapping(t *testing.T) {
+	rewrite, err := parseAddressRewrite("10.0.0.0/24", "192.168.0.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dashboard := func(ip string) []endpointGroup {
+		return []endpointGroup{{name: "ceph-dashboard", addrs: []*endpointAddress{{ip: net.ParseIP(ip), port: 8443, url: "https://" + ip + ":8443/"}}}}
+	}
+	tests := []struct {
+		name           string
+		cfg            config
+		m              mapping
+		groups         []endpointGroup
+		dashboardPorts map[string]int32
+		reason         string
+		wantErr        error
+		refused        string
+		ip             string
+		port           int32
+		extraPorts     int
+	}{
+		{
+			name:   "unchanged",
+			m:      mapping{module: "dashboard", slice: "ceph-dashboard"},
+			groups: dashboard("10.0.0.1"),
+			ip:     "10.0.0.1",
+			port:   8443,
+		},
+		{
+			name:   "port override",
+			m:      mapping{module: "dashboard", slice: "ceph-dashboard", port: 443},
+			groups: dashboard("10.0.0.1"),
+			ip:     "10.0.0.1",
+			port:   443,
+		},
+		{
+			name:   "address rewritten",
+			cfg:    config{addressMap: []addressRewrite{rewrite}},
+			m:      mapping{module: "dashboard", slice: "ceph-dashboard"},
+			groups: dashboard("10.0.0.7"),
+			ip:     "192.168.0.7",
+			port:   8443,
+		},
+		{
+			name:           "dashboard ports",
+			cfg:            config{dashboardPorts: true},
+			m:              mapping{module: "dashboard", slice: "ceph-dashboard"},
+			groups:         dashboard("10.0.0.1"),
+			dashboardPorts: map[string]int32{"http": 8080, "https": 8443},
+			ip:             "10.0.0.1",
+			port:           8443,
+			extraPorts:     2,
+		},
+		{
+			name:    "outside allowed CIDRs",
+			cfg:     config{allowedNets: []*net.IPNet{mustCIDR(t, "192.168.0.0/16")}},
+			m:       mapping{module: "dashboard", slice: "ceph-dashboard"},
+			groups:  dashboard("10.0.0.1"),
+			reason:  "AddressNotAllowed",
+			refused: "10.0.0.1",
+		},
+		{
+			name:   "allowed after rewrite",
+			cfg:    config{addressMap: []addressRewrite{rewrite}, allowedNets: []*net.IPNet{mustCIDR(t, "192.168.0.0/16")}},
+			m:      mapping{module: "dashboard", slice: "ceph-dashboard"},
+			groups: dashboard("10.0.0.1"),
+			ip:     "192.168.0.1",
+			port:   8443,
+		},
+		{
+			name:    "no daemons",
+			m:       mapping{module: "rgw", slice: "ceph-rgw", daemonType: "rgw"},
+			reason:  "NoEndpoints",
+			wantErr: errNoEndpoints,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := planMapping(tt.cfg, tt.m, tt.groups, tt.dashboardPorts)
+			if plan.reason != tt.reason {
+				t.Errorf("reason = %q, want %q", plan.reason, tt.reason)
+			}
+			if tt.wantErr == nil && plan.err != nil || tt.wantErr != nil && !errors.Is(plan.err, tt.wantErr) {
+				t.Errorf("err = %v, want %v", plan.err, tt.wantErr)
+			}
+			if tt.refused != "" {
+				if !plan.refused.Equal(net.ParseIP(tt.refused)) {
+					t.Errorf("refused = %v, want %s", plan.refused, tt.refused)
+				}
+				if len(plan.groups) != 0 {
+					t.Errorf("groups = %d, want none", len(plan.groups))
+				}
+				return
+			}
+			if tt.ip == "" {
+				return
+			}
+			if len(plan.groups) != 1 || len(plan.groups[0].addrs) != 1 {
+				t.Fatalf("groups = %+v, want one address", plan.groups)
+			}
+			addr := plan.groups[0].addrs[0]
+			if !addr.ip.Equal(net.ParseIP(tt.ip)) {
+				t.Errorf("ip = %s, want %s", addr.ip, tt.ip)
+			}
+			if addr.port != tt.port {
+				t.Errorf("port = %d, want %d", addr.port, tt.port)
+			}
+			if len(addr.extraPorts) != tt.extraPorts {
+				t.Errorf("extra ports = %v, want %d", addr.extraPorts, tt.extraPorts)
+			}
+		})
+	}
+}
+
+func TestPlanMappingKeepsInput(t *testing.T) {
+	groups := []endpointGroup{{name: "ceph-dashboard", addrs: []*endpointAddress{{ip: net.ParseIP("10.0.0.1"), port: 8443}}}}
+	planMapping(config{}, mapping{module: "dashboard", slice: "ceph-dashboard", port: 443}, groups, nil)
+	if groups[0].addrs[0].port != 8443 {
+		t.Errorf("input port = %d, want 8443", groups[0].addrs[0].port)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	discoveryv1apply "k8s.io/client-go/applyconfigurations/discovery/v1"
+)
+
+// checkDrift compares the managed EndpointSlices of every mapping, configured
+// or discovered, in every cluster with the ones the controller would publish right now, and
+// logs each slice that is missing, differs or should not exist. It changes
+// nothing, and returns whether any slice has drifted.
+func checkDrift(ctx context.Context, cfg config, conn discoverer, kubes []*kubeClient) (bool, error) {
+	mappings, desired, err := desiredSlices(ctx, cfg, conn, kubes)
+	if err != nil {
+		return false, err
+	}
+	drifted := false
+	for _, kube := range kubes {
+		for _, m := range mappings {
+			if m.disabled || !m.appliesTo(kube.name) {
+				continue
+			}
+			svc, err := kube.getService(ctx, m.namespace, m.serviceName)
+			if err != nil && !errors.IsNotFound(err) {
+				return false, fmt.Errorf("cluster %s: get Service %s/%s: %w", kube.name, m.namespace, m.serviceName, err)
+			}
+			if err != nil {
+				svc = nil
+			} else if isPaused(svc.Annotations) {
+				slog.Info("Service paused, not compared", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName)
+				continue
+			}
+
+			var names []string
+			for _, d := range desired {
+				if d.cluster != kube.name || d.m.namespace != m.namespace || d.m.slice != m.slice {
+					continue
+				}
+				names = append(names, d.name)
+				attrs := []any{"cluster", kube.name, "namespace", m.namespace, "name", d.name}
+				live, err := kube.getEndpointSlice(ctx, m.namespace, d.name)
+				if errors.IsNotFound(err) {
+					slog.Warn("EndpointSlice missing", attrs...)
+					drifted = true
+					continue
+				}
+				if err != nil {
+					return false, fmt.Errorf("cluster %s: get EndpointSlice %s/%s: %w", kube.name, m.namespace, d.name, err)
+				}
+				if isPaused(live.Annotations) {
+					slog.Info("EndpointSlice paused, not compared", attrs...)
+					continue
+				}
+				diff, err := endpointSliceDrift(live, endpointSliceApply(d.m, d.name, d.addrs), svc)
+				if err != nil {
+					return false, fmt.Errorf("cluster %s: EndpointSlice %s/%s: %w", kube.name, m.namespace, d.name, err)
+				}
+				if len(diff) == 0 {
+					slog.Info("EndpointSlice in sync", attrs...)
+					continue
+				}
+				slog.Warn("EndpointSlice drifted", append(attrs, diff...)...)
+				drifted = true
+			}
+
+			existing, err := kube.listEndpointSlices(ctx, m.namespace, labels.Set{managedByLabel: fieldManager, sliceGroupLabel: m.slice}.AsSelector())
+			if err != nil {
+				return false, fmt.Errorf("cluster %s: list EndpointSlices: %w", kube.name, err)
+			}
+			for _, slice := range existing {
+				if !slices.Contains(names, slice.Name) {
+					slog.Warn("unexpected EndpointSlice", "cluster", kube.name, "namespace", m.namespace, "name", slice.Name, "addresses", endpointSliceAddresses(slice))
+					drifted = true
+				}
+			}
+		}
+	}
+	return drifted, nil
+}
+
+// endpointSliceDrift returns the differences between live and the slice the
+// controller would apply, as log attributes. Only the labels and annotations
+// the controller sets are compared, endpoints are compared regardless of
+// order, and the owner must be svc when the Service exists.
+func endpointSliceDrift(live *discoveryv1.EndpointSlice, apply *discoveryv1apply.EndpointSliceApplyConfiguration, svc *corev1.Service) ([]any, error) {
+	data, err := json.Marshal(apply)
+	if err != nil {
+		return nil, fmt.Errorf("encode desired EndpointSlice: %w", err)
+	}
+	var want discoveryv1.EndpointSlice
+	if err := json.Unmarshal(data, &want); err != nil {
+		return nil, fmt.Errorf("decode desired EndpointSlice: %w", err)
+	}
+	got := live.DeepCopy()
+	got.Labels = make(map[string]string)
+	for key := range want.Labels {
+		if value, ok := live.Labels[key]; ok {
+			got.Labels[key] = value
+		}
+	}
+	got.Annotations = make(map[string]string)
+	for key, value := range live.Annotations {
+		if _, ok := want.Annotations[key]; ok || key == staleAnnotation {
+			got.Annotations[key] = value
+		}
+	}
+	for _, slice := range []*discoveryv1.EndpointSlice{got, &want} {
+		slices.SortFunc(slice.Endpoints, func(a, b discoveryv1.Endpoint) int {
+			return strings.Compare(strings.Join(a.Addresses, ","), strings.Join(b.Addresses, ","))
+		})
+	}
+	diff := endpointSliceDiff(got, &want)
+
+	if svc != nil {
+		owner := ""
+		for _, ref := range live.OwnerReferences {
+			if ref.Kind == "Service" {
+				owner = fmt.Sprintf("%s/%s", ref.Name, ref.UID)
+			}
+		}
+		if wantOwner := fmt.Sprintf("%s/%s", svc.Name, svc.UID); owner != wantOwner {
+			diff = append(diff, slog.Group("owner", "from", owner, "to", wantOwner))
+		}
+	}
+	return diff, nil
+}
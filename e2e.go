@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const e2eServiceName = "ceph-mgr-e2e"
+
+type e2eOptions struct {
+	module      string
+	keep        bool
+	dialTimeout time.Duration
+}
+
+// parseE2EOptions parses the flags of the e2e command.
+func parseE2EOptions(args []string) (e2eOptions, error) {
+	flags := flag.NewFlagSet("e2e", flag.ContinueOnError)
+	opts := e2eOptions{}
+	flags.StringVar(&opts.module, "module", "prometheus", "mgr module to publish")
+	flags.BoolVar(&opts.keep, "keep", false, "keep the temporary namespace for inspection")
+	flags.DurationVar(&opts.dialTimeout, "dial-timeout", 5*time.Second, "timeout for connecting to each published address")
+	err := flags.Parse(args)
+	return opts, err
+}
+
+// runE2E publishes the mgr module into a Service in a temporary namespace of
+// the first cluster, checks the resulting EndpointSlices and that their
+// addresses accept connections, and deletes the namespace. It reports each
+// step to out and returns the exit code.
+func runE2E(ctx context.Context, cfg config, conn discoverer, kube *kubeClient, opts e2eOptions, out io.Writer) (code int) {
+	failed := false
+	step := func(name string, err error) bool {
+		if err != nil {
+			fmt.Fprintf(out, "FAIL %s: %v\n", name, err)
+			failed = true
+			return false
+		}
+		fmt.Fprintf(out, "ok   %s\n", name)
+		return true
+	}
+
+	var services mgrServices
+	err := cfg.cephRetry.do(ctx, func() (err error) {
+		services, err = getMgrServices(conn)
+		return err
+	})
+	if err == nil && services[opts.module] == "" {
+		err = fmt.Errorf("%s service URL not found in ceph mgr services", opts.module)
+	}
+	if !step("discover "+opts.module+" service URL", err) {
+		return 1
+	}
+	var mgr *mgrMap
+	if cfg.dualStack {
+		if mgr, err = getMgrMap(conn); !step("get mgr map", err) {
+			return 1
+		}
+	}
+
+	ns, err := createScratchNamespace(ctx, kube, "ceph-mgr-endpoint-e2e-")
+	if !step("create namespace", err) {
+		return 1
+	}
+	defer func() {
+		if opts.keep {
+			fmt.Fprintf(out, "kept namespace %s\n", ns.Name)
+			return
+		}
+		if !step("delete namespace "+ns.Name, deleteScratchNamespace(ctx, kube, ns)) {
+			code = 1
+		}
+	}()
+
+	m := mapping{module: opts.module, namespace: ns.Name, serviceName: e2eServiceName, slice: e2eServiceName + "-" + opts.module, onDisable: "keep"}
+	groups, err := discoverGroups(ctx, cfg, conn, newHostResolver(cfg.resolve), m, services, mgr, make(map[string][]*endpointAddress))
+	if !step("parse "+opts.module+" addresses", err) {
+		return 1
+	}
+	var dashboardPorts map[string]int32
+	if m.module == "dashboard" && cfg.dashboardPorts {
+		if dashboardPorts, err = getDashboardPorts(conn); !step("get dashboard ports", err) {
+			return 1
+		}
+	}
+	groups = desiredGroups(cfg, m, groups, dashboardPorts)
+	if addr := disallowedAddress(groups, cfg.allowedNets); addr != nil {
+		step("check allowed CIDRs", fmt.Errorf("%s is outside allowedCIDRs", addr.ip))
+		return 1
+	}
+
+	svc, err := createScratchService(ctx, kube, m, groups[0].addrs[0].port)
+	if !step("create Service", err) {
+		return 1
+	}
+
+	if !step("publish EndpointSlices", publishEndpointSlices(ctx, cfg, kube, m, groups)) {
+		return 1
+	}
+
+	for _, group := range groups {
+		slice, err := kube.clientset.DiscoveryV1().EndpointSlices(ns.Name).Get(ctx, group.name, metav1.GetOptions{})
+		if err == nil && !endpointSliceMatches(slice, m, group.addrs) {
+			err = fmt.Errorf("addresses %v, ports %v", endpointSliceAddresses(slice), endpointSlicePorts(slice))
+		}
+		if err == nil && (len(slice.OwnerReferences) != 1 || slice.OwnerReferences[0].UID != svc.UID) {
+			err = fmt.Errorf("not owned by Service %s", svc.Name)
+		}
+		step("verify EndpointSlice "+group.name, err)
+		for _, addr := range group.addrs {
+			hostPort := net.JoinHostPort(addr.ip.String(), strconv.Itoa(int(addr.port)))
+			dialer := net.Dialer{Timeout: opts.dialTimeout}
+			c, err := dialer.DialContext(ctx, "tcp", hostPort)
+			if err == nil {
+				c.Close()
+			}
+			step("connect to "+hostPort, err)
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// createScratchNamespace creates a namespace with a generated name for
+// publishing test Services.
+func createScratchNamespace(ctx context.Context, kube *kubeClient, prefix string) (*corev1.Namespace, error) {
+	return kube.clientset.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: prefix,
+			Labels:       map[string]string{"app.kubernetes.io/managed-by": fieldManager},
+		},
+	}, metav1.CreateOptions{})
+}
+
+// deleteScratchNamespace deletes ns even when ctx has been cancelled.
+func deleteScratchNamespace(ctx context.Context, kube *kubeClient, ns *corev1.Namespace) error {
+	return kube.clientset.CoreV1().Namespaces().Delete(context.WithoutCancel(ctx), ns.Name, metav1.DeleteOptions{})
+}
+
+// createScratchService creates the selectorless Service of m with a port
+// named after its module.
+func createScratchService(ctx context.Context, kube *kubeClient, m mapping, port int32) (*corev1.Service, error) {
+	return kube.clientset.CoreV1().Services(m.namespace).Create(ctx, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: m.serviceName},
+		Spec: corev1.ServiceSpec{
+			Ports: []corev1.ServicePort{{Name: m.module, Port: port, Protocol: corev1.ProtocolTCP}},
+		},
+	}, metav1.CreateOptions{})
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// Error categories that reconcile failures are wrapped with, so logs, status
+// conditions and exit codes can tell them apart. A failure matching several
+// categories takes the first listed.
+var (
+	errInvalidConfig   = errors.New("invalid configuration")
+	errCephUnreachable = errors.New("ceph unreachable")
+	errServiceMissing  = errors.New("mgr service missing")
+	errNoEndpoints     = errors.New("no endpoints")
+	errApplyConflict   = errors.New("apply conflict")
+	errKubernetes      = errors.New("kubernetes request failed")
+	errInconsistentMgr = errors.New("inconsistent mgr data")
+)
+
+var errorCategories = []struct {
+	err      error
+	reason   string
+	exitCode int
+}{
+	{errInvalidConfig, "InvalidConfig", 3},
+	{errCephUnreachable, "CephUnreachable", 4},
+	{errServiceMissing, "ServiceMissing", 5},
+	{errNoEndpoints, "NoEndpoints", 6},
+	{errApplyConflict, "ApplyConflict", 7},
+	{errKubernetes, "KubernetesFailed", 8},
+	{errInconsistentMgr, "InconsistentMgr", 9},
+}
+
+// categorizedError marks err as belonging to category without changing its
+// message.
+type categorizedError struct {
+	category error
+	err      error
+}
+
+func (e *categorizedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *categorizedError) Unwrap() []error {
+	return []error{e.category, e.err}
+}
+
+// withCategory wraps err so that errors.Is matches category.
+func withCategory(category, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &categorizedError{category: category, err: err}
+}
+
+// mappingErrors collects the failures of the mappings in one reconcile, each
+// prefixed with its namespace and slice. errors.Is matches the categories of
+// all of them.
+type mappingErrors []error
+
+func (e mappingErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e mappingErrors) Unwrap() []error {
+	return e
+}
+
+// errorReason returns the reason of the category of err, or an empty string
+// when it has none.
+func errorReason(err error) string {
+	for _, c := range errorCategories {
+		if errors.Is(err, c.err) {
+			return c.reason
+		}
+	}
+	return ""
+}
+
+// exitCode returns the process exit code for a fatal err: the code of its
+// category, or 1.
+func exitCode(err error) int {
+	for _, c := range errorCategories {
+		if errors.Is(err, c.err) {
+			return c.exitCode
+		}
+	}
+	return 1
+}
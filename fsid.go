@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func getFSID(conn discoverer) (string, error) {
+	buf, err := execMonCommand(conn, fsidCommand)
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		FSID string `json:"fsid"`
+	}
+	if err := json.Unmarshal(buf, &resp); err != nil {
+		return "", fmt.Errorf("unmarshal response: %w", err)
+	}
+	return resp.FSID, nil
+}
+
+// stateFileFSID returns the FSID recorded in the state file, or an empty
+// string when there is none.
+func stateFileFSID(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	var saved savedState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return ""
+	}
+	return saved.FSID
+}
+
+// checkFSID compares the FSID of the Ceph cluster with the one seen before.
+// When the cluster was redeployed it reports the change loudly and forgets
+// everything learnt from the previous cluster, so that the run publishes
+// from scratch instead of mixing data from both. Clusters that do not
+// answer the command are not checked.
+func checkFSID(cfg config, conn discoverer, kubes []*kubeClient, state *runState) {
+	fsid, err := getFSID(conn)
+	if err != nil || fsid == "" {
+		slog.Debug("failed to get ceph FSID", "error", err)
+		return
+	}
+	previous := state.fsid
+	state.fsid = fsid
+	if previous == "" || previous == fsid {
+		return
+	}
+	slog.Error("ceph cluster FSID changed, discarding state of the previous cluster", "from", previous, "to", fsid)
+	for _, m := range append(slices.Clone(cfg.mappings), state.serviceMappings...) {
+		for _, kube := range state.shards.targets(cfg, m, kubes) {
+			kube.recorder.Eventf(endpointSliceRef(m), corev1.EventTypeWarning, "FSIDChanged", "Ceph cluster FSID changed from %s to %s, republishing", previous, fsid)
+		}
+	}
+	state.lastHash = ""
+	state.due = nil
+	state.globalDue = time.Time{}
+	state.published = nil
+	state.services = nil
+	state.activeMgr = ""
+	if state.resolver != nil {
+		state.resolver.reset()
+	}
+	if cfg.stateFile != "" {
+		if err := os.Remove(cfg.stateFile); err != nil && !os.IsNotExist(err) {
+			slog.Warn("failed to remove state file", "path", cfg.stateFile, "error", err)
+		}
+	}
+}
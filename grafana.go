@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var grafanaDatasourceResource = schema.GroupVersionResource{Group: "grafana.integreatly.org", Version: "v1beta1", Resource: "grafanadatasources"}
+
+// applyGrafanaDatasource creates or updates a Grafana Operator
+// GrafanaDatasource named after the mapping's Service. The datasource points
+// at the Service rather than a mgr address, so it keeps working across mgr
+// failovers.
+func applyGrafanaDatasource(ctx context.Context, kube *kubeClient, cfg grafanaConfig, m mapping, addr *endpointAddress) error {
+	hostPort, err := serviceHostPort(ctx, kube, m, addr)
+	if err != nil {
+		return err
+	}
+	scheme := "http"
+	jsonData := map[string]any{}
+	if strings.HasPrefix(addr.url, "https://") {
+		scheme = "https"
+		if cfg.insecure {
+			jsonData["tlsSkipVerify"] = true
+		}
+	}
+	matchLabels := make(map[string]any, len(cfg.instanceLabels))
+	for key, value := range cfg.instanceLabels {
+		matchLabels[key] = value
+	}
+	datasource := map[string]any{
+		"name":   m.serviceName,
+		"type":   "prometheus",
+		"access": "proxy",
+		"url":    scheme + "://" + hostPort,
+	}
+	if len(jsonData) > 0 {
+		datasource["jsonData"] = jsonData
+	}
+	spec := map[string]any{
+		"instanceSelector": map[string]any{"matchLabels": matchLabels},
+		"datasource":       datasource,
+	}
+	if cfg.crossNamespace {
+		spec["allowCrossNamespaceImport"] = true
+	}
+
+	applied, err := applyGeneratedObject(ctx, kube, grafanaDatasourceResource, "GrafanaDatasource", m.namespace, m.serviceName, spec)
+	if err != nil {
+		return err
+	}
+	if applied {
+		slog.InfoContext(ctx, "applied GrafanaDatasource", "cluster", kube.name, "namespace", m.namespace, "name", m.serviceName, "url", datasource["url"])
+	}
+	return nil
+}
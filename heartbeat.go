@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coordinationv1apply "k8s.io/client-go/applyconfigurations/coordination/v1"
+)
+
+// heartbeatLeaseName returns the heartbeat Lease for this replica. Sharded
+// replicas each renew their own Lease.
+func heartbeatLeaseName(cfg config, state *runState) string {
+	if cfg.shards > 0 {
+		return cfg.heartbeatLease + "-" + state.shards.identity
+	}
+	return cfg.heartbeatLease
+}
+
+// renewHeartbeat records a successful reconcile by renewing the heartbeat
+// Lease in each cluster. The Lease expires after three intervals, or 15
+// seconds, without a successful reconcile.
+func renewHeartbeat(ctx context.Context, cfg config, kubes []*kubeClient, state *runState) {
+	if cfg.heartbeatLease == "" {
+		return
+	}
+	name := heartbeatLeaseName(cfg, state)
+	duration := int32(max(3*cfg.interval, 15*time.Second) / time.Second)
+	for _, kube := range kubes {
+		if err := cfg.kubeRetry.do(ctx, func() error {
+			return applyHeartbeatLease(ctx, kube, cfg.namespace, name, state.shards.identity, duration)
+		}); err != nil {
+			slog.Warn("failed to renew heartbeat Lease", "cluster", kube.name, "namespace", cfg.namespace, "name", name, "error", err)
+		}
+	}
+}
+
+func applyHeartbeatLease(ctx context.Context, kube *kubeClient, namespace, name, identity string, duration int32) error {
+	lease := coordinationv1apply.Lease(name, namespace).
+		WithLabels(map[string]string{
+			"app.kubernetes.io/managed-by": fieldManager,
+		}).
+		WithSpec(coordinationv1apply.LeaseSpec().
+			WithHolderIdentity(identity).
+			WithLeaseDurationSeconds(duration).
+			WithRenewTime(metav1.NewMicroTime(time.Now())))
+	_, err := kube.clientset.CoordinationV1().Leases(namespace).Apply(ctx, lease, metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+	auditMutation(kube, "apply", "leases", namespace, name, fieldManager, []any{"holder", identity}, err)
+	if err != nil {
+		return fmt.Errorf("apply Lease: %w", err)
+	}
+	slog.Debug("renewed heartbeat Lease", "cluster", kube.name, "namespace", namespace, "name", name)
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// serverTLSConfig returns the TLS configuration of an HTTPS listener. The
+// certificate is read on every handshake so that rotated certificates are
+// picked up. With a client CA, clients must present a certificate signed by
+// it.
+func serverTLSConfig(certFile, keyFile, clientCA string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("load certificate: %w", err)
+			}
+			return &cert, nil
+		},
+	}
+	if clientCA != "" {
+		data, err := os.ReadFile(clientCA)
+		if err != nil {
+			return nil, fmt.Errorf("read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in client CA %s", clientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// requireBearerToken rejects requests to next without the token in
+// tokenFile, which is read on every request so that a rotated Secret takes
+// effect without a restart. Without a token file every request is allowed.
+func requireBearerToken(tokenFile string, next http.Handler) http.Handler {
+	if tokenFile == "" {
+		return next
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		data, err := os.ReadFile(tokenFile)
+		token := strings.TrimSpace(string(data))
+		if err != nil || token == "" {
+			slog.Error("failed to read bearer token", "path", tokenFile, "error", err)
+			http.Error(rw, "bearer token unavailable", http.StatusInternalServerError)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+			http.Error(rw, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(rw, r)
+	})
+}
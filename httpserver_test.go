@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRequireBearerToken(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ok := http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {})
+	tests := []struct {
+		name          string
+		tokenFile     string
+		authorization string
+		status        int
+	}{
+		{name: "no token file", status: http.StatusOK},
+		{name: "matching token", tokenFile: tokenFile, authorization: "Bearer s3cret", status: http.StatusOK},
+		{name: "missing header", tokenFile: tokenFile, status: http.StatusUnauthorized},
+		{name: "wrong token", tokenFile: tokenFile, authorization: "Bearer guess", status: http.StatusUnauthorized},
+		{name: "basic auth", tokenFile: tokenFile, authorization: "Basic czNjcmV0", status: http.StatusUnauthorized},
+		{name: "unreadable token file", tokenFile: filepath.Join(t.TempDir(), "missing"), authorization: "Bearer s3cret", status: http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			requireBearerToken(tt.tokenFile, ok).ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+	discoveryv1apply "k8s.io/client-go/applyconfigurations/discovery/v1"
+	applyconfigmetav1 "k8s.io/client-go/applyconfigurations/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+)
+
+// publisher is the Kubernetes side of a reconcile: the API that
+// EndpointSlices, Services and events are published through. A clientset
+// implements it, and tests substitute the client-go fake.
+type publisher interface {
+	kubernetes.Interface
+}
+
+type kubeClient struct {
+	name        string
+	clientset   publisher
+	broadcaster record.EventBroadcaster
+	recorder    record.EventRecorder
+	dynamic     dynamic.Interface
+	factories   map[string]informers.SharedInformerFactory
+	stop        chan struct{}
+	// forceApply makes updates apply EndpointSlices that the cache shows
+	// as up to date, during a full resync.
+	forceApply bool
+	// servicesHash is the fingerprint of the reconcile in progress, recorded
+	// on the EndpointSlices it applies when skipUnchanged is set.
+	servicesHash string
+}
+
+func newKubeClients(cfg config) ([]*kubeClient, error) {
+	var kubes []*kubeClient
+	for _, cl := range cfg.clusters {
+		kube, err := newKubeClient(cfg, cl)
+		if err != nil {
+			shutdownKubeClients(kubes)
+			return nil, fmt.Errorf("cluster %s: %w", cl.name, err)
+		}
+		kubes = append(kubes, kube)
+	}
+	return kubes, nil
+}
+
+func shutdownKubeClients(kubes []*kubeClient) {
+	for _, kube := range kubes {
+		kube.shutdown()
+	}
+}
+
+// restConfig returns the client configuration for a cluster, including any
+// impersonation.
+func restConfig(cfg config, cl cluster) (*rest.Config, error) {
+	var config *rest.Config
+	var err error
+	if cl.kubeconfig == "" && cl.context == "" {
+		config, err = rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("in-cluster config: %w", err)
+		}
+	} else {
+		config, err = clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+			&clientcmd.ClientConfigLoadingRules{ExplicitPath: cl.kubeconfig},
+			&clientcmd.ConfigOverrides{CurrentContext: cl.context},
+		).ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig: %w", err)
+		}
+	}
+	config.Impersonate = cfg.impersonate
+	return config, nil
+}
+
+func newKubeClient(cfg config, cl cluster) (*kubeClient, error) {
+	config, err := restConfig(cfg, cl)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("create clientset: %w", err)
+	}
+
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("create dynamic client: %w", err)
+	}
+
+	stop := make(chan struct{})
+	factories := make(map[string]informers.SharedInformerFactory)
+	for _, namespace := range cfg.mappingNamespaces() {
+		factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0, informers.WithNamespace(namespace))
+		factory.Discovery().V1().EndpointSlices().Informer()
+		factory.Core().V1().Services().Informer()
+		factory.Start(stop)
+		factories[namespace] = factory
+	}
+	syncCtx, cancel := context.WithTimeout(context.Background(), cacheSyncTimeout)
+	defer cancel()
+	for namespace, factory := range factories {
+		for typ, synced := range factory.WaitForCacheSync(syncCtx.Done()) {
+			if !synced {
+				close(stop)
+				return nil, fmt.Errorf("cache for %v in namespace %s did not sync", typ, namespace)
+			}
+		}
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: fieldManager})
+
+	return &kubeClient{
+		name:        cl.name,
+		clientset:   clientset,
+		broadcaster: broadcaster,
+		recorder:    recorder,
+		dynamic:     dynamicClient,
+		factories:   factories,
+		stop:        stop,
+	}, nil
+}
+
+const cacheSyncTimeout = 30 * time.Second
+
+// getEndpointSlice reads from the informer cache when the namespace is
+// watched and falls back to the API server otherwise.
+func (k *kubeClient) getEndpointSlice(ctx context.Context, namespace, name string) (*discoveryv1.EndpointSlice, error) {
+	if factory, ok := k.factories[namespace]; ok {
+		return factory.Discovery().V1().EndpointSlices().Lister().EndpointSlices(namespace).Get(name)
+	}
+	return k.clientset.DiscoveryV1().EndpointSlices(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+func (k *kubeClient) listEndpointSlices(ctx context.Context, namespace string, selector labels.Selector) ([]*discoveryv1.EndpointSlice, error) {
+	if factory, ok := k.factories[namespace]; ok {
+		return factory.Discovery().V1().EndpointSlices().Lister().EndpointSlices(namespace).List(selector)
+	}
+	list, err := k.clientset.DiscoveryV1().EndpointSlices(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*discoveryv1.EndpointSlice, len(list.Items))
+	for i := range list.Items {
+		items[i] = &list.Items[i]
+	}
+	return items, nil
+}
+
+func (k *kubeClient) getService(ctx context.Context, namespace, name string) (*corev1.Service, error) {
+	if factory, ok := k.factories[namespace]; ok {
+		return factory.Core().V1().Services().Lister().Services(namespace).Get(name)
+	}
+	return k.clientset.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// serviceHostPort returns the cluster DNS name and port of the mapping's
+// Service, using the Service port named after the module when there is one
+// and the mgr port otherwise.
+func serviceHostPort(ctx context.Context, kube *kubeClient, m mapping, addr *endpointAddress) (string, error) {
+	port := addr.port
+	svc, err := kube.getService(ctx, m.namespace, m.serviceName)
+	if err != nil && !errors.IsNotFound(err) {
+		return "", fmt.Errorf("get Service: %w", err)
+	}
+	if err == nil {
+		for _, p := range svc.Spec.Ports {
+			if p.Name == m.module {
+				port = p.Port
+			}
+		}
+	}
+	return net.JoinHostPort(m.serviceName+"."+m.namespace+".svc", strconv.Itoa(int(port))), nil
+}
+
+func (k *kubeClient) listServices(ctx context.Context, namespace string, selector labels.Selector) ([]*corev1.Service, error) {
+	if factory, ok := k.factories[namespace]; ok {
+		return factory.Core().V1().Services().Lister().Services(namespace).List(selector)
+	}
+	list, err := k.clientset.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	items := make([]*corev1.Service, len(list.Items))
+	for i := range list.Items {
+		items[i] = &list.Items[i]
+	}
+	return items, nil
+}
+
+type endpointGroup struct {
+	name  string
+	addrs []*endpointAddress
+}
+
+// groupEndpointAddresses splits addresses into one group per address family
+// and port, since an EndpointSlice carries a single address type and port
+// list. The group containing the first address keeps the base slice name.
+func groupEndpointAddresses(base string, addrs []*endpointAddress) []endpointGroup {
+	var groups []endpointGroup
+	index := make(map[string]int)
+	for _, addr := range addrs {
+		family := strings.ToLower(string(addressTypeFor(addr.ip)))
+		key := fmt.Sprintf("%s-%d", family, addr.port)
+		i, ok := index[key]
+		if !ok {
+			name := base
+			if len(groups) > 0 {
+				name = fmt.Sprintf("%s-%s", base, key)
+			}
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, endpointGroup{name: name})
+		}
+		if !slices.ContainsFunc(groups[i].addrs, func(a *endpointAddress) bool { return a.ip.Equal(addr.ip) }) {
+			groups[i].addrs = append(groups[i].addrs, addr)
+		}
+	}
+	return groups
+}
+
+// mapEndpointGroups applies fn to a copy of every address in groups and
+// groups them again, since fn may change an address family or port.
+func mapEndpointGroups(base string, groups []endpointGroup, fn func(*endpointAddress)) []endpointGroup {
+	var addrs []*endpointAddress
+	for _, group := range groups {
+		for _, addr := range group.addrs {
+			mapped := *addr
+			fn(&mapped)
+			addrs = append(addrs, &mapped)
+		}
+	}
+	return groupEndpointAddresses(base, addrs)
+}
+
+func addressTypeFor(ip net.IP) discoveryv1.AddressType {
+	if ip.To4() == nil {
+		return discoveryv1.AddressTypeIPv6
+	}
+	return discoveryv1.AddressTypeIPv4
+}
+
+func deleteStaleEndpointSlices(ctx context.Context, kube *kubeClient, m mapping, groups []endpointGroup) error {
+	sliceClient := kube.clientset.DiscoveryV1().EndpointSlices(m.namespace)
+	existing, err := kube.listEndpointSlices(ctx, m.namespace, labels.Set{managedByLabel: fieldManager, sliceGroupLabel: m.slice}.AsSelector())
+	if err != nil {
+		return fmt.Errorf("list EndpointSlices: %w", err)
+	}
+	for _, slice := range existing {
+		if slices.ContainsFunc(groups, func(g endpointGroup) bool { return g.name == slice.Name }) {
+			continue
+		}
+		err := sliceClient.Delete(ctx, slice.Name, metav1.DeleteOptions{})
+		auditMutation(kube, "delete", "endpointslices", m.namespace, slice.Name, fieldManager, []any{"addresses", endpointSliceAddresses(slice)}, err)
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("delete EndpointSlice %s: %w", slice.Name, err)
+		}
+		slog.InfoContext(ctx, "deleted stale EndpointSlice", "cluster", kube.name, "namespace", m.namespace, "name", slice.Name)
+	}
+	return nil
+}
+
+// markEndpointSlicesUnready flags every endpoint in the managed slices of a
+// mapping as no longer ready or serving, and optionally as terminating.
+func markEndpointSlicesUnready(ctx context.Context, kube *kubeClient, m mapping, terminating bool) error {
+	sliceClient := kube.clientset.DiscoveryV1().EndpointSlices(m.namespace)
+	existing, err := kube.listEndpointSlices(ctx, m.namespace, labels.Set{managedByLabel: fieldManager, sliceGroupLabel: m.slice}.AsSelector())
+	if err != nil {
+		return fmt.Errorf("list EndpointSlices: %w", err)
+	}
+	for _, slice := range existing {
+		if isPaused(slice.Annotations) || endpointsUnready(slice, terminating) {
+			continue
+		}
+		apply, err := discoveryv1apply.ExtractEndpointSlice(slice, fieldManager)
+		if err != nil {
+			return fmt.Errorf("extract EndpointSlice %s: %w", slice.Name, err)
+		}
+		for i := range apply.Endpoints {
+			apply.Endpoints[i].Conditions = discoveryv1apply.EndpointConditions().
+				WithReady(false).
+				WithServing(false).
+				WithTerminating(terminating)
+		}
+		_, err = sliceClient.Apply(ctx, apply, metav1.ApplyOptions{FieldManager: fieldManager})
+		auditMutation(kube, "apply", "endpointslices", m.namespace, slice.Name, fieldManager, []any{"ready", false, "terminating", terminating}, err)
+		if err != nil {
+			return fmt.Errorf("apply EndpointSlice %s: %w", slice.Name, err)
+		}
+		slog.InfoContext(ctx, "marked EndpointSlice not ready", "cluster", kube.name, "namespace", m.namespace, "name", slice.Name, "terminating", terminating)
+	}
+	return nil
+}
+
+func endpointsUnready(slice *discoveryv1.EndpointSlice, terminating bool) bool {
+	for _, endpoint := range slice.Endpoints {
+		c := endpoint.Conditions
+		if c.Ready == nil || *c.Ready || c.Terminating == nil || *c.Terminating != terminating {
+			return false
+		}
+	}
+	return true
+}
+
+func endpointSliceRef(m mapping) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: "discovery.k8s.io/v1",
+		Kind:       "EndpointSlice",
+		Namespace:  m.namespace,
+		Name:       m.slice,
+	}
+}
+
+func (k *kubeClient) shutdown() {
+	close(k.stop)
+	for _, factory := range k.factories {
+		factory.Shutdown()
+	}
+	k.broadcaster.Shutdown()
+}
+
+const (
+	fieldManager   = "ceph-mgr-endpoint-controller"
+	managedByLabel = "endpointslice.kubernetes.io/managed-by"
+)
+
+func updateEndpointSlice(ctx context.Context, cfg config, kube *kubeClient, m mapping, name string, addrs []*endpointAddress) error {
+	addr := addrs[0]
+	sliceClient := kube.clientset.DiscoveryV1().EndpointSlices(m.namespace)
+
+	existing, err := kube.getEndpointSlice(ctx, m.namespace, name)
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("get EndpointSlice: %w", err)
+	}
+	force := false
+	if err == nil {
+		if manager := foreignManager(existing); manager != "" {
+			switch cfg.conflictPolicy {
+			case "ignore":
+				slog.InfoContext(ctx, "EndpointSlice managed by another component, ignoring", "cluster", kube.name, "namespace", m.namespace, "name", name, "manager", manager)
+				kube.recorder.Eventf(existing, corev1.EventTypeNormal, "ConflictIgnored", "EndpointSlice is managed by %s, skipping update", manager)
+				return nil
+			case "adopt":
+				slog.WarnContext(ctx, "adopting EndpointSlice managed by another component", "cluster", kube.name, "namespace", m.namespace, "name", name, "manager", manager)
+				kube.recorder.Eventf(existing, corev1.EventTypeWarning, "Adopted", "Taking ownership of EndpointSlice managed by %s", manager)
+				force = true
+			default:
+				kube.recorder.Eventf(existing, corev1.EventTypeWarning, "ConflictAborted", "EndpointSlice is managed by %s, refusing to update", manager)
+				return withCategory(errApplyConflict, fmt.Errorf("EndpointSlice is managed by %s", manager))
+			}
+		}
+	}
+	if err == nil && !kube.forceApply && endpointSliceMatches(existing, m, addrs) {
+		slog.DebugContext(ctx, "EndpointSlice already up-to-date", "cluster", kube.name, "namespace", m.namespace, "name", name)
+		return nil
+	}
+	if err == nil && isPaused(existing.Annotations) {
+		slog.InfoContext(ctx, "EndpointSlice paused, skipping update", "cluster", kube.name, "namespace", m.namespace, "name", name, "ip", addr.ip, "port", addr.port)
+		return nil
+	}
+
+	slice := endpointSliceApply(m, name, addrs)
+	if kube.servicesHash != "" {
+		slice.WithAnnotations(map[string]string{servicesHashAnnotation: kube.servicesHash})
+	}
+
+	svc, err := kube.getService(ctx, m.namespace, m.serviceName)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to get service for owner reference", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "error", err)
+		svc = nil
+	} else if isPaused(svc.Annotations) {
+		slog.InfoContext(ctx, "Service paused, skipping EndpointSlice update", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "name", name, "ip", addr.ip, "port", addr.port)
+		return nil
+	} else if rookManaged(svc) && cfg.conflictPolicy != "adopt" {
+		if cfg.conflictPolicy == "ignore" {
+			slog.InfoContext(ctx, "Service managed by Rook, ignoring", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName)
+			kube.recorder.Eventf(svc, corev1.EventTypeNormal, "RookConflictIgnored", "Service is managed by Rook, skipping EndpointSlice %s", name)
+			return nil
+		}
+		kube.recorder.Eventf(svc, corev1.EventTypeWarning, "RookConflictAborted", "Service is managed by Rook, refusing to publish EndpointSlice %s", name)
+		return withCategory(errApplyConflict, fmt.Errorf("Service %s/%s is managed by Rook", m.namespace, m.serviceName))
+	} else {
+		if rookManaged(svc) {
+			slog.WarnContext(ctx, "taking over Service managed by Rook", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName)
+			kube.recorder.Eventf(svc, corev1.EventTypeWarning, "RookAdopted", "Publishing EndpointSlice %s for Service managed by Rook", name)
+		}
+		slice = slice.WithOwnerReferences(
+			applyconfigmetav1.OwnerReference().
+				WithAPIVersion("v1").
+				WithKind("Service").
+				WithName(svc.Name).
+				WithUID(svc.UID),
+		)
+	}
+
+	if cfg.dryRunDiff {
+		preview, err := sliceClient.Apply(ctx, slice, metav1.ApplyOptions{FieldManager: fieldManager, Force: force, DryRun: []string{metav1.DryRunAll}})
+		if err != nil {
+			return fmt.Errorf("dry-run apply EndpointSlice: %w", err)
+		}
+		if existing == nil {
+			existing = &discoveryv1.EndpointSlice{}
+		}
+		slog.InfoContext(ctx, "EndpointSlice diff", append([]any{"cluster", kube.name, "namespace", m.namespace, "name", name}, endpointSliceDiff(existing, preview)...)...)
+	}
+
+	applied, err := sliceClient.Apply(ctx, slice, metav1.ApplyOptions{FieldManager: fieldManager, Force: force})
+	var diff []any
+	if auditLog != nil && err == nil {
+		if existing == nil {
+			existing = &discoveryv1.EndpointSlice{}
+		}
+		diff = endpointSliceDiff(existing, applied)
+	}
+	auditMutation(kube, "apply", "endpointslices", m.namespace, name, fieldManager, diff, err)
+	if err != nil {
+		return fmt.Errorf("apply EndpointSlice: %w", err)
+	}
+
+	slog.InfoContext(ctx, "applied EndpointSlice", "cluster", kube.name, "namespace", m.namespace, "name", name, "ip", addr.ip, "port", addr.port)
+
+	if svc != nil && name == m.slice {
+		if err := updateServiceAnnotations(ctx, kube, svc, m, addr); err != nil {
+			slog.WarnContext(ctx, "failed to annotate service", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "error", err)
+		}
+	}
+	return nil
+}
+
+func updateServiceAnnotations(ctx context.Context, kube *kubeClient, svc *corev1.Service, m mapping, addr *endpointAddress) error {
+	annotations := map[string]string{
+		"ceph.io/" + m.module + "-url":        addr.url,
+		"ceph.io/" + m.module + "-url-prefix": addr.path,
+		"ceph.io/" + m.module + "-url-scheme": addr.scheme(),
+	}
+	current := make(map[string]string)
+	for key := range annotations {
+		if value, ok := svc.Annotations[key]; ok {
+			current[key] = value
+		}
+	}
+	if maps.Equal(current, annotations) {
+		return nil
+	}
+
+	service := corev1apply.Service(m.serviceName, m.namespace).WithAnnotations(annotations)
+	_, err := kube.clientset.CoreV1().Services(m.namespace).Apply(ctx, service, metav1.ApplyOptions{FieldManager: fieldManager + "-" + m.module})
+	auditMutation(kube, "apply", "services", m.namespace, m.serviceName, fieldManager+"-"+m.module, []any{"annotations", changedKeys(current, annotations, func(a, b string) bool { return a == b })}, err)
+	if err != nil {
+		return fmt.Errorf("apply Service: %w", err)
+	}
+	slog.InfoContext(ctx, "annotated Service", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "url", addr.url)
+	return nil
+}
+
+// rookManaged reports whether a Rook operator created or owns obj, as for the
+// mgr Services Rook maintains alongside an external cluster.
+func rookManaged(obj metav1.Object) bool {
+	labels := obj.GetLabels()
+	if labels["app.kubernetes.io/managed-by"] == "rook-ceph-operator" || labels["rook_cluster"] != "" {
+		return true
+	}
+	for _, ref := range obj.GetOwnerReferences() {
+		if strings.HasPrefix(ref.APIVersion, "ceph.rook.io/") {
+			return true
+		}
+	}
+	return false
+}
+
+func foreignManager(slice *discoveryv1.EndpointSlice) string {
+	if manager, ok := slice.Labels[managedByLabel]; ok && manager != fieldManager {
+		return manager
+	}
+	if rookManaged(slice) {
+		return "rook-ceph-operator"
+	}
+	for _, entry := range slice.ManagedFields {
+		if entry.Manager == fieldManager || entry.FieldsV1 == nil {
+			continue
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &fields); err != nil {
+			continue
+		}
+		for _, key := range []string{"f:addressType", "f:endpoints", "f:ports"} {
+			if _, ok := fields[key]; ok {
+				return entry.Manager
+			}
+		}
+	}
+	return ""
+}
+
+func endpointSliceDiff(from, to *discoveryv1.EndpointSlice) []any {
+	var attrs []any
+	add := func(field string, before, after any) {
+		if !reflect.DeepEqual(before, after) {
+			attrs = append(attrs, slog.Group(field, "from", before, "to", after))
+		}
+	}
+	add("addressType", string(from.AddressType), string(to.AddressType))
+	add("addresses", endpointSliceAddresses(from), endpointSliceAddresses(to))
+	add("ports", endpointSlicePorts(from), endpointSlicePorts(to))
+	add("labels", from.Labels, to.Labels)
+	add("annotations", from.Annotations, to.Annotations)
+	return attrs
+}
+
+func endpointSliceAddresses(slice *discoveryv1.EndpointSlice) []string {
+	var addresses []string
+	for _, endpoint := range slice.Endpoints {
+		addresses = append(addresses, endpoint.Addresses...)
+	}
+	return addresses
+}
+
+func endpointSlicePorts(slice *discoveryv1.EndpointSlice) []string {
+	var ports []string
+	for _, port := range slice.Ports {
+		var name, protocol string
+		var number int32
+		if port.Name != nil {
+			name = *port.Name
+		}
+		if port.Port != nil {
+			number = *port.Port
+		}
+		if port.Protocol != nil {
+			protocol = string(*port.Protocol)
+		}
+		ports = append(ports, fmt.Sprintf("%s:%d/%s", name, number, protocol))
+	}
+	return ports
+}
+
+const (
+	pausedAnnotation    = "ceph.io/paused"
+	urlAnnotation       = "ceph.io/url"
+	urlPrefixAnnotation = "ceph.io/url-prefix"
+	urlSchemeAnnotation = "ceph.io/url-scheme"
+	sliceGroupLabel     = "ceph.io/slice-group"
+	// servicesHashAnnotation records the servicesHash of the reconcile that
+	// last applied a slice.
+	servicesHashAnnotation = "ceph.io/services-hash"
+)
+
+func isPaused(annotations map[string]string) bool {
+	paused, _ := strconv.ParseBool(annotations[pausedAnnotation])
+	return paused
+}
+
+func endpointSliceMatches(slice *discoveryv1.EndpointSlice, m mapping, addrs []*endpointAddress) bool {
+	addr := addrs[0]
+	if slice.Labels["kubernetes.io/service-name"] != m.serviceName {
+		return false
+	}
+	if slice.Labels[managedByLabel] != fieldManager || slice.Labels[sliceGroupLabel] != m.slice {
+		return false
+	}
+	if slice.Annotations[urlAnnotation] != addr.url || slice.Annotations[urlPrefixAnnotation] != addr.path || slice.Annotations[urlSchemeAnnotation] != addr.scheme() {
+		return false
+	}
+	staleSince, stale := slice.Annotations[staleAnnotation]
+	if stale != !addr.staleSince.IsZero() || (stale && staleSince != addr.staleSince.Format(time.RFC3339)) {
+		return false
+	}
+
+	if slice.AddressType != addressTypeFor(addr.ip) {
+		return false
+	}
+
+	if len(slice.Endpoints) != len(addrs) {
+		return false
+	}
+	for _, endpoint := range slice.Endpoints {
+		if len(endpoint.Addresses) != 1 || endpoint.Conditions != (discoveryv1.EndpointConditions{}) {
+			return false
+		}
+	}
+	// Discovery order is not stable across restarts, so compare the
+	// addresses as a set to avoid reapplying an otherwise identical slice.
+	want := make([]string, len(addrs))
+	for i, a := range addrs {
+		want[i] = a.ip.String()
+	}
+	got := endpointSliceAddresses(slice)
+	slices.Sort(want)
+	slices.Sort(got)
+	if !slices.Equal(got, want) {
+		return false
+	}
+	nodes := make(map[string]string, len(slice.Endpoints))
+	for _, endpoint := range slice.Endpoints {
+		if endpoint.NodeName != nil {
+			nodes[endpoint.Addresses[0]] = *endpoint.NodeName
+		}
+	}
+	for _, a := range addrs {
+		if nodes[a.ip.String()] != a.nodeName {
+			return false
+		}
+	}
+	var ports []string
+	for _, port := range endpointPorts(m, addr) {
+		ports = append(ports, fmt.Sprintf("%s:%d/%s", *port.Name, *port.Port, *port.Protocol))
+	}
+	return slices.Equal(endpointSlicePorts(slice), ports)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+// linkerdExportLabel marks a Service for Linkerd multi-cluster mirroring.
+// Its value selects gateway mirroring ("true") or remote discovery.
+const linkerdExportLabel = "mirror.linkerd.io/exported"
+
+// labelLinkerdExport stamps the mapping's Service with the Linkerd export
+// label so that linked clusters mirror it.
+func labelLinkerdExport(ctx context.Context, kube *kubeClient, m mapping, mode string) error {
+	svc, err := kube.getService(ctx, m.namespace, m.serviceName)
+	if err != nil {
+		return fmt.Errorf("get Service: %w", err)
+	}
+	if svc.Labels[linkerdExportLabel] == mode {
+		return nil
+	}
+	manager := fieldManager + "-linkerd"
+	service := corev1apply.Service(m.serviceName, m.namespace).WithLabels(map[string]string{linkerdExportLabel: mode})
+	_, err = kube.clientset.CoreV1().Services(m.namespace).Apply(ctx, service, metav1.ApplyOptions{FieldManager: manager})
+	auditMutation(kube, "apply", "services", m.namespace, m.serviceName, manager, []any{"labels", []string{linkerdExportLabel}}, err)
+	if err != nil {
+		return fmt.Errorf("apply Service: %w", err)
+	}
+	slog.InfoContext(ctx, "labeled Service for Linkerd mirroring", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "mode", mode)
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+type logAttrsKey struct{}
+
+// withLogAttrs returns a context whose log lines carry attrs, after those
+// already attached to ctx.
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	return context.WithValue(ctx, logAttrsKey{}, append(existing[:len(existing):len(existing)], attrs...))
+}
+
+// withMappingLog attaches the mapping and the FSID of the Ceph cluster it is
+// published from, when known, to the log lines emitted with ctx, as the
+// mapping group.
+func withMappingLog(ctx context.Context, m mapping, fsid string) context.Context {
+	name := m.module
+	switch {
+	case m.resource != "":
+		name = m.resource
+	case m.daemonType != "":
+		name = m.daemonType
+	}
+	attrs := []any{"name", name, "namespace", m.namespace, "slice", m.slice}
+	if fsid != "" {
+		attrs = append(attrs, "fsid", fsid)
+	}
+	return withLogAttrs(ctx, slog.Group("mapping", attrs...))
+}
+
+// contextHandler adds the attributes attached to the context of a record,
+// so that functions logging with the *Context variants of slog need not
+// pass them along.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r = r.Clone()
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logOutput is where the regular logs are written: standard error, or the
+// configured log file.
+var logOutput io.Writer = os.Stderr
+
+// backupTimeFormat names rotated log files after the time they were rotated.
+const backupTimeFormat = "20060102T150405.000"
+
+// openLogFile points logOutput at the log file of cfg, or at standard error
+// when no path is configured.
+func openLogFile(cfg logFileConfig) (io.Closer, error) {
+	if cfg.path == "" {
+		logOutput = os.Stderr
+		return nopWriteCloser{io.Discard}, nil
+	}
+	f := &rotatingFile{cfg: cfg}
+	if err := f.open(time.Now()); err != nil {
+		return nil, fmt.Errorf("open log file: %w", err)
+	}
+	logOutput = f
+	return f, nil
+}
+
+// rotatingFile appends to a log file and renames it to a timestamped backup
+// once it reaches maxSize or maxAge, keeping at most maxBackups backups.
+type rotatingFile struct {
+	cfg    logFileConfig
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// open opens the log file for appending. An existing file that is already
+// due for rotation is rotated first, so that restarts do not keep a file
+// from aging out.
+func (f *rotatingFile) open(now time.Time) error {
+	file, err := os.OpenFile(f.cfg.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.opened = file, info.Size(), now
+	if f.size > 0 && f.cfg.maxAge > 0 && now.Sub(info.ModTime()) >= f.cfg.maxAge {
+		return f.rotate(now)
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	if f.size > 0 && (f.size+int64(len(p)) > f.cfg.maxSize || (f.cfg.maxAge > 0 && now.Sub(f.opened) >= f.cfg.maxAge)) {
+		if err := f.rotate(now); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to rotate log file: %v\n", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the log file to a backup, opens a new one and removes the
+// oldest backups. When the rename fails, writing continues to the old file.
+func (f *rotatingFile) rotate(now time.Time) error {
+	backup := f.cfg.path + "." + now.UTC().Format(backupTimeFormat)
+	if err := os.Rename(f.cfg.path, backup); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.cfg.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	f.file.Close()
+	f.file, f.size, f.opened = file, 0, now
+	return f.prune()
+}
+
+// prune removes the backups beyond the newest maxBackups.
+func (f *rotatingFile) prune() error {
+	matches, err := filepath.Glob(f.cfg.path + ".*")
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, match := range matches {
+		if _, err := time.Parse(backupTimeFormat, strings.TrimPrefix(match, f.cfg.path+".")); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	slices.Sort(backups)
+	for len(backups) > f.cfg.maxBackups {
+		if err := os.Remove(backups[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
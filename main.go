@@ -2,192 +2,298 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"log/slog"
+	"maps"
+	"math/rand/v2"
 	"net"
-	"net/url"
 	"os"
 	"os/signal"
 	"reflect"
-	"strconv"
+	"slices"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/ceph/go-ceph/rados"
 	corev1 "k8s.io/api/core/v1"
-	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	discoveryv1apply "k8s.io/client-go/applyconfigurations/discovery/v1"
-	applyconfigmetav1 "k8s.io/client-go/applyconfigurations/meta/v1"
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
 )
 
-type rawConfig struct {
-	Debug           *bool  `json:"debug,omitempty"`
-	Interval        string `json:"interval,omitempty"`
-	Namespace       string `json:"namespace,omitempty"`
-	ServiceName     string `json:"serviceName,omitempty"`
-	DashboardSlice  string `json:"dashboardSlice,omitempty"`
-	PrometheusSlice string `json:"prometheusSlice,omitempty"`
-}
-
-type config struct {
-	debug           bool
-	interval        time.Duration
-	namespace       string
-	serviceName     string
-	dashboardSlice  string
-	prometheusSlice string
-	cephID          string
-	cephKey         string
-}
+var version = "0.5.0"
 
-func loadConfig() (config, error) {
-	var cephID string
-	if data, err := os.ReadFile("/var/run/secrets/ceph/userID"); err == nil {
-		cephID = strings.TrimSpace(string(data))
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		major, minor, patch := rados.Version()
+		fmt.Printf("ceph-mgr-endpoint-controller: %s\n", version)
+		fmt.Printf("librados: %d.%d.%d\n", major, minor, patch)
+		return
 	}
-
-	var cephKey string
-	if data, err := os.ReadFile("/var/run/secrets/ceph/userKey"); err == nil {
-		cephKey = strings.TrimSpace(string(data))
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(check(os.Args[2:]))
 	}
-
-	path := "/etc/ceph-mgr-endpoint-controller/config.json"
-	if v := os.Getenv("CEPH_MGR_CONFIG_PATH"); v != "" {
-		path = v
+	if len(os.Args) > 1 && os.Args[1] == "state" {
+		os.Exit(stateCommand(os.Args[2:]))
 	}
-	f, err := os.Open(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			return config{
-				cephID:  cephID,
-				cephKey: cephKey,
-			}, nil
-		}
-		return config{}, fmt.Errorf("open config file: %w", err)
-	}
-	defer f.Close()
-	var raw rawConfig
-	if err := json.NewDecoder(f).Decode(&raw); err != nil {
-		return config{}, fmt.Errorf("decode config file: %w", err)
-	}
-	var interval time.Duration
-	if raw.Interval != "" {
-		parsed, err := time.ParseDuration(raw.Interval)
+	cephStub := flag.String("ceph-stub", "", "answer Ceph commands from this JSON fixture instead of librados")
+	printOnly := flag.Bool("print-objects", false, "print the EndpointSlices that would be applied as YAML and exit")
+	recordCeph := flag.String("record-ceph", "", "append every Ceph command and its response to this file")
+	replayCeph := flag.String("replay-ceph", "", "answer Ceph commands from a file written by --record-ceph instead of librados")
+	once := flag.Bool("once", false, "run a single reconcile, print a JSON summary of its outcome and exit")
+	var e2e *e2eOptions
+	var bench *benchOptions
+	switch {
+	case len(os.Args) > 1 && os.Args[1] == "e2e":
+		opts, err := parseE2EOptions(os.Args[2:])
 		if err != nil {
-			return config{}, fmt.Errorf("invalid duration in config: %w", err)
+			os.Exit(2)
 		}
-		if parsed <= 0 {
-			return config{}, fmt.Errorf("interval must be positive: %s", raw.Interval)
+		e2e = &opts
+	case len(os.Args) > 1 && os.Args[1] == "bench":
+		opts, err := parseBenchOptions(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
 		}
-		interval = parsed
-	}
-	debug := false
-	if raw.Debug != nil {
-		debug = *raw.Debug
+		bench = &opts
+	default:
+		flag.Parse()
 	}
-	if (raw.DashboardSlice != "" || raw.PrometheusSlice != "") && raw.Namespace == "" {
-		return config{}, fmt.Errorf("namespace is required when creating EndpointSlices")
-	}
-	if (raw.DashboardSlice != "" || raw.PrometheusSlice != "") && raw.ServiceName == "" {
-		return config{}, fmt.Errorf("service name is required when creating EndpointSlices")
-	}
-	return config{
-		debug:           debug,
-		interval:        interval,
-		namespace:       raw.Namespace,
-		serviceName:     raw.ServiceName,
-		dashboardSlice:  raw.DashboardSlice,
-		prometheusSlice: raw.PrometheusSlice,
-		cephID:          cephID,
-		cephKey:         cephKey,
-	}, nil
-}
-
-var version = "0.5.0"
 
-func main() {
-	if len(os.Args) > 1 && os.Args[1] == "version" {
-		major, minor, patch := rados.Version()
-		fmt.Printf("ceph-mgr-endpoint-controller: %s\n", version)
-		fmt.Printf("librados: %d.%d.%d\n", major, minor, patch)
-		return
+	// fatal exits with the code of err's category, reporting it first as
+	// the outcome of --once.
+	fatal := func(err error) {
+		if *once {
+			os.Exit(reportOnceFailure(os.Stdout, err))
+		}
+		os.Exit(exitCode(err))
 	}
 
 	cfg, err := loadConfig()
 	if err != nil {
 		slog.Error("failed to load config", "error", err)
-		os.Exit(1)
+		fatal(err)
+	}
+	if cfg.auditLog == "stdout" && (*once || *printOnly || e2e != nil || bench != nil) {
+		err := withCategory(errInvalidConfig, fmt.Errorf("auditLog stdout would mix audit records into the output on standard output; use a file"))
+		slog.Error("failed to load config", "error", err)
+		fatal(err)
 	}
 
-	if cfg.debug {
-		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	logFile, err := openLogFile(cfg.logFile)
+	if err != nil {
+		slog.Error("failed to open log file", "error", err)
+		fatal(err)
 	}
+	defer func() { logFile.Close() }()
+	slog.SetDefault(newLogger(cfg))
+
+	interval := cfg.tickInterval()
 
-	interval := cfg.interval
+	audit, err := openAuditLog(cfg.auditLog)
+	if err != nil {
+		slog.Error("failed to open audit log", "error", err)
+		fatal(err)
+	}
+	defer func() { audit.Close() }()
 
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	var conn *rados.Conn
-	if cfg.cephID != "" {
-		conn, err = rados.NewConnWithUser(cfg.cephID)
+	var ceph discoverer
+	var connect func() error
+	var connAttrs []any
+	if *cephStub != "" {
+		slog.Warn("answering Ceph commands from stub fixture instead of librados", "path", *cephStub)
+		stub := &stubConn{path: *cephStub}
+		ceph, connect = stub, stub.connect
+	} else if *replayCeph != "" {
+		slog.Warn("replaying Ceph commands from recording instead of librados", "path", *replayCeph)
+		replay, err := newReplayConn(*replayCeph)
+		if err != nil {
+			slog.Error("failed to load Ceph recording", "error", err)
+			fatal(err)
+		}
+		ceph, connect = replay, func() error { return nil }
 	} else {
-		conn, err = rados.NewConn()
+		conn, err := newRadosConn(cfg)
+		if err != nil {
+			slog.Error("failed to create rados connection", "error", err)
+			fatal(err)
+		}
+		defer conn.Shutdown()
+
+		connAttrs = radosConfigAttrs(conn)
+		slog.Debug("rados config", connAttrs...)
+
+		ceph, connect = conn, conn.Connect
 	}
-	if err != nil {
-		slog.Error("failed to create rados connection", "error", err)
-		os.Exit(1)
+	if *recordCeph != "" {
+		recording, err := newRecordingConn(ceph, *recordCeph)
+		if err != nil {
+			slog.Error("failed to open Ceph recording", "error", err)
+			fatal(err)
+		}
+		defer recording.file.Close()
+		slog.Warn("recording Ceph commands and responses", "path", *recordCeph)
+		ceph = recording
 	}
-	defer conn.Shutdown()
 
-	if err := conn.ReadDefaultConfigFile(); err != nil {
-		slog.Error("failed to read ceph config", "error", err)
-		os.Exit(1)
+	connected, connectErr := waitForCeph(ctx, cfg, ceph, connect)
+	if !connected {
+		slog.Error("failed to connect to cluster", append([]any{"error", connectErr}, connAttrs...)...)
+		if cfg.stateFile == "" {
+			fatal(withCategory(errCephUnreachable, fmt.Errorf("connect to cluster: %w", connectErr)))
+		}
+	} else if connectErr != nil {
+		slog.Warn("ceph cluster not answering mgr commands at the end of the startup window", "error", connectErr)
 	}
 
-	if err := conn.ParseDefaultConfigEnv(); err != nil {
-		slog.Error("failed to parse ceph args env", "error", err)
-		os.Exit(1)
+	if *printOnly {
+		if !connected {
+			os.Exit(exitCode(errCephUnreachable))
+		}
+		if err := printObjects(ctx, cfg, ceph, os.Stdout); err != nil {
+			slog.Error("failed to print objects", "error", err)
+			os.Exit(exitCode(err))
+		}
+		return
 	}
 
-	if cfg.cephKey != "" {
-		if err := conn.SetConfigOption("key", cfg.cephKey); err != nil {
-			slog.Error("failed to set ceph key", "error", err)
-			os.Exit(1)
+	if _, err := checkRBAC(ctx, cfg, nil); err != nil {
+		slog.Warn("failed to check RBAC permissions", "error", err)
+	}
+
+	kubes, err := newKubeClients(cfg)
+	if err != nil {
+		slog.Error("failed to connect to kubernetes", "error", err)
+		fatal(withCategory(errKubernetes, fmt.Errorf("connect to kubernetes: %w", err)))
+	}
+	defer func() { shutdownKubeClients(kubes) }()
+
+	if e2e != nil {
+		if !connected {
+			os.Exit(exitCode(errCephUnreachable))
 		}
+		os.Exit(runE2E(ctx, cfg, ceph, kubes[0], *e2e, os.Stdout))
+	}
+	if bench != nil {
+		if !connected {
+			os.Exit(exitCode(errCephUnreachable))
+		}
+		os.Exit(runBench(ctx, cfg, ceph, kubes[0], *bench, os.Stdout))
 	}
 
-	slog.Debug("rados config", radosConfigAttrs(conn)...)
+	if len(cfg.migrateManagers) > 0 {
+		migrateFieldManagers(ctx, cfg, kubes)
+	}
 
-	if err := conn.Connect(); err != nil {
-		slog.Error("failed to connect to cluster", append([]any{"error", err}, radosConfigAttrs(conn)...)...)
-		os.Exit(1)
+	hook := &webhookServer{}
+	hook.update(cfg, kubes)
+	if cfg.webhook.addr != "" {
+		go func() {
+			if err := hook.serve(ctx, cfg.webhook); err != nil {
+				slog.Error("admission webhook failed", "error", err)
+				cancel()
+			}
+		}()
+	}
+	metrics := &metricsServer{}
+	metrics.update(ctx, cfg, func(err error) {
+		slog.Error("metrics server failed", "error", err)
+		cancel()
+	})
+	otlp := &otlpExporter{}
+	if !*once {
+		otlp.update(ctx, cfg.otlp)
 	}
 
-	clientset, err := getKubeClient()
+	shards, err := newShardManager()
 	if err != nil {
-		slog.Error("failed to connect to kubernetes", "error", err)
+		slog.Error("failed to create shard manager", "error", err)
 		os.Exit(1)
 	}
 
-	if err := run(ctx, cfg, conn, clientset); err != nil {
-		slog.Error("run failed", "error", err)
+	state := &runState{started: time.Now(), shards: shards}
+	if cfg.stateFile != "" {
+		state.fsid = stateFileFSID(cfg.stateFile)
+	}
+	seedRunState(ctx, cfg, kubes, state)
+	unreachable := func(err error) {
+		state.failures++
+		state.lastErr = withCategory(errCephUnreachable, err)
+		state.setCondition(conditionCephReachable, metav1.ConditionFalse, "ConnectFailed", err.Error())
+		state.updateDegraded(nil)
+		publishLastKnown(ctx, cfg, kubes, state)
+	}
+	reconcile := func() {
+		if !connected {
+			if err := connect(); err != nil {
+				slog.Error("ceph cluster unreachable, publishing last-known endpoints", "error", err)
+				unreachable(err)
+			} else {
+				slog.Info("connected to cluster")
+				connected = true
+			}
+		}
+		if connected {
+			if err := runWithTimeout(ctx, cfg, ceph, kubes, state); err != nil {
+				slog.Error("run failed", "error", err, "reason", errorReason(err))
+			}
+		}
+		publishStatus(ctx, cfg, kubes, state)
+	}
+	dog := &watchdog{}
+	if timeout, err := watchdogTimeout(); err != nil {
+		slog.Warn("systemd watchdog disabled", "error", err)
+	} else if timeout > 0 {
+		slog.Info("pinging systemd watchdog", "timeout", timeout)
+		go dog.run(ctx, timeout)
+	}
+
+	dog.begin(tickLimit(cfg))
+	start := time.Now()
+	if connected {
+		reconcile()
+	} else {
+		unreachable(connectErr)
+		publishStatus(ctx, cfg, kubes, state)
+	}
+	dog.end()
+	if *once {
+		if cfg.pushgateway.url != "" {
+			if err := pushMetrics(ctx, cfg.pushgateway, state, time.Since(start)); err != nil {
+				slog.Error("failed to push metrics to Pushgateway", "url", cfg.pushgateway.url, "error", err)
+			}
+		}
+		os.Exit(reportOnce(os.Stdout, state))
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("failed to notify systemd", "error", err)
+	}
+	if state.startupFailed(cfg.failFast) {
+		slog.Error("no successful reconcile since startup, exiting", "failures", state.failures, "error", state.lastErr)
+		os.Exit(exitCode(state.lastErr))
 	}
 
-	ticker := time.NewTicker(interval)
+	ticker := time.NewTicker(jitteredInterval(interval, cfg.jitter))
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
+			if err := sdNotify("STOPPING=1"); err != nil {
+				slog.Warn("failed to notify systemd", "error", err)
+			}
+			shutdown(cfg, kubes, state)
 			return
 		case <-ticker.C:
+			dog.begin(tickLimit(cfg))
 			newCfg, err := loadConfig()
 			if err != nil {
 				slog.Error("failed to reload config, using previous configuration", "error", err)
@@ -195,260 +301,823 @@ func main() {
 				slog.Debug("configuration changed", "from", cfg, "to", newCfg)
 				if newCfg.debug != cfg.debug {
 					slog.Info("log level changed", "debug", newCfg.debug)
-					if newCfg.debug {
-						slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})))
+				}
+				if newCfg.logFile != cfg.logFile {
+					if newLogFile, err := openLogFile(newCfg.logFile); err != nil {
+						slog.Error("failed to open log file, keeping previous log file", "error", err)
+						newCfg.logFile = cfg.logFile
+					} else {
+						slog.SetDefault(newLogger(newCfg))
+						logFile.Close()
+						logFile = newLogFile
+						slog.Info("log file changed", "path", newCfg.logFile.path)
+					}
+				}
+				if newCfg.debug != cfg.debug || newCfg.repeatInterval != cfg.repeatInterval {
+					slog.SetDefault(newLogger(newCfg))
+				}
+				if newCfg.auditLog != cfg.auditLog {
+					if newAudit, err := openAuditLog(newCfg.auditLog); err != nil {
+						slog.Error("failed to open audit log, keeping previous audit log", "error", err)
+						newCfg.auditLog = cfg.auditLog
+					} else {
+						audit.Close()
+						audit = newAudit
+						slog.Info("audit log changed", "path", newCfg.auditLog)
+					}
+				}
+				if newCfg.tickInterval() != interval || newCfg.jitter != cfg.jitter {
+					interval = newCfg.tickInterval()
+					slog.Info("interval changed", "interval", interval, "jitter", newCfg.jitter)
+				}
+				if !reflect.DeepEqual(newCfg.impersonate, cfg.impersonate) || !reflect.DeepEqual(newCfg.clusters, cfg.clusters) || !slices.Equal(newCfg.mappingNamespaces(), cfg.mappingNamespaces()) {
+					if newKubes, err := newKubeClients(newCfg); err != nil {
+						slog.Error("failed to recreate kubernetes clients, using previous clients", "error", err)
 					} else {
-						slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})))
+						shutdownKubeClients(kubes)
+						kubes = newKubes
+						state.lastHash = ""
+						slog.Info("kubernetes clients changed", "clusters", len(kubes), "impersonate", newCfg.impersonate.UserName)
 					}
 				}
-				if newCfg.interval != cfg.interval {
-					interval = newCfg.interval
-					ticker.Reset(interval)
-					slog.Info("interval changed", "interval", interval)
+				if metrics.update(ctx, newCfg, func(err error) {
+					slog.Error("metrics server failed", "addr", newCfg.metricsAddr, "error", err)
+				}) {
+					slog.Info("metrics server changed", "addr", newCfg.metricsAddr)
+				}
+				if newCfg.otlp != cfg.otlp {
+					otlp.update(ctx, newCfg.otlp)
+					slog.Info("otlp export changed", "endpoint", newCfg.otlp.endpoint)
 				}
 				cfg = newCfg
+				state.lastHash = ""
+				hook.update(cfg, kubes)
 			}
 
-			if err := run(ctx, cfg, conn, clientset); err != nil {
-				slog.Error("run failed", "error", err)
+			reconcile()
+			if state.startupFailed(cfg.failFast) {
+				slog.Error("no successful reconcile since startup, exiting", "failures", state.failures, "elapsed", time.Since(state.started), "error", state.lastErr)
+				os.Exit(exitCode(state.lastErr))
 			}
+			dog.end()
+			ticker.Reset(jitteredInterval(interval, cfg.jitter))
 		}
 	}
 }
 
-func radosConfigAttrs(conn *rados.Conn) []any {
-	var attrs []any
-	for _, key := range []string{"name", "keyring", "mon_host"} {
-		if val, err := conn.GetConfigOption(key); err == nil {
-			attrs = append(attrs, key, val)
+// newRadosConn creates a rados connection configured from the default Ceph
+// configuration file and environment, and the credentials of cfg.
+func newRadosConn(cfg config) (*rados.Conn, error) {
+	var conn *rados.Conn
+	var err error
+	if cfg.cephID != "" {
+		conn, err = rados.NewConnWithUser(cfg.cephID)
+	} else {
+		conn, err = rados.NewConn()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.ReadDefaultConfigFile(); err != nil {
+		conn.Shutdown()
+		return nil, fmt.Errorf("read ceph config: %w", err)
+	}
+	if err := conn.ParseDefaultConfigEnv(); err != nil {
+		conn.Shutdown()
+		return nil, fmt.Errorf("parse ceph args env: %w", err)
+	}
+	if cfg.cephKey != "" {
+		if err := conn.SetConfigOption("key", cfg.cephKey); err != nil {
+			conn.Shutdown()
+			return nil, fmt.Errorf("set ceph key: %w", err)
 		}
 	}
-	return attrs
+	return conn, nil
 }
 
-func run(ctx context.Context, cfg config, conn *rados.Conn, clientset *kubernetes.Clientset) error {
-	services, err := getMgrServices(conn)
-	if err != nil {
-		return fmt.Errorf("failed to get mgr services: %w", err)
+// jitteredInterval randomly spreads interval by up to ±percent so that many
+// controllers sharing the same interval do not poll in lockstep.
+func jitteredInterval(interval time.Duration, percent int) time.Duration {
+	if percent == 0 {
+		return interval
 	}
+	spread := float64(interval) * float64(percent) / 100
+	return interval + time.Duration(spread*(2*rand.Float64()-1))
+}
 
-	if services.Dashboard != "" {
-		slog.Debug("discovered service", "service", "dashboard", "url", services.Dashboard)
-	}
-	if services.Prometheus != "" {
-		slog.Debug("discovered service", "service", "prometheus", "url", services.Prometheus)
-	}
+const shutdownTimeout = 10 * time.Second
 
-	if cfg.dashboardSlice == "" && cfg.prometheusSlice == "" {
-		return nil
+// shutdown optionally removes the published objects or tells consumers that
+// they will no longer be kept up to date, then hands shard Leases over to
+// other replicas.
+func shutdown(cfg config, kubes []*kubeClient, state *runState) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if cfg.cleanupOnExit {
+		cleanupOnExit(ctx, cfg, kubes, state)
+	} else if cfg.markTerminating {
+		markTerminating(ctx, cfg, kubes, state)
+	}
+	if cfg.shards > 0 && len(kubes) > 0 {
+		state.shards.releaseAll(ctx, kubes[0], cfg)
 	}
+}
 
-	if cfg.dashboardSlice != "" {
-		if services.Dashboard == "" {
-			return fmt.Errorf("dashboard service URL not found in ceph mgr services")
-		}
-		addr, err := parseServiceURL(services.Dashboard)
-		if err != nil {
-			return fmt.Errorf("failed to parse dashboard URL: %w", err)
-		}
-		if err := updateEndpointSlice(ctx, cfg, clientset, cfg.dashboardSlice, "dashboard", addr); err != nil {
-			return fmt.Errorf("failed to update dashboard EndpointSlice: %w", err)
+func markTerminating(ctx context.Context, cfg config, kubes []*kubeClient, state *runState) {
+	for _, m := range append(slices.Clone(cfg.mappings), state.serviceMappings...) {
+		for _, kube := range state.shards.targets(cfg, m, kubes) {
+			if err := markEndpointSlicesUnready(ctx, kube, m, true); err != nil {
+				slog.Error("failed to mark EndpointSlices terminating", "cluster", kube.name, "namespace", m.namespace, "slice", m.slice, "error", err)
+			}
 		}
 	}
+}
 
-	if cfg.prometheusSlice != "" {
-		if services.Prometheus == "" {
-			return fmt.Errorf("prometheus service URL not found in ceph mgr services")
-		}
-		addr, err := parseServiceURL(services.Prometheus)
-		if err != nil {
-			return fmt.Errorf("failed to parse prometheus URL: %w", err)
-		}
-		if err := updateEndpointSlice(ctx, cfg, clientset, cfg.prometheusSlice, "prometheus", addr); err != nil {
-			return fmt.Errorf("failed to update prometheus EndpointSlice: %w", err)
+func radosConfigAttrs(conn *rados.Conn) []any {
+	var attrs []any
+	for _, key := range []string{"name", "keyring", "mon_host"} {
+		if val, err := conn.GetConfigOption(key); err == nil {
+			attrs = append(attrs, key, val)
 		}
 	}
-
-	return nil
+	return attrs
 }
 
-type monCommand struct {
-	Prefix string `json:"prefix"`
-	Format string `json:"format"`
+// runState carries information from one reconcile run to the next.
+type runState struct {
+	lastHash  string
+	started   time.Time
+	succeeded bool
+	failures  int
+	lastErr   error
+	shards    *shardManager
+	// conditions reports controller health in the status ConfigMap.
+	conditions []metav1.Condition
+	// due holds when each mapping is next reconciled, and globalDue when
+	// mgr configuration and module targets are next applied.
+	due       map[string]time.Time
+	globalDue time.Time
+	// readOnly is set while EndpointSlice writes are forbidden.
+	readOnly bool
+	// published holds the endpoints of the last run, so that mappings that
+	// are not yet due keep their entry in the state file.
+	published map[string][]endpointGroup
+	// serviceMappings holds the mappings derived from Services in the last
+	// run.
+	serviceMappings []mapping
+	// simulated is the fake mgr address of the current failover simulation
+	// turn.
+	simulated net.IP
+	// services and activeMgr hold what the last run discovered, so changes
+	// can be logged.
+	services  mgrServices
+	activeMgr string
+	// publishedMgr holds the active mgr when each mapping was last
+	// published, for the endpoint switch counter.
+	publishedMgr map[string]string
+	// changes counts the objects and Ceph settings the last run changed.
+	changes int
+	// fsid identifies the Ceph cluster the state above was learnt from.
+	fsid string
+	// nextResync is when the next full resync is due.
+	nextResync time.Time
+	// resolver resolves hostnames in mgr service URLs and caches their
+	// addresses across runs.
+	resolver *hostResolver
 }
 
-type mgrServices struct {
-	Dashboard  string `json:"dashboard"`
-	Prometheus string `json:"prometheus"`
+// hostResolver returns the resolver for the resolve settings of cfg. The
+// resolver and its cache are kept for as long as the settings stay the same.
+func (s *runState) hostResolver(cfg config) *hostResolver {
+	if s.resolver == nil || !reflect.DeepEqual(s.resolver.resolveConfig, cfg.resolve) {
+		s.resolver = newHostResolver(cfg.resolve)
+	}
+	return s.resolver
 }
 
-type endpointAddress struct {
-	ip   net.IP
-	port int32
+// isDue reports whether work scheduled every interval and next due at next
+// should run in this tick. Work on the shortest interval runs on every tick,
+// and other work runs when it falls due within half a tick.
+func isDue(cfg config, next time.Time, interval time.Duration, now time.Time) bool {
+	tick := cfg.tickInterval()
+	return interval <= tick || !now.Add(tick/2).Before(next)
 }
 
-var mgrServicesCommand = monCommand{Prefix: "mgr services", Format: "json"}
+// startupFailed reports whether the fail-fast policy gives up on a
+// controller that has not completed a reconcile since it started.
+func (s *runState) startupFailed(p failFastPolicy) bool {
+	if s.succeeded || s.failures == 0 {
+		return false
+	}
+	if p.attempts > 0 && s.failures >= p.attempts {
+		return true
+	}
+	return p.window > 0 && time.Since(s.started) >= p.window
+}
 
-func getMgrServices(conn *rados.Conn) (*mgrServices, error) {
-	cmd, err := json.Marshal(mgrServicesCommand)
+// runWithTimeout calls run with a context bounded by cfg.runTimeout.
+func runWithTimeout(ctx context.Context, cfg config, conn discoverer, kubes []*kubeClient, state *runState) error {
+	if timeout := cfg.runTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := syncShards(ctx, cfg, kubes, state)
+	if err == nil {
+		before := changeCount.Load()
+		err = run(ctx, cfg, conn, kubes, state)
+		state.changes = int(changeCount.Load() - before)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("marshal command: %w", err)
+		state.failures++
+		state.lastErr = err
+	} else {
+		state.succeeded = true
+		renewHeartbeat(ctx, cfg, kubes, state)
 	}
+	state.updateDegraded(err)
+	return err
+}
 
-	buf, info, err := conn.MonCommand(cmd)
+// syncShards refreshes the shard Leases held by this replica. Without a
+// successful sync the replica owns no shards.
+func syncShards(ctx context.Context, cfg config, kubes []*kubeClient, state *runState) error {
+	if cfg.shards == 0 || len(kubes) == 0 {
+		return nil
+	}
+	changed, err := state.shards.sync(ctx, kubes[0], cfg)
 	if err != nil {
-		return nil, fmt.Errorf("mon command: %w", err)
+		state.shards.owned = nil
+		return withCategory(errKubernetes, fmt.Errorf("failed to sync shard Leases: %w", err))
 	}
-	if info != "" {
-		slog.Debug("mon command info", "info", info)
+	if changed {
+		state.lastHash = ""
 	}
+	return nil
+}
 
-	var services mgrServices
-	if err := json.Unmarshal(buf, &services); err != nil {
-		return nil, fmt.Errorf("unmarshal response: %w", err)
+func run(ctx context.Context, cfg config, conn discoverer, kubes []*kubeClient, state *runState) error {
+	checkFSID(cfg, conn, kubes, state)
+	if cfg.metricsEnabled() {
+		updateClusterInfo(conn, state.fsid)
 	}
+	now := time.Now()
+	if fullResyncDue(cfg, state, now) {
+		defer startFullResync(kubes, state)()
+	}
+	global := state.shards.ownsGlobal(cfg) && isDue(cfg, state.globalDue, cfg.interval, now)
 
-	return &services, nil
-}
-
-func parseServiceURL(rawURL string) (*endpointAddress, error) {
-	u, err := url.Parse(rawURL)
-	if err != nil {
-		return nil, fmt.Errorf("parse URL: %w", err)
+	if cfg.manageModules && global {
+		if err := cfg.cephRetry.do(ctx, func() error { return enableMgrModules(conn, cfg.mappings) }); err != nil {
+			return withCategory(errCephUnreachable, fmt.Errorf("failed to enable mgr modules: %w", err))
+		}
 	}
 
-	host := u.Hostname()
-	portStr := u.Port()
+	if global {
+		if err := cfg.cephRetry.do(ctx, func() error { return applyMgrOptions(conn, cfg.mgrBind) }); err != nil {
+			return withCategory(errCephUnreachable, fmt.Errorf("failed to configure mgr: %w", err))
+		}
+	}
 
-	if portStr == "" {
-		switch u.Scheme {
-		case "https":
-			portStr = "443"
-		case "http":
-			portStr = "80"
-		default:
-			return nil, fmt.Errorf("no port specified and unknown scheme: %s", u.Scheme)
+	if cfg.moduleTargets != "" && global {
+		var targets map[string]string
+		if err := cfg.cephRetry.do(ctx, func() (err error) {
+			targets, err = getModuleTargets(conn)
+			return err
+		}); err != nil {
+			return withCategory(errCephUnreachable, fmt.Errorf("failed to get module targets: %w", err))
+		}
+		for _, kube := range kubes {
+			if err := cfg.kubeRetry.do(ctx, func() error {
+				return updateModuleTargets(ctx, kube, cfg.namespace, cfg.moduleTargets, targets)
+			}); err != nil {
+				return withCategory(errKubernetes, fmt.Errorf("failed to update module targets in %s: %w", kube.name, err))
+			}
 		}
 	}
+	if global {
+		state.globalDue = now.Add(cfg.interval)
+	}
 
-	port, err := strconv.Atoi(portStr)
+	serviceMappings, err := discoverServiceMappings(ctx, cfg, kubes)
 	if err != nil {
-		return nil, fmt.Errorf("invalid port: %w", err)
+		return withCategory(errKubernetes, fmt.Errorf("failed to discover Services: %w", err))
 	}
-	if port < 1 || port > 65535 {
-		return nil, fmt.Errorf("port out of range: %d", port)
+	resourceMappings, resources, rejected, err := discoverResourceMappings(ctx, cfg, kubes)
+	if err != nil {
+		return withCategory(errKubernetes, fmt.Errorf("failed to discover CephMgrEndpoints: %w", err))
 	}
-
-	ip := net.ParseIP(host)
-	if ip == nil {
-		return nil, fmt.Errorf("expected IP address, got hostname: %s", host)
+	for _, r := range rejected {
+		setResourceStatus(ctx, r.kube, r.res, metav1.ConditionFalse, "InvalidSpec", strings.Join(r.problems, "; "), nil, "")
 	}
+	serviceMappings = append(serviceMappings, resourceMappings...)
+	state.serviceMappings = serviceMappings
+	mappings := append(slices.Clone(cfg.mappings), serviceMappings...)
 
-	return &endpointAddress{
-		ip:   ip,
-		port: int32(port),
-	}, nil
-}
+	var mgr *mgrMap
+	if cfg.verifyActiveMgr || cfg.skipUnchanged || cfg.dualStack || cfg.metricsEnabled() || len(resourceMappings) > 0 {
+		if err := cfg.cephRetry.do(ctx, func() (err error) {
+			mgr, err = getMgrMap(conn)
+			return err
+		}); err != nil {
+			state.setCondition(conditionCephReachable, metav1.ConditionFalse, "CommandFailed", err.Error())
+			return withCategory(errCephUnreachable, fmt.Errorf("failed to get mgr map: %w", err))
+		}
+	}
 
-func getKubeClient() (*kubernetes.Clientset, error) {
-	config, err := rest.InClusterConfig()
+	var services mgrServices
+	var servicesJSON []byte
+	err = cfg.cephRetry.do(ctx, func() (err error) {
+		services, servicesJSON, err = getMgrServicesJSON(conn)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("in-cluster config: %w", err)
+		state.setCondition(conditionCephReachable, metav1.ConditionFalse, "CommandFailed", err.Error())
+		return withCategory(errCephUnreachable, fmt.Errorf("failed to get mgr services: %w", err))
 	}
+	state.setCondition(conditionCephReachable, metav1.ConditionTrue, "Connected", "")
 
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("create clientset: %w", err)
+	if cfg.verifyActiveMgr {
+		reason, err := verifyActiveMgr(conn, mgr, services)
+		if err != nil {
+			return withCategory(errCephUnreachable, fmt.Errorf("failed to verify active mgr: %w", err))
+		}
+		if reason != "" {
+			err := withCategory(errInconsistentMgr, fmt.Errorf("holding EndpointSlice updates: %s", reason))
+			state.setCondition(conditionServiceDiscovered, metav1.ConditionFalse, "InconsistentMgr", reason)
+			for _, m := range mappings {
+				countReconcile(m, err)
+				for _, kube := range state.shards.targets(cfg, m, kubes) {
+					kube.recorder.Eventf(endpointSliceRef(m), corev1.EventTypeWarning, "InconsistentMgr", "Holding EndpointSlice update: %s", reason)
+				}
+			}
+			return err
+		}
 	}
 
-	return clientset, nil
-}
+	resolver := state.hostResolver(cfg)
+	if resolver != nil && resolver.refresh(ctx) {
+		state.lastHash = ""
+	}
+	if ip := cfg.simulation.address(now); !ip.Equal(state.simulated) {
+		if ip != nil {
+			slog.Warn("simulating mgr failover", "address", ip)
+		}
+		state.simulated = ip
+		state.lastHash = ""
+	}
 
-func updateEndpointSlice(ctx context.Context, cfg config, clientset *kubernetes.Clientset, sliceName, portName string, addr *endpointAddress) error {
-	sliceClient := clientset.DiscoveryV1().EndpointSlices(cfg.namespace)
+	var hash string
+	if cfg.skipUnchanged {
+		hash = servicesHash(servicesJSON, mgr.Epoch, mappings)
+		if hash == state.lastHash {
+			slog.Debug("ceph mgr data unchanged, skipping reconcile", "epoch", mgr.Epoch)
+			return nil
+		}
+	}
+	for _, kube := range kubes {
+		kube.servicesHash = hash
+	}
 
-	existing, err := sliceClient.Get(ctx, sliceName, metav1.GetOptions{})
-	if err != nil && !errors.IsNotFound(err) {
-		return fmt.Errorf("get EndpointSlice: %w", err)
+	if cfg.configFallback {
+		if err := fillServicesFromConfig(conn, services, cfg.mappings, cfg.preferredNets); err != nil {
+			slog.Warn("failed to derive mgr services from config", "error", err)
+		}
 	}
-	if err == nil && endpointSliceMatches(cfg, existing, portName, addr) {
-		slog.Debug("EndpointSlice already up-to-date", "namespace", cfg.namespace, "name", sliceName)
-		return nil
+
+	if state.simulated != nil {
+		services, err = simulateServices(services, state.simulated)
+		if err != nil {
+			return withCategory(errInvalidConfig, fmt.Errorf("failed to simulate failover: %w", err))
+		}
 	}
 
-	addressType := discoveryv1.AddressTypeIPv4
-	if addr.ip.To4() == nil {
-		addressType = discoveryv1.AddressTypeIPv6
-	}
-
-	slice := discoveryv1apply.EndpointSlice(sliceName, cfg.namespace).
-		WithLabels(map[string]string{
-			"kubernetes.io/service-name": cfg.serviceName,
-		}).
-		WithAddressType(addressType).
-		WithEndpoints(
-			discoveryv1apply.Endpoint().
-				WithAddresses(addr.ip.String()),
-		).
-		WithPorts(
-			discoveryv1apply.EndpointPort().
-				WithName(portName).
-				WithPort(addr.port).
-				WithProtocol(corev1.ProtocolTCP),
-		)
-
-	if svc, err := clientset.CoreV1().Services(cfg.namespace).Get(ctx, cfg.serviceName, metav1.GetOptions{}); err != nil {
-		slog.Warn("failed to get service for owner reference", "namespace", cfg.namespace, "service", cfg.serviceName, "error", err)
+	for _, module := range slices.Sorted(maps.Keys(services)) {
+		slog.Debug("discovered service", "service", module, "url", services[module])
+	}
+	logServiceChanges(state.services, services)
+	state.services = services
+	if mgr != nil && mgr.ActiveName != state.activeMgr {
+		slog.Info("active mgr changed", "from", state.activeMgr, "to", mgr.ActiveName, "epoch", mgr.Epoch)
+		state.activeMgr = mgr.ActiveName
+	}
+
+	if cfg.serviceURLs != "" && global {
+		for _, kube := range kubes {
+			if err := cfg.kubeRetry.do(ctx, func() error {
+				return updateServiceURLs(ctx, kube, cfg.namespace, cfg.serviceURLs, services)
+			}); err != nil {
+				return withCategory(errKubernetes, fmt.Errorf("failed to update service URLs in %s: %w", kube.name, err))
+			}
+		}
+	}
+
+	addrs := make(map[string][]*endpointAddress)
+	discovered := make(map[string][]endpointGroup)
+	due := make(map[string]time.Time)
+	waiting := false
+	forbidden := 0
+	var refused []string
+	nodes := make(map[string]map[string]*corev1.Node)
+	certs := make(map[string]*x509.Certificate)
+	var restfulKey string
+	var dashboardPorts map[string]int32
+	var failed mappingErrors
+	var undiscovered, unpublished []string
+	undiscoveredReason := ""
+	// report records the outcome for mappings derived from a CephMgrEndpoint.
+	report := func(kube *kubeClient, m mapping, ready metav1.ConditionStatus, reason, message string, groups []endpointGroup) {
+		if res := resources[resourceKey(kube.name, m.namespace, m.resource)]; m.resource != "" && res != nil {
+			setResourceStatus(ctx, kube, res, ready, reason, message, groups, mgr.ActiveName)
+		}
+	}
+	// fail records a failed mapping and keeps what was last published for
+	// it. Without a due time, it is retried on the next tick.
+	fail := func(m mapping, err error) {
+		slog.Error("failed to reconcile mapping", "namespace", m.namespace, "slice", m.slice, "reason", errorReason(err), "error", err)
+		failed = append(failed, fmt.Errorf("%s/%s: %w", m.namespace, m.slice, err))
+		countReconcile(m, err)
+		if groups, ok := state.published[stateKey(m)]; ok {
+			discovered[stateKey(m)] = groups
+		}
+	}
+	// notDiscovered records why the ServiceDiscovered condition is False.
+	notDiscovered := func(m mapping, reason, message string) {
+		if undiscoveredReason == "" {
+			undiscoveredReason = reason
+		}
+		undiscovered = append(undiscovered, fmt.Sprintf("%s/%s: %s", m.namespace, m.slice, message))
+	}
+	for _, m := range mappings {
+		targets := state.shards.targets(cfg, m, kubes)
+		if len(targets) == 0 {
+			continue
+		}
+		ctx := withMappingLog(ctx, m, state.fsid)
+		if m.disabled {
+			for _, kube := range targets {
+				if err := cfg.kubeRetry.do(ctx, func() error { return applyDisablePolicy(ctx, kube, m) }); err != nil {
+					fail(m, withCategory(errKubernetes, fmt.Errorf("failed to apply %s policy to disabled mapping in %s: %w", m.onDisable, kube.name, err)))
+				}
+			}
+			continue
+		}
+		if next, ok := state.due[m.key()]; ok && !isDue(cfg, next, cfg.mappingInterval(m), now) {
+			due[m.key()] = next
+			if groups, ok := state.published[stateKey(m)]; ok {
+				discovered[stateKey(m)] = groups
+			}
+			waiting = true
+			continue
+		}
+		if plan, ok := planService(m, services); !ok {
+			if plan.err != nil {
+				notDiscovered(m, plan.reason, plan.message)
+				fail(m, plan.err)
+				continue
+			}
+			slog.DebugContext(ctx, "no mgr service for Service port, skipping", "namespace", m.namespace, "service", m.serviceName, "port", m.module)
+			for _, kube := range targets {
+				report(kube, m, metav1.ConditionFalse, plan.reason, plan.message, nil)
+			}
+			continue
+		}
+		discoverStart := time.Now()
+		groups, err := discoverGroups(ctx, cfg, conn, resolver, m, services, mgr, addrs)
+		observeDiscovery(m, time.Since(discoverStart))
+		if err != nil {
+			fail(m, err)
+			continue
+		}
+		if m.module == "dashboard" && cfg.dashboardPorts && dashboardPorts == nil {
+			if err := cfg.cephRetry.do(ctx, func() (err error) {
+				dashboardPorts, err = getDashboardPorts(conn)
+				return err
+			}); err != nil {
+				fail(m, withCategory(errCephUnreachable, fmt.Errorf("failed to get dashboard ports: %w", err)))
+				continue
+			}
+		}
+		plan := planMapping(cfg, m, groups, dashboardPorts)
+		if plan.refused != nil {
+			slog.WarnContext(ctx, "refusing to publish address outside allowed CIDRs", "namespace", m.namespace, "slice", m.slice, "ip", plan.refused)
+			for _, kube := range targets {
+				kube.recorder.Eventf(endpointSliceRef(m), corev1.EventTypeWarning, plan.reason, "Refusing to publish %s, which is outside allowedCIDRs", plan.refused)
+				report(kube, m, metav1.ConditionFalse, plan.reason, plan.message, nil)
+			}
+			if published, ok := state.published[stateKey(m)]; ok {
+				discovered[stateKey(m)] = published
+			}
+			refused = append(refused, plan.message)
+			continue
+		}
+		if plan.err != nil {
+			for _, kube := range targets {
+				report(kube, m, metav1.ConditionFalse, plan.reason, plan.message, nil)
+			}
+			notDiscovered(m, plan.reason, plan.message)
+			fail(m, plan.err)
+			continue
+		}
+		groups = plan.groups
+		addr := groups[0].addrs[0]
+		if m.module == "restful" && cfg.restfulSecret != "" && restfulKey == "" {
+			if err := cfg.cephRetry.do(ctx, func() (err error) {
+				restfulKey, err = getRestfulKey(conn, cfg.restfulUser)
+				return err
+			}); err != nil {
+				fail(m, withCategory(errCephUnreachable, fmt.Errorf("failed to get restful API key: %w", err)))
+				continue
+			}
+		}
+		before := len(failed)
+		applyStart := time.Now()
+		for _, kube := range targets {
+			if m.module == "restful" && cfg.restfulSecret != "" {
+				data := map[string][]byte{
+					"username": []byte(cfg.restfulUser),
+					"key":      []byte(restfulKey),
+					"url":      []byte(addr.url),
+				}
+				if err := cfg.kubeRetry.do(ctx, func() error {
+					return updateRestfulSecret(ctx, kube, m.namespace, cfg.restfulSecret, data)
+				}); err != nil {
+					fail(m, withCategory(errKubernetes, fmt.Errorf("failed to update restful Secret %s in %s: %w", cfg.restfulSecret, kube.name, err)))
+					continue
+				}
+			}
+			published, err := withNodeAddresses(ctx, cfg, kube, m, groups, nodes)
+			if err != nil {
+				fail(m, withCategory(errKubernetes, fmt.Errorf("failed to map Node addresses in %s: %w", kube.name, err)))
+				continue
+			}
+			if err := publishEndpointSlices(ctx, cfg, kube, m, published); errors.IsForbidden(err) {
+				// Slices that already match are never written, so a
+				// forbidden write means the slice has drifted.
+				slog.WarnContext(ctx, "EndpointSlice out of date but writes are forbidden", "cluster", kube.name, "namespace", m.namespace, "slice", m.slice, "error", err)
+				report(kube, m, metav1.ConditionFalse, "Forbidden", err.Error(), nil)
+				forbidden++
+				continue
+			} else if err != nil {
+				report(kube, m, metav1.ConditionFalse, "PublishFailed", err.Error(), nil)
+				unpublished = append(unpublished, fmt.Sprintf("%s/%s in %s: %s", m.namespace, m.slice, kube.name, err))
+				fail(m, withCategory(errKubernetes, fmt.Errorf("%s: %w", kube.name, err)))
+				continue
+			}
+			report(kube, m, metav1.ConditionTrue, "Published", "", published)
+			if cfg.serviceExport {
+				if err := cfg.kubeRetry.do(ctx, func() error { return ensureServiceExport(ctx, kube, m) }); err != nil {
+					slog.WarnContext(ctx, "failed to export Service", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "error", err)
+				}
+			}
+			if cfg.ciliumGlobal {
+				if err := cfg.kubeRetry.do(ctx, func() error { return annotateCiliumGlobal(ctx, kube, m) }); err != nil {
+					slog.WarnContext(ctx, "failed to annotate Cilium global service", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "error", err)
+				}
+			}
+			if cfg.linkerdExport != "" {
+				if err := cfg.kubeRetry.do(ctx, func() error { return labelLinkerdExport(ctx, kube, m, cfg.linkerdExport) }); err != nil {
+					slog.WarnContext(ctx, "failed to label Service for Linkerd mirroring", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "error", err)
+				}
+			}
+			if cfg.route.termination != "" && m.module == "dashboard" {
+				if err := cfg.kubeRetry.do(ctx, func() error { return applyRoute(ctx, kube, cfg.route, m) }); err != nil {
+					slog.WarnContext(ctx, "failed to apply Route", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "error", err)
+				}
+			}
+			if cfg.traefik.host != "" && m.module == "dashboard" {
+				if err := cfg.kubeRetry.do(ctx, func() error { return applyTraefikRoute(ctx, kube, cfg.traefik, m, addr) }); err != nil {
+					slog.WarnContext(ctx, "failed to apply Traefik route", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "error", err)
+				}
+			}
+			if cfg.scrapeConfig.jobName != "" && m.module == "prometheus" {
+				if err := cfg.kubeRetry.do(ctx, func() error { return updateScrapeConfig(ctx, kube, cfg.scrapeConfig, m, addr) }); err != nil {
+					slog.WarnContext(ctx, "failed to update scrape config", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "error", err)
+				}
+			}
+			if cfg.vmScrape.enabled && m.module == "prometheus" {
+				if err := cfg.kubeRetry.do(ctx, func() error { return applyVMServiceScrape(ctx, kube, cfg.vmScrape, m, addr) }); err != nil {
+					slog.WarnContext(ctx, "failed to apply VMServiceScrape", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "error", err)
+				}
+			}
+			if cfg.grafana.enabled && m.module == "prometheus" {
+				if err := cfg.kubeRetry.do(ctx, func() error { return applyGrafanaDatasource(ctx, kube, cfg.grafana, m, addr) }); err != nil {
+					slog.WarnContext(ctx, "failed to apply GrafanaDatasource", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "error", err)
+				}
+			}
+		}
+		observeApply(m, time.Since(applyStart))
+		if len(failed) > before {
+			continue
+		}
+		countReconcile(m, nil)
+		if cfg.dashboardCert.enabled && m.module == "dashboard" && strings.HasPrefix(addr.url, "https://") {
+			cert, ok := certs[addr.url]
+			if !ok {
+				cert, err = inspectCertificate(ctx, addr)
+				if err != nil {
+					slog.WarnContext(ctx, "failed to inspect dashboard certificate", "url", addr.url, "error", err)
+				}
+				certs[addr.url] = cert
+			}
+			if cert != nil {
+				for _, kube := range targets {
+					if err := reportCertExpiry(ctx, kube, m, cert, cfg.dashboardCert.warnBefore); err != nil {
+						slog.WarnContext(ctx, "failed to report dashboard certificate expiry", "cluster", kube.name, "namespace", m.namespace, "service", m.serviceName, "error", err)
+					}
+				}
+			}
+		}
+		if previous, ok := state.published[stateKey(m)]; ok {
+			countEndpointSwitch(m, previous, groups, state.publishedMgr[stateKey(m)], state.activeMgr)
+		}
+		if state.publishedMgr == nil {
+			state.publishedMgr = make(map[string]string)
+		}
+		state.publishedMgr[stateKey(m)] = state.activeMgr
+		discovered[stateKey(m)] = groups
+		due[m.key()] = now.Add(cfg.mappingInterval(m))
+	}
+	state.due = due
+	state.published = discovered
+	if cfg.metricsEnabled() {
+		updateServicesInfo(ctx, resolver, services, addrs, state.activeMgr)
+	}
+	switch {
+	case len(undiscovered) > 0:
+		state.setCondition(conditionServiceDiscovered, metav1.ConditionFalse, undiscoveredReason, strings.Join(undiscovered, "; "))
+	case len(refused) > 0:
+		state.setCondition(conditionServiceDiscovered, metav1.ConditionFalse, "AddressNotAllowed", strings.Join(refused, "; "))
+	default:
+		state.setCondition(conditionServiceDiscovered, metav1.ConditionTrue, "Discovered", fmt.Sprintf("%d mappings", len(discovered)))
+	}
+	if forbidden > 0 {
+		if !state.readOnly {
+			slog.Error("EndpointSlice writes are forbidden, continuing in read-only mode", "drifted", forbidden)
+		}
+		state.readOnly = true
+		state.setCondition(conditionEndpointPublished, metav1.ConditionFalse, "Forbidden", fmt.Sprintf("%d EndpointSlices out of date, writes are forbidden", forbidden))
 	} else {
-		slice = slice.WithOwnerReferences(
-			applyconfigmetav1.OwnerReference().
-				WithAPIVersion("v1").
-				WithKind("Service").
-				WithName(svc.Name).
-				WithUID(svc.UID),
-		)
+		if state.readOnly {
+			slog.Info("EndpointSlice writes permitted again, leaving read-only mode")
+		}
+		state.readOnly = false
+		if len(unpublished) > 0 {
+			state.setCondition(conditionEndpointPublished, metav1.ConditionFalse, "PublishFailed", strings.Join(unpublished, "; "))
+		} else {
+			state.setCondition(conditionEndpointPublished, metav1.ConditionTrue, "Published", "")
+		}
 	}
 
-	_, err = sliceClient.Apply(ctx, slice, metav1.ApplyOptions{FieldManager: "ceph-mgr-endpoint-controller"})
-	if err != nil {
-		return fmt.Errorf("apply EndpointSlice: %w", err)
+	if cfg.stateFile != "" {
+		if err := writeStateFile(cfg.stateFile, state.fsid, discovered); err != nil {
+			slog.Warn("failed to write state file", "path", cfg.stateFile, "error", err)
+		}
 	}
 
-	slog.Info("applied EndpointSlice", "namespace", cfg.namespace, "name", sliceName, "ip", addr.ip, "port", addr.port)
+	// Mappings that were not due have not seen the data behind hash, and
+	// forbidden writes and failed mappings must be tried again on the next
+	// tick.
+	if waiting || forbidden > 0 || len(failed) > 0 {
+		hash = ""
+	}
+	state.lastHash = hash
+	if len(failed) > 0 {
+		return failed
+	}
 	return nil
 }
 
-func endpointSliceMatches(cfg config, slice *discoveryv1.EndpointSlice, portName string, addr *endpointAddress) bool {
-	if slice.Labels["kubernetes.io/service-name"] != cfg.serviceName {
-		return false
+// logServiceChanges logs every mgr service that was added, removed or whose
+// URL changed since the previous run.
+func logServiceChanges(previous, current mgrServices) {
+	for _, module := range slices.Sorted(maps.Keys(current)) {
+		if from, ok := previous[module]; !ok {
+			slog.Info("mgr service added", "service", module, "url", current[module])
+		} else if from != current[module] {
+			slog.Info("mgr service changed", "service", module, "from", from, "to", current[module])
+		}
+	}
+	for _, module := range slices.Sorted(maps.Keys(previous)) {
+		if _, ok := current[module]; !ok {
+			slog.Info("mgr service removed", "service", module, "url", previous[module])
+		}
 	}
+}
 
-	expectedType := discoveryv1.AddressTypeIPv4
-	if addr.ip.To4() == nil {
-		expectedType = discoveryv1.AddressTypeIPv6
+// discoverGroups returns the addresses of m grouped into EndpointSlices.
+// Addresses parsed from mgr service URLs are cached in addrs, so mappings of
+// the same module share them.
+func discoverGroups(ctx context.Context, cfg config, conn discoverer, resolver *hostResolver, m mapping, services mgrServices, mgr *mgrMap, addrs map[string][]*endpointAddress) ([]endpointGroup, error) {
+	if !m.fromMgrServices() {
+		var instances []*endpointAddress
+		if err := cfg.cephRetry.do(ctx, func() (err error) {
+			instances, err = getOrchDaemonAddresses(conn, m.daemonType)
+			return err
+		}); err != nil {
+			return nil, fmt.Errorf("failed to get %s daemons: %w", m.daemonType, err)
+		}
+		return groupEndpointAddresses(m.slice, instances), nil
 	}
-	if slice.AddressType != expectedType {
-		return false
+	active, ok := addrs[m.module]
+	if !ok {
+		var err error
+		active, err = parseServiceURL(ctx, services[m.module], resolver)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s URL: %w", m.module, err)
+		}
+		if cfg.dualStack {
+			active, err = mgr.dualStackAddresses(active, cfg.preferredNets)
+			if err != nil {
+				return nil, fmt.Errorf("failed to add dual-stack %s addresses: %w", m.module, err)
+			}
+		}
+		addrs[m.module] = active
+	}
+	if !m.allMgrs {
+		return groupEndpointAddresses(m.slice, active), nil
+	}
+	var instances []*endpointAddress
+	if err := cfg.cephRetry.do(ctx, func() (err error) {
+		instances, err = getMgrInstanceAddresses(conn, m.module, active)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("failed to get %s mgr instances: %w", m.module, err)
 	}
+	return groupEndpointAddresses(m.slice, instances), nil
+}
 
-	if len(slice.Endpoints) != 1 || len(slice.Endpoints[0].Addresses) != 1 {
-		return false
+// publishEndpointSlices applies one EndpointSlice per group and removes the
+// mapping's slices that no longer have a group.
+func publishEndpointSlices(ctx context.Context, cfg config, kube *kubeClient, m mapping, groups []endpointGroup) error {
+	for _, group := range groups {
+		if err := cfg.kubeRetry.do(ctx, func() error {
+			return updateEndpointSlice(ctx, cfg, kube, m, group.name, group.addrs)
+		}); err != nil {
+			return fmt.Errorf("failed to update %s EndpointSlice %s/%s in %s: %w", m.module, m.namespace, group.name, kube.name, err)
+		}
 	}
-	if slice.Endpoints[0].Addresses[0] != addr.ip.String() {
-		return false
+	if m.allMgrs || !m.fromMgrServices() {
+		if err := cfg.kubeRetry.do(ctx, func() error {
+			return deleteStaleEndpointSlices(ctx, kube, m, groups)
+		}); err != nil {
+			return fmt.Errorf("failed to delete stale %s EndpointSlices in %s: %w", m.module, kube.name, err)
+		}
 	}
-	if len(slice.Ports) != 1 {
-		return false
+	return nil
+}
+
+// applyDisablePolicy leaves the slices of a disabled mapping alone, marks
+// their endpoints not ready, or deletes them.
+func applyDisablePolicy(ctx context.Context, kube *kubeClient, m mapping) error {
+	switch m.onDisable {
+	case "not-ready":
+		return markEndpointSlicesUnready(ctx, kube, m, false)
+	case "delete":
+		return deleteStaleEndpointSlices(ctx, kube, m, nil)
 	}
-	port := slice.Ports[0]
-	if port.Name == nil || *port.Name != portName {
-		return false
+	return nil
+}
+
+// publishLastKnown republishes the addresses recorded in the state file,
+// marked stale, while the Ceph cluster cannot be reached.
+func publishLastKnown(ctx context.Context, cfg config, kubes []*kubeClient, state *runState) {
+	saved, err := readStateFile(cfg.stateFile)
+	if err != nil {
+		slog.Warn("failed to read state file", "path", cfg.stateFile, "error", err)
+		return
 	}
-	if port.Port == nil || *port.Port != addr.port {
-		return false
+	nodes := make(map[string]map[string]*corev1.Node)
+	for _, m := range cfg.mappings {
+		groups := saved[stateKey(m)]
+		if m.disabled || len(groups) == 0 {
+			continue
+		}
+		for _, kube := range state.shards.targets(cfg, m, kubes) {
+			published, err := withNodeAddresses(ctx, cfg, kube, m, groups, nodes)
+			if err != nil {
+				slog.Error("failed to map Node addresses", "cluster", kube.name, "error", err)
+				continue
+			}
+			if err := publishEndpointSlices(ctx, cfg, kube, m, published); err != nil {
+				slog.Error("failed to publish last-known endpoints", "error", err)
+			}
+		}
 	}
-	if port.Protocol == nil || *port.Protocol != corev1.ProtocolTCP {
-		return false
+}
+
+// servicesHash fingerprints the inputs of a reconcile: the raw mgr services
+// response, the mgr map epoch and the mappings. Configuration changes are
+// covered by clearing the last hash on reload rather than hashing the
+// configuration, which holds credentials.
+func servicesHash(servicesJSON []byte, epoch int, mappings []mapping) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\n", epoch)
+	h.Write(servicesJSON)
+	for _, m := range mappings {
+		fmt.Fprintf(h, "\n%q %q %q %q %t %q %q %t %q %s %t %q %d",
+			m.module, m.namespace, m.serviceName, m.slice, m.allMgrs, m.daemonType, m.cluster,
+			m.discovered, m.resource, m.interval, m.disabled, m.onDisable, m.port)
 	}
-	return true
+	return hex.EncodeToString(h.Sum(nil))
 }
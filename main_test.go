@@ -0,0 +1,382 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+// cephFixture is the fixture of a stubConn, which tests edit to simulate
+// changes in the Ceph cluster.
+type cephFixture struct {
+	stubConn
+	t         *testing.T
+	responses map[string]any
+}
+
+func newCephFixture(t *testing.T) *cephFixture {
+	f := &cephFixture{
+		stubConn: stubConn{path: filepath.Join(t.TempDir(), "ceph.json")},
+		t:        t,
+		responses: map[string]any{
+			"fsid":       map[string]string{"fsid": "c1a5d9e2-0000-4000-8000-000000000001"},
+			"config get": map[string]map[string]string{"mgr": {}},
+		},
+	}
+	f.failover(10, "a", "10.0.0.1")
+	f.setRGW(rgwDaemon{"a", "10.0.1.1", 8080})
+	return f
+}
+
+// set makes response the answer to commands with prefix.
+func (f *cephFixture) set(prefix string, response any) {
+	f.t.Helper()
+	f.responses[prefix] = response
+	data, err := json.Marshal(f.responses)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.WriteFile(f.path, data, 0o600); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// failover makes name the active mgr, serving the dashboard from ip.
+func (f *cephFixture) failover(epoch int, name, ip string) {
+	services := map[string]string{"dashboard": "https://" + ip + ":8443/"}
+	f.set("mgr services", services)
+	f.set("mgr dump", map[string]any{
+		"epoch":       epoch,
+		"active_name": name,
+		"active_addr": ip + ":6800/0",
+		"available":   true,
+		"services":    services,
+	})
+}
+
+// rgwDaemon is a running rgw daemon listed by `orch ps`.
+type rgwDaemon struct {
+	name string
+	ip   string
+	port int
+}
+
+// setRGW makes daemons the running rgw daemons.
+func (f *cephFixture) setRGW(daemons ...rgwDaemon) {
+	ps := []orchDaemon{}
+	for _, d := range daemons {
+		ps = append(ps, orchDaemon{DaemonType: "rgw", DaemonName: "rgw." + d.name, Hostname: d.name, IP: d.ip, Ports: []int{d.port}, Status: 1})
+	}
+	f.set("orch ps", ps)
+}
+
+// testMappings publishes the active dashboard and every running rgw into
+// namespace.
+func testMappings(namespace string) []mapping {
+	return []mapping{
+		{module: "dashboard", namespace: namespace, serviceName: "ceph-dashboard", slice: "ceph-dashboard"},
+		{module: "rgw", namespace: namespace, serviceName: "ceph-rgw", slice: "ceph-rgw", daemonType: "rgw"},
+	}
+}
+
+// newTestCluster returns a publisher whose namespace holds services.
+type newTestCluster func(t *testing.T, namespace string, services []*corev1.Service) publisher
+
+// fakeCluster publishes into the client-go fake clientset.
+func fakeCluster(t *testing.T, namespace string, services []*corev1.Service) publisher {
+	var objects []runtime.Object
+	for _, svc := range services {
+		svc.UID = types.UID("uid-" + svc.Name)
+		objects = append(objects, svc)
+	}
+	return fake.NewClientset(objects...)
+}
+
+var testNamespaces atomic.Int32
+
+type runFixture struct {
+	cfg       config
+	ceph      *cephFixture
+	namespace string
+	clientset publisher
+	kubes     []*kubeClient
+	state     *runState
+}
+
+// newRunFixture returns a controller publishing testMappings into a cluster
+// that holds their Services, discovering them from a stubbed Ceph cluster.
+func newRunFixture(t *testing.T, newCluster newTestCluster) *runFixture {
+	t.Helper()
+	namespace := fmt.Sprintf("ceph-%d", testNamespaces.Add(1))
+	mappings := testMappings(namespace)
+	var services []*corev1.Service
+	for _, m := range mappings {
+		services = append(services, &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: m.serviceName, Namespace: namespace},
+			Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Name: m.module, Port: 443, Protocol: corev1.ProtocolTCP}}},
+		})
+	}
+	clientset := newCluster(t, namespace, services)
+	return &runFixture{
+		cfg: config{
+			mappings:        mappings,
+			interval:        time.Minute,
+			verifyActiveMgr: true,
+			cephRetry:       defaultRetryPolicy,
+			kubeRetry:       defaultRetryPolicy,
+			namespace:       namespace,
+			clusters:        []cluster{{name: "default"}},
+		},
+		ceph:      newCephFixture(t),
+		namespace: namespace,
+		clientset: clientset,
+		kubes:     []*kubeClient{{name: "default", clientset: clientset, recorder: &record.FakeRecorder{}}},
+		state:     &runState{started: time.Now(), shards: &shardManager{}},
+	}
+}
+
+func (f *runFixture) run(t *testing.T) {
+	t.Helper()
+	if err := run(context.Background(), f.cfg, &f.ceph.stubConn, f.kubes, f.state); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+}
+
+// slice returns an EndpointSlice, or nil when it does not exist.
+func (f *runFixture) slice(t *testing.T, name string) *discoveryv1.EndpointSlice {
+	t.Helper()
+	slice, err := f.clientset.DiscoveryV1().EndpointSlices(f.namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("get EndpointSlice %s: %v", name, err)
+	}
+	return slice
+}
+
+// addresses returns the endpoint addresses of an EndpointSlice, or nil when
+// it does not exist.
+func (f *runFixture) addresses(t *testing.T, name string) []string {
+	t.Helper()
+	slice := f.slice(t, name)
+	if slice == nil {
+		return nil
+	}
+	var addrs []string
+	for _, endpoint := range slice.Endpoints {
+		addrs = append(addrs, endpoint.Addresses...)
+	}
+	slices.Sort(addrs)
+	return addrs
+}
+
+// objects returns the EndpointSlices and Services of the namespace.
+func (f *runFixture) objects(t *testing.T) []runtime.Object {
+	t.Helper()
+	ctx := context.Background()
+	endpointSlices, err := f.clientset.DiscoveryV1().EndpointSlices(f.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	services, err := f.clientset.CoreV1().Services(f.namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var objects []runtime.Object
+	for i := range endpointSlices.Items {
+		objects = append(objects, &endpointSlices.Items[i])
+	}
+	for i := range services.Items {
+		objects = append(objects, &services.Items[i])
+	}
+	return objects
+}
+
+// drift points the dashboard slice at another address the way kubectl edit
+// would, and deletes the rgw slice.
+func (f *runFixture) drift(t *testing.T) {
+	t.Helper()
+	ctx := context.Background()
+	client := f.clientset.DiscoveryV1().EndpointSlices(f.namespace)
+	if err := client.Delete(ctx, "ceph-rgw", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	slice := f.slice(t, "ceph-dashboard")
+	slice.Endpoints = []discoveryv1.Endpoint{{Addresses: []string{"10.9.9.9"}}}
+	slice.Annotations[urlAnnotation] = "https://10.9.9.9:8443/"
+	if _, err := client.Update(ctx, slice, metav1.UpdateOptions{FieldManager: "kubectl-edit"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runScenarios exercise run against a cluster, so that they can be shared
+// by the fake clientset and a real API server.
+var runScenarios = []struct {
+	name string
+	test func(t *testing.T, f *runFixture)
+}{
+	{"first apply", testRunFirstApply},
+	{"second pass is a no-op", testRunSecondPassIsNoOp},
+	{"failover", testRunFailover},
+	{"repairs drift", testRunRepairsDrift},
+	{"refuses foreign edits", testRunRefusesForeignEdits},
+	{"deletes stale slices", testRunDeletesStaleSlices},
+}
+
+func TestRun(t *testing.T) {
+	for _, scenario := range runScenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			scenario.test(t, newRunFixture(t, fakeCluster))
+		})
+	}
+}
+
+func testRunFirstApply(t *testing.T, f *runFixture) {
+	f.run(t)
+
+	if got := f.addresses(t, "ceph-dashboard"); !slices.Equal(got, []string{"10.0.0.1"}) {
+		t.Errorf("ceph-dashboard addresses = %v, want [10.0.0.1]", got)
+	}
+	if got := f.addresses(t, "ceph-rgw"); !slices.Equal(got, []string{"10.0.1.1"}) {
+		t.Errorf("ceph-rgw addresses = %v, want [10.0.1.1]", got)
+	}
+	slice := f.slice(t, "ceph-dashboard")
+	if slice.Labels[managedByLabel] != fieldManager || slice.Labels[sliceGroupLabel] != "ceph-dashboard" {
+		t.Errorf("labels = %v", slice.Labels)
+	}
+	if slice.Annotations[urlAnnotation] != "https://10.0.0.1:8443/" {
+		t.Errorf("url annotation = %q", slice.Annotations[urlAnnotation])
+	}
+	if len(slice.Ports) != 1 || *slice.Ports[0].Port != 8443 || *slice.Ports[0].Name != "dashboard" {
+		t.Errorf("ports = %+v", slice.Ports)
+	}
+	svc, err := f.clientset.CoreV1().Services(f.namespace).Get(context.Background(), "ceph-dashboard", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(slice.OwnerReferences) != 1 || slice.OwnerReferences[0].UID != svc.UID {
+		t.Errorf("owner references = %+v, want Service %s", slice.OwnerReferences, svc.UID)
+	}
+}
+
+func testRunSecondPassIsNoOp(t *testing.T, f *runFixture) {
+	f.run(t)
+	before := f.objects(t)
+	f.run(t)
+
+	if after := f.objects(t); !equality.Semantic.DeepEqual(before, after) {
+		t.Errorf("second pass changed objects:\nbefore %v\nafter  %v", before, after)
+	}
+}
+
+func testRunFailover(t *testing.T, f *runFixture) {
+	f.run(t)
+	f.ceph.failover(11, "b", "10.0.0.2")
+	f.run(t)
+
+	if got := f.addresses(t, "ceph-dashboard"); !slices.Equal(got, []string{"10.0.0.2"}) {
+		t.Errorf("ceph-dashboard addresses = %v, want [10.0.0.2]", got)
+	}
+	if url := f.slice(t, "ceph-dashboard").Annotations[urlAnnotation]; url != "https://10.0.0.2:8443/" {
+		t.Errorf("url annotation = %q, want https://10.0.0.2:8443/", url)
+	}
+}
+
+func testRunRepairsDrift(t *testing.T, f *runFixture) {
+	f.cfg.conflictPolicy = "adopt"
+	f.run(t)
+	f.drift(t)
+	f.run(t)
+
+	if got := f.addresses(t, "ceph-dashboard"); !slices.Equal(got, []string{"10.0.0.1"}) {
+		t.Errorf("ceph-dashboard addresses = %v, want [10.0.0.1]", got)
+	}
+	if got := f.addresses(t, "ceph-rgw"); !slices.Equal(got, []string{"10.0.1.1"}) {
+		t.Errorf("ceph-rgw addresses = %v, want [10.0.1.1]", got)
+	}
+}
+
+func testRunRefusesForeignEdits(t *testing.T, f *runFixture) {
+	f.run(t)
+	f.drift(t)
+
+	if err := run(context.Background(), f.cfg, &f.ceph.stubConn, f.kubes, f.state); err == nil {
+		t.Fatal("run succeeded over a foreign edit, want an error")
+	}
+	if got := f.addresses(t, "ceph-dashboard"); !slices.Equal(got, []string{"10.9.9.9"}) {
+		t.Errorf("ceph-dashboard addresses = %v, want the edited [10.9.9.9]", got)
+	}
+}
+
+func testRunDeletesStaleSlices(t *testing.T, f *runFixture) {
+	f.ceph.setRGW(rgwDaemon{"a", "10.0.1.1", 8080}, rgwDaemon{"b", "10.0.1.2", 8081})
+	f.run(t)
+	if got := f.addresses(t, "ceph-rgw-ipv4-8081"); !slices.Equal(got, []string{"10.0.1.2"}) {
+		t.Fatalf("ceph-rgw-ipv4-8081 addresses = %v, want [10.0.1.2]", got)
+	}
+
+	f.ceph.setRGW(rgwDaemon{"a", "10.0.1.1", 8080})
+	f.run(t)
+
+	if got := f.addresses(t, "ceph-rgw-ipv4-8081"); got != nil {
+		t.Errorf("stale ceph-rgw-ipv4-8081 still has addresses %v", got)
+	}
+	if got := f.addresses(t, "ceph-rgw"); !slices.Equal(got, []string{"10.0.1.1"}) {
+		t.Errorf("ceph-rgw addresses = %v, want [10.0.1.1]", got)
+	}
+}
+
+// TestRunAfterRestartIsNoOp runs a controller that starts over existing
+// slices, as after a restart, and expects its first pass to write nothing.
+func TestRunAfterRestartIsNoOp(t *testing.T) {
+	for _, skipUnchanged := range []bool{false, true} {
+		t.Run(fmt.Sprintf("skipUnchanged=%t", skipUnchanged), func(t *testing.T) {
+			f := newRunFixture(t, fakeCluster)
+			f.cfg.skipUnchanged = skipUnchanged
+			f.run(t)
+			published, lastHash := f.state.published, f.state.lastHash
+
+			clientset := f.clientset.(*fake.Clientset)
+			clientset.ClearActions()
+			f.state = &runState{started: time.Now(), shards: &shardManager{}}
+			seedRunState(context.Background(), f.cfg, f.kubes, f.state)
+			if got := slices.Sorted(maps.Keys(f.state.published)); !slices.Equal(got, slices.Sorted(maps.Keys(published))) {
+				t.Errorf("seeded mappings = %v, want %v", got, slices.Sorted(maps.Keys(published)))
+			}
+			for key, groups := range published {
+				if got, want := publishedAddresses(f.state.published[key]), publishedAddresses(groups); !slices.Equal(got, want) {
+					t.Errorf("seeded %s addresses = %v, want %v", key, got, want)
+				}
+			}
+			if f.state.lastHash != lastHash {
+				t.Errorf("seeded fingerprint = %q, want %q", f.state.lastHash, lastHash)
+			}
+			f.run(t)
+
+			for _, action := range clientset.Actions() {
+				switch action.GetVerb() {
+				case "create", "update", "patch", "delete":
+					t.Errorf("first pass after restart: %s %s", action.GetVerb(), action.GetResource().Resource)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ceph/go-ceph/rados"
+)
+
+// mgrServiceInfo is one series of the ceph_mgr_services_info gauge.
+type mgrServiceInfo struct {
+	module string
+	url    string
+	ip     string
+	port   string
+}
+
+// servicesInfo holds the series of ceph_mgr_services_info and the active mgr
+// they were discovered from, as of the last reconcile.
+var servicesInfo struct {
+	mu        sync.Mutex
+	series    []mgrServiceInfo
+	activeMgr string
+}
+
+// clusterInfo holds the identity of the Ceph cluster as of the last
+// reconcile.
+var clusterInfo struct {
+	mu      sync.Mutex
+	fsid    string
+	version string
+}
+
+// updateClusterInfo records the FSID and version of the connected Ceph
+// cluster. A version that cannot be read keeps the last one.
+func updateClusterInfo(conn discoverer, fsid string) {
+	version, err := getCephVersion(conn)
+	if err != nil {
+		slog.Debug("failed to get ceph version", "error", err)
+	}
+	clusterInfo.mu.Lock()
+	defer clusterInfo.mu.Unlock()
+	if fsid != clusterInfo.fsid {
+		clusterInfo.version = ""
+	}
+	clusterInfo.fsid = fsid
+	if version != "" {
+		clusterInfo.version = version
+	}
+}
+
+// updateServicesInfo replaces the ceph_mgr_services_info series with one per
+// address of every mgr service. Modules that no mapping parsed are parsed
+// here; a URL that cannot be parsed keeps empty ip and port labels.
+func updateServicesInfo(ctx context.Context, resolver *hostResolver, services mgrServices, addrs map[string][]*endpointAddress, activeMgr string) {
+	var series []mgrServiceInfo
+	for _, module := range slices.Sorted(maps.Keys(services)) {
+		url := services[module]
+		parsed, ok := addrs[module]
+		if !ok {
+			var err error
+			if parsed, err = parseServiceURL(ctx, url, resolver); err != nil {
+				slog.Debug("failed to parse mgr service URL for metrics", "service", module, "url", url, "error", err)
+			}
+		}
+		if len(parsed) == 0 {
+			series = append(series, mgrServiceInfo{module: module, url: url})
+			continue
+		}
+		for _, addr := range parsed {
+			series = append(series, mgrServiceInfo{module: module, url: url, ip: addr.ip.String(), port: strconv.Itoa(int(addr.port))})
+		}
+	}
+	servicesInfo.mu.Lock()
+	defer servicesInfo.mu.Unlock()
+	servicesInfo.series = series
+	servicesInfo.activeMgr = activeMgr
+}
+
+// durationBuckets are the upper bounds in seconds of the duration histograms.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	seconds := d.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// reconcileResult identifies a series of the reconciles counter.
+type reconcileResult struct {
+	mapping string
+	result  string
+	reason  string
+}
+
+// endpointSwitch identifies a series of the endpoint switch counter.
+type endpointSwitch struct {
+	mapping string
+	fromMgr string
+	toMgr   string
+}
+
+// reconcileMetrics holds the per-mapping durations, outcomes and endpoint
+// switches since the controller started.
+var reconcileMetrics = struct {
+	mu        sync.Mutex
+	discovery map[string]*histogram
+	apply     map[string]*histogram
+	results   map[reconcileResult]uint64
+	switches  map[endpointSwitch]uint64
+}{
+	discovery: make(map[string]*histogram),
+	apply:     make(map[string]*histogram),
+	results:   make(map[reconcileResult]uint64),
+	switches:  make(map[endpointSwitch]uint64),
+}
+
+func metricsMapping(m mapping) string {
+	return m.namespace + "/" + m.slice
+}
+
+// observeDiscovery records how long discovering the addresses of m took.
+func observeDiscovery(m mapping, d time.Duration) {
+	observeMappingDuration(reconcileMetrics.discovery, m, d)
+}
+
+// observeApply records how long publishing m to every target cluster took.
+func observeApply(m mapping, d time.Duration) {
+	observeMappingDuration(reconcileMetrics.apply, m, d)
+}
+
+func observeMappingDuration(histograms map[string]*histogram, m mapping, d time.Duration) {
+	reconcileMetrics.mu.Lock()
+	defer reconcileMetrics.mu.Unlock()
+	h, ok := histograms[metricsMapping(m)]
+	if !ok {
+		h = &histogram{}
+		histograms[metricsMapping(m)] = h
+	}
+	h.observe(d)
+}
+
+// countReconcile counts a successful reconcile of m when err is nil, and a
+// failure of the category of err otherwise.
+func countReconcile(m mapping, err error) {
+	key := reconcileResult{mapping: metricsMapping(m), result: "success"}
+	if err != nil {
+		key.result = "failure"
+		key.reason = errorReason(err)
+		if key.reason == "" {
+			key.reason = "ReconcileFailed"
+		}
+	}
+	reconcileMetrics.mu.Lock()
+	defer reconcileMetrics.mu.Unlock()
+	reconcileMetrics.results[key]++
+}
+
+// publishedAddresses returns the sorted ip:port pairs of groups.
+func publishedAddresses(groups []endpointGroup) []string {
+	var addrs []string
+	for _, group := range groups {
+		for _, addr := range group.addrs {
+			addrs = append(addrs, net.JoinHostPort(addr.ip.String(), strconv.Itoa(int(addr.port))))
+		}
+	}
+	slices.Sort(addrs)
+	return slices.Compact(addrs)
+}
+
+// countEndpointSwitch counts a switch of m's published addresses from
+// previous to groups, if they differ, along with the active mgr before and
+// after.
+func countEndpointSwitch(m mapping, previous, groups []endpointGroup, fromMgr, toMgr string) {
+	if slices.Equal(publishedAddresses(previous), publishedAddresses(groups)) {
+		return
+	}
+	reconcileMetrics.mu.Lock()
+	defer reconcileMetrics.mu.Unlock()
+	reconcileMetrics.switches[endpointSwitch{mapping: metricsMapping(m), fromMgr: fromMgr, toMgr: toMgr}]++
+}
+
+// metricSample is one sample of a metric family. Histograms and summaries
+// have several samples per series, named with the _bucket, _sum and _count
+// suffixes of the Prometheus text format.
+type metricSample struct {
+	name   string
+	labels [][2]string
+	value  float64
+}
+
+// metricFamily is the samples of one metric, which the metrics endpoint
+// renders in the Prometheus text format and the OTLP exporter converts to
+// OTLP metrics.
+type metricFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples []metricSample
+}
+
+// add appends a sample of the family itself, labelled with the name and
+// value pairs of labels.
+func (f *metricFamily) add(value float64, labels ...string) {
+	f.addSample(f.name, value, labels...)
+}
+
+func (f *metricFamily) addSample(name string, value float64, labels ...string) {
+	s := metricSample{name: name, value: value}
+	for i := 0; i+1 < len(labels); i += 2 {
+		s.labels = append(s.labels, [2]string{labels[i], labels[i+1]})
+	}
+	f.samples = append(f.samples, s)
+}
+
+// singleSample returns a family of type typ with one unlabelled sample.
+func singleSample(name, help, typ string, value float64) *metricFamily {
+	f := &metricFamily{name: name, help: help, typ: typ}
+	f.add(value)
+	return f
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeExposition writes families in the Prometheus text format.
+func writeExposition(b *strings.Builder, families []*metricFamily) {
+	for _, f := range families {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, s := range f.samples {
+			b.WriteString(s.name)
+			if len(s.labels) > 0 {
+				b.WriteByte('{')
+				for i, l := range s.labels {
+					if i > 0 {
+						b.WriteByte(',')
+					}
+					fmt.Fprintf(b, "%s=\"%s\"", l[0], labelEscaper.Replace(l[1]))
+				}
+				b.WriteByte('}')
+			}
+			fmt.Fprintf(b, " %s\n", formatValue(s.value))
+		}
+	}
+}
+
+// formatValue formats whole numbers without an exponent, so that counts and
+// timestamps read naturally.
+func formatValue(v float64) string {
+	if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func histogramFamily(name, help string, histograms map[string]*histogram) *metricFamily {
+	f := &metricFamily{name: name, help: help, typ: "histogram"}
+	for _, mapping := range slices.Sorted(maps.Keys(histograms)) {
+		h := histograms[mapping]
+		for i, bound := range durationBuckets {
+			f.addSample(name+"_bucket", float64(h.counts[i]), "mapping", mapping, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		f.addSample(name+"_bucket", float64(h.count), "mapping", mapping, "le", "+Inf")
+		f.addSample(name+"_sum", h.sum, "mapping", mapping)
+		f.addSample(name+"_count", float64(h.count), "mapping", mapping)
+	}
+	return f
+}
+
+// handleMetrics writes the metrics in the Prometheus text format.
+func handleMetrics(rw http.ResponseWriter, _ *http.Request) {
+	var b strings.Builder
+	writeExposition(&b, allMetrics())
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = rw.Write([]byte(b.String()))
+}
+
+// allMetrics returns the controller, runtime and process metrics.
+func allMetrics() []*metricFamily {
+	return slices.Concat(controllerMetrics(), runtimeMetrics(), processMetrics())
+}
+
+// controllerMetrics returns the metrics about Ceph and the mappings.
+func controllerMetrics() []*metricFamily {
+	servicesInfo.mu.Lock()
+	series, activeMgr := servicesInfo.series, servicesInfo.activeMgr
+	servicesInfo.mu.Unlock()
+
+	major, minor, patch := rados.Version()
+	build := &metricFamily{name: "ceph_mgr_endpoint_controller_build_info", help: "Version of the controller and of the librados it is linked against.", typ: "gauge"}
+	build.add(1, "version", version, "librados_version", fmt.Sprintf("%d.%d.%d", major, minor, patch))
+
+	clusterInfo.mu.Lock()
+	fsid, cephVersion := clusterInfo.fsid, clusterInfo.version
+	clusterInfo.mu.Unlock()
+	cluster := &metricFamily{name: "ceph_mgr_endpoint_controller_cluster_info", help: "FSID and version of the connected Ceph cluster.", typ: "gauge"}
+	if fsid != "" || cephVersion != "" {
+		cluster.add(1, "fsid", fsid, "version", cephVersion)
+	}
+
+	services := &metricFamily{name: "ceph_mgr_services_info", help: "Ceph mgr service endpoints discovered by the last reconcile.", typ: "gauge"}
+	for _, s := range series {
+		services.add(1, "module", s.module, "url", s.url, "ip", s.ip, "port", s.port, "active_mgr", activeMgr)
+	}
+
+	reconcileMetrics.mu.Lock()
+	defer reconcileMetrics.mu.Unlock()
+	discovery := histogramFamily("ceph_mgr_endpoint_controller_discovery_duration_seconds", "Time taken to discover the addresses of a mapping.", reconcileMetrics.discovery)
+	apply := histogramFamily("ceph_mgr_endpoint_controller_apply_duration_seconds", "Time taken to publish a mapping to every target cluster.", reconcileMetrics.apply)
+	reconciles := &metricFamily{name: "ceph_mgr_endpoint_controller_reconciles_total", help: "Mapping reconciles by result and failure reason.", typ: "counter"}
+	keys := slices.SortedFunc(maps.Keys(reconcileMetrics.results), func(x, y reconcileResult) int {
+		return strings.Compare(x.mapping+"\x00"+x.result+"\x00"+x.reason, y.mapping+"\x00"+y.result+"\x00"+y.reason)
+	})
+	for _, key := range keys {
+		reconciles.add(float64(reconcileMetrics.results[key]), "mapping", key.mapping, "result", key.result, "reason", key.reason)
+	}
+	switches := &metricFamily{name: "ceph_mgr_endpoint_controller_endpoint_switch_total", help: "Changes of a mapping's published addresses by the active mgr before and after.", typ: "counter"}
+	switchKeys := slices.SortedFunc(maps.Keys(reconcileMetrics.switches), func(x, y endpointSwitch) int {
+		return strings.Compare(x.mapping+"\x00"+x.fromMgr+"\x00"+x.toMgr, y.mapping+"\x00"+y.fromMgr+"\x00"+y.toMgr)
+	})
+	for _, key := range switchKeys {
+		switches.add(float64(reconcileMetrics.switches[key]), "mapping", key.mapping, "from_mgr", key.fromMgr, "to_mgr", key.toMgr)
+	}
+	return []*metricFamily{build, cluster, services, discovery, apply, reconciles, switches}
+}
+
+// metricsListener holds the settings of the /metrics listener.
+type metricsListener struct {
+	addr      string
+	tls       metricsTLSConfig
+	tokenFile string
+}
+
+func (c config) metricsListener() metricsListener {
+	return metricsListener{addr: c.metricsAddr, tls: c.metricsTLS, tokenFile: c.metricsToken}
+}
+
+// metricsServer runs the /metrics listener and restarts it when its
+// settings change on reload.
+type metricsServer struct {
+	listener metricsListener
+	stop     context.CancelFunc
+	done     chan struct{}
+}
+
+// update stops the running listener when the settings of cfg differ from
+// its own and starts one with the new settings, unless metrics are disabled.
+// A listener that failed, such as on a bind error, is started again. onError
+// is called when the listener fails. update reports whether it stopped or
+// started a listener.
+func (s *metricsServer) update(ctx context.Context, cfg config, onError func(error)) bool {
+	if s.stop != nil {
+		select {
+		case <-s.done:
+			// The listener failed, so there is nothing to stop.
+			s.stop()
+			s.stop = nil
+		default:
+		}
+	}
+	if s.stop != nil && s.listener == cfg.metricsListener() {
+		return false
+	}
+	if s.stop == nil && cfg.metricsAddr == "" {
+		s.listener = cfg.metricsListener()
+		return false
+	}
+	if s.stop != nil {
+		s.stop()
+		<-s.done
+		s.stop = nil
+	}
+	s.listener = cfg.metricsListener()
+	if s.listener.addr == "" {
+		return true
+	}
+	serverCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	s.stop, s.done = stop, done
+	listener := s.listener
+	go func() {
+		defer close(done)
+		if err := serveMetrics(serverCtx, listener); err != nil {
+			onError(err)
+		}
+	}()
+	return true
+}
+
+// serveMetrics serves /metrics until ctx is done, over HTTPS when a
+// certificate is configured. With a token file, requests must carry its
+// contents as a bearer token.
+func serveMetrics(ctx context.Context, l metricsListener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", requireBearerToken(l.tokenFile, http.HandlerFunc(handleMetrics)))
+	server := &http.Server{
+		Addr:              l.addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if l.tls.certFile != "" {
+		tlsConfig, err := serverTLSConfig(l.tls.certFile, l.tls.keyFile, l.tls.clientCA)
+		if err != nil {
+			return fmt.Errorf("metrics TLS: %w", err)
+		}
+		server.TLSConfig = tlsConfig
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	slog.Info("serving metrics", "addr", l.addr, "tls", server.TLSConfig != nil, "clientAuth", l.tls.clientCA != "", "tokenAuth", l.tokenFile != "")
+	var err error
+	if server.TLSConfig != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
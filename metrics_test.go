@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestMetricsServerRestartsFailedListener(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	blocker, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config{metricsAddr: blocker.Addr().String()}
+	failed := make(chan error, 1)
+	onError := func(err error) { failed <- err }
+
+	s := &metricsServer{}
+	if !s.update(ctx, cfg, onError) {
+		t.Fatal("update did not start a listener")
+	}
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener on a used address did not fail")
+	}
+	if err := blocker.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.update(ctx, cfg, onError) {
+		t.Fatal("update with the same settings did not restart the failed listener")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get("http://" + cfg.metricsAddr + "/metrics")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("restarted listener does not serve: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.update(ctx, cfg, onError) {
+		t.Error("update with the same settings restarted a running listener")
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fieldSet is a decoded FieldsV1 tree of managed fields.
+type fieldSet map[string]any
+
+func parseFieldSet(fields *metav1.FieldsV1) (fieldSet, error) {
+	set := make(fieldSet)
+	if fields == nil || len(fields.Raw) == 0 {
+		return set, nil
+	}
+	if err := json.Unmarshal(fields.Raw, &set); err != nil {
+		return nil, fmt.Errorf("parse managed fields: %w", err)
+	}
+	return set, nil
+}
+
+// merge adds the fields of other to s.
+func (s fieldSet) merge(other fieldSet) {
+	for key, value := range other {
+		child, ok := value.(map[string]any)
+		existing, exists := s[key].(map[string]any)
+		if ok && exists {
+			fieldSet(existing).merge(child)
+		} else if !exists {
+			s[key] = value
+		}
+	}
+}
+
+// take removes the field at path from s and returns it nested under path, or
+// nil when s does not contain it. Parents left empty are removed.
+func (s fieldSet) take(path ...string) fieldSet {
+	value, ok := s[path[0]]
+	if !ok {
+		return nil
+	}
+	if len(path) == 1 {
+		delete(s, path[0])
+		return fieldSet{path[0]: value}
+	}
+	child, ok := value.(map[string]any)
+	if !ok {
+		return nil
+	}
+	taken := fieldSet(child).take(path[1:]...)
+	if taken == nil {
+		return nil
+	}
+	if len(child) == 0 || (len(child) == 1 && child["."] != nil) {
+		delete(s, path[0])
+	}
+	return fieldSet{path[0]: map[string]any(taken)}
+}
+
+// rebaseManagedFields moves the fields that the from managers own into the
+// Apply entry of manager to, so that the next Apply by to owns them. With
+// paths, only those fields move and the rest stay with their managers. It
+// returns nil when nothing moved.
+func rebaseManagedFields(entries []metav1.ManagedFieldsEntry, from []string, to string, paths [][]string) ([]metav1.ManagedFieldsEntry, error) {
+	moved := make(fieldSet)
+	var apiVersion string
+	var result []metav1.ManagedFieldsEntry
+	for _, entry := range entries {
+		if !slices.Contains(from, entry.Manager) || entry.Subresource != "" {
+			result = append(result, entry)
+			continue
+		}
+		set, err := parseFieldSet(entry.FieldsV1)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", entry.Manager, err)
+		}
+		if paths == nil {
+			moved.merge(set)
+			set = nil
+		} else {
+			for _, path := range paths {
+				if taken := set.take(path...); taken != nil {
+					moved.merge(taken)
+				}
+			}
+		}
+		if apiVersion == "" {
+			apiVersion = entry.APIVersion
+		}
+		if len(set) > 0 {
+			raw, err := json.Marshal(set)
+			if err != nil {
+				return nil, err
+			}
+			entry.FieldsV1 = &metav1.FieldsV1{Raw: raw}
+			result = append(result, entry)
+		}
+	}
+	if len(moved) == 0 {
+		return nil, nil
+	}
+
+	i := slices.IndexFunc(result, func(e metav1.ManagedFieldsEntry) bool {
+		return e.Manager == to && e.Operation == metav1.ManagedFieldsOperationApply && e.Subresource == ""
+	})
+	if i < 0 {
+		now := metav1.Now()
+		result = append(result, metav1.ManagedFieldsEntry{Manager: to, Operation: metav1.ManagedFieldsOperationApply, APIVersion: apiVersion, Time: &now, FieldsType: "FieldsV1"})
+		i = len(result) - 1
+	}
+	set, err := parseFieldSet(result[i].FieldsV1)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", to, err)
+	}
+	set.merge(moved)
+	raw, err := json.Marshal(set)
+	if err != nil {
+		return nil, err
+	}
+	result[i].FieldsV1 = &metav1.FieldsV1{Raw: raw}
+	return result, nil
+}
+
+type jsonPatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+// escapeJSONPointer escapes a map key for use in a JSON patch path.
+func escapeJSONPointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// migrateEndpointSlices hands the EndpointSlices of m over from the previous
+// field managers. Their label naming a previous manager is rewritten too, so
+// the slices are no longer taken for another component's.
+func migrateEndpointSlices(ctx context.Context, cfg config, kube *kubeClient, m mapping) error {
+	sliceClient := kube.clientset.DiscoveryV1().EndpointSlices(m.namespace)
+	list, err := sliceClient.List(ctx, metav1.ListOptions{LabelSelector: labels.Set{sliceGroupLabel: m.slice}.String()})
+	if err != nil {
+		return fmt.Errorf("list EndpointSlices: %w", err)
+	}
+	items := list.Items
+	if !slices.ContainsFunc(items, func(s discoveryv1.EndpointSlice) bool { return s.Name == m.slice }) {
+		slice, err := sliceClient.Get(ctx, m.slice, metav1.GetOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("get EndpointSlice: %w", err)
+		}
+		if err == nil {
+			items = append(items, *slice)
+		}
+	}
+	for _, slice := range items {
+		if isPaused(slice.Annotations) {
+			continue
+		}
+		entries, err := rebaseManagedFields(slice.ManagedFields, cfg.migrateManagers, fieldManager, nil)
+		if err != nil {
+			return fmt.Errorf("EndpointSlice %s: %w", slice.Name, err)
+		}
+		relabel := slices.Contains(cfg.migrateManagers, slice.Labels[managedByLabel])
+		if entries == nil && !relabel {
+			continue
+		}
+		patch := []jsonPatchOp{{Op: "test", Path: "/metadata/resourceVersion", Value: slice.ResourceVersion}}
+		if entries != nil {
+			patch = append(patch, jsonPatchOp{Op: "replace", Path: "/metadata/managedFields", Value: entries})
+		}
+		if relabel {
+			patch = append(patch, jsonPatchOp{Op: "replace", Path: "/metadata/labels/" + escapeJSONPointer(managedByLabel), Value: fieldManager})
+		}
+		if err := patchMigration(kube, "endpointslices", m.namespace, slice.Name, patch, func(data []byte) error {
+			_, err := sliceClient.Patch(ctx, slice.Name, types.JSONPatchType, data, metav1.PatchOptions{})
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateServiceAnnotations hands the URL annotations of m's Service over
+// from the previous field managers. Other fields of the Service stay with
+// their managers.
+func migrateServiceAnnotations(ctx context.Context, cfg config, kube *kubeClient, m mapping) error {
+	services := kube.clientset.CoreV1().Services(m.namespace)
+	svc, err := services.Get(ctx, m.serviceName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("get Service: %w", err)
+	}
+	var paths [][]string
+	for _, suffix := range []string{"-url", "-url-prefix", "-url-scheme"} {
+		paths = append(paths, []string{"f:metadata", "f:annotations", "f:ceph.io/" + m.module + suffix})
+	}
+	manager := fieldManager + "-" + m.module
+	entries, err := rebaseManagedFields(svc.ManagedFields, cfg.migrateManagers, manager, paths)
+	if err != nil {
+		return fmt.Errorf("Service %s: %w", svc.Name, err)
+	}
+	if entries == nil {
+		return nil
+	}
+	patch := []jsonPatchOp{
+		{Op: "test", Path: "/metadata/resourceVersion", Value: svc.ResourceVersion},
+		{Op: "replace", Path: "/metadata/managedFields", Value: entries},
+	}
+	return patchMigration(kube, "services", m.namespace, svc.Name, patch, func(data []byte) error {
+		_, err := services.Patch(ctx, svc.Name, types.JSONPatchType, data, metav1.PatchOptions{})
+		return err
+	})
+}
+
+// patchMigration sends a JSON patch rewriting managed fields through apply.
+func patchMigration(kube *kubeClient, resource, namespace, name string, patch []jsonPatchOp, apply func([]byte) error) error {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	err = apply(data)
+	auditMutation(kube, "patch", resource, namespace, name, fieldManager, []any{"managedFields", "migrated"}, err)
+	if err != nil {
+		return fmt.Errorf("migrate field managers of %s %s: %w", resource, name, err)
+	}
+	slog.Info("migrated field managers", "cluster", kube.name, "resource", resource, "namespace", namespace, "name", name)
+	return nil
+}
+
+// migrateFieldManagers runs once at startup and hands the configured
+// mappings' EndpointSlices and Service URL annotations over from the field
+// managers of a previous deployment, so that the first Apply neither
+// conflicts with them nor leaves fields behind that only they owned.
+func migrateFieldManagers(ctx context.Context, cfg config, kubes []*kubeClient) {
+	for _, m := range cfg.mappings {
+		for _, kube := range kubes {
+			if !m.appliesTo(kube.name) {
+				continue
+			}
+			err := cfg.kubeRetry.do(ctx, func() error { return migrateEndpointSlices(ctx, cfg, kube, m) })
+			if err == nil {
+				err = cfg.kubeRetry.do(ctx, func() error { return migrateServiceAnnotations(ctx, cfg, kube, m) })
+			}
+			if err != nil {
+				slog.Warn("failed to migrate field managers", "cluster", kube.name, "namespace", m.namespace, "slice", m.slice, "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+)
+
+type healthCommand struct {
+	Prefix string `json:"prefix"`
+	Detail string `json:"detail"`
+	Format string `json:"format"`
+}
+
+type healthReport struct {
+	Checks map[string]struct {
+		Detail []struct {
+			Message string `json:"message"`
+		} `json:"detail"`
+	} `json:"checks"`
+}
+
+// failedModulePattern matches the MGR_MODULE_ERROR and MGR_MODULE_DEPENDENCY
+// health details, such as "Module 'dashboard' has failed: ...".
+var failedModulePattern = regexp.MustCompile(`^Module '([^']+)' has failed`)
+
+// getFailedMgrModules returns the health detail message of each mgr module
+// that has failed, by name.
+func getFailedMgrModules(conn discoverer) (map[string]string, error) {
+	buf, err := execMonCommand(conn, healthCommand{Prefix: "health", Detail: "detail", Format: "json"})
+	if err != nil {
+		return nil, err
+	}
+	var report healthReport
+	if err := json.Unmarshal(buf, &report); err != nil {
+		return nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+	failed := make(map[string]string)
+	for _, check := range []string{"MGR_MODULE_ERROR", "MGR_MODULE_DEPENDENCY"} {
+		for _, detail := range report.Checks[check].Detail {
+			if match := failedModulePattern.FindStringSubmatch(detail.Message); match != nil {
+				failed[match[1]] = detail.Message
+			}
+		}
+	}
+	return failed, nil
+}
+
+// checkMgrModules reports whether the mgr modules of the configured mappings
+// are enabled, have not failed and publish a URL in the mgr services map. It
+// returns whether any of them has a problem.
+func checkMgrModules(conn discoverer, cfg config) (bool, error) {
+	modules, err := getMgrModules(conn)
+	if err != nil {
+		return false, fmt.Errorf("list mgr modules: %w", err)
+	}
+	failed, err := getFailedMgrModules(conn)
+	if err != nil {
+		return false, fmt.Errorf("get health: %w", err)
+	}
+	services, err := getMgrServices(conn)
+	if err != nil {
+		return false, fmt.Errorf("get mgr services: %w", err)
+	}
+
+	var names []string
+	for _, m := range cfg.mappings {
+		if m.fromMgrServices() && !slices.Contains(names, m.module) {
+			names = append(names, m.module)
+		}
+	}
+	problems := false
+	for _, name := range names {
+		enabled := slices.Contains(modules.EnabledModules, name) || slices.Contains(modules.AlwaysOnModules, name)
+		switch {
+		case !enabled:
+			attrs := []any{"module", name}
+			i := slices.IndexFunc(modules.DisabledModules, func(d disabledModule) bool { return d.Name == name })
+			if i >= 0 && !modules.DisabledModules[i].CanRun {
+				attrs = append(attrs, "canRun", false, "error", modules.DisabledModules[i].ErrorString)
+			}
+			slog.Warn("mgr module not enabled", attrs...)
+		case failed[name] != "":
+			slog.Warn("mgr module failed", "module", name, "error", failed[name])
+		case services[name] == "":
+			slog.Warn("mgr module enabled but has not published a URL", "module", name)
+		default:
+			slog.Info("mgr module ready", "module", name, "url", services[name])
+			continue
+		}
+		problems = true
+	}
+	return problems, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+)
+
+// parseCIDRs parses a list of CIDRs from the configuration.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// preferNetworks narrows candidate addresses of one host to those in the
+// first of networks that contains any of them, keeping their order. The
+// candidates are returned unchanged when no network matches.
+func preferNetworks(ips []net.IP, networks []*net.IPNet) []net.IP {
+	for _, network := range networks {
+		var matched []net.IP
+		for _, ip := range ips {
+			if network.Contains(ip) {
+				matched = append(matched, ip)
+			}
+		}
+		if len(matched) > 0 {
+			return matched
+		}
+	}
+	return ips
+}
+
+// addressRewrite maps addresses in one network onto another of the same
+// size, keeping the host bits, as with 1:1 NAT. Exact rewrites are single
+// address networks.
+type addressRewrite struct {
+	from *net.IPNet
+	to   *net.IPNet
+}
+
+// parseAddressRewrite parses a rewrite between two addresses or two CIDRs
+// with the same prefix length.
+func parseAddressRewrite(from, to string) (addressRewrite, error) {
+	parse := func(s string) (*net.IPNet, error) {
+		if ip := net.ParseIP(s); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or CIDR %q", s)
+		}
+		return network, nil
+	}
+	fromNet, err := parse(from)
+	if err != nil {
+		return addressRewrite{}, err
+	}
+	toNet, err := parse(to)
+	if err != nil {
+		return addressRewrite{}, err
+	}
+	fromOnes, fromBits := fromNet.Mask.Size()
+	toOnes, toBits := toNet.Mask.Size()
+	if fromOnes != toOnes || fromBits != toBits {
+		return addressRewrite{}, fmt.Errorf("%s and %s differ in size", from, to)
+	}
+	return addressRewrite{from: fromNet, to: toNet}, nil
+}
+
+// rewriteAddress applies the first matching rewrite to ip.
+func rewriteAddress(ip net.IP, rewrites []addressRewrite) net.IP {
+	for _, r := range rewrites {
+		if !r.from.Contains(ip) {
+			continue
+		}
+		if len(r.from.IP) == net.IPv4len {
+			ip = ip.To4()
+		} else {
+			ip = ip.To16()
+		}
+		rewritten := make(net.IP, len(ip))
+		for i := range ip {
+			rewritten[i] = r.to.IP[i] | ip[i]&^r.from.Mask[i]
+		}
+		return rewritten
+	}
+	return ip
+}
+
+// rewriteGroups applies the rewrites to every published address.
+func rewriteGroups(base string, groups []endpointGroup, rewrites []addressRewrite) []endpointGroup {
+	if len(rewrites) == 0 {
+		return groups
+	}
+	return mapEndpointGroups(base, groups, func(addr *endpointAddress) {
+		addr.ip = rewriteAddress(addr.ip, rewrites)
+	})
+}
+
+// disallowedAddress returns the first address in groups outside networks,
+// or nil when all are inside or networks is empty.
+func disallowedAddress(groups []endpointGroup, networks []*net.IPNet) *endpointAddress {
+	if len(networks) == 0 {
+		return nil
+	}
+	for _, group := range groups {
+		for _, addr := range group.addrs {
+			if !slices.ContainsFunc(networks, func(network *net.IPNet) bool { return network.Contains(addr.ip) }) {
+				return addr
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// listNodeAddresses indexes a cluster's Nodes by each of their addresses.
+func listNodeAddresses(ctx context.Context, kube *kubeClient) (map[string]*corev1.Node, error) {
+	list, err := kube.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("list Nodes: %w", err)
+	}
+	index := make(map[string]*corev1.Node)
+	for i := range list.Items {
+		node := &list.Items[i]
+		for _, address := range node.Status.Addresses {
+			if ip := net.ParseIP(address.Address); ip != nil {
+				index[ip.String()] = node
+			}
+		}
+	}
+	return index, nil
+}
+
+// nodeInternalIP returns the InternalIP of node in the family of ip, or nil
+// when it has none.
+func nodeInternalIP(node *corev1.Node, ip net.IP) net.IP {
+	for _, address := range node.Status.Addresses {
+		if address.Type != corev1.NodeInternalIP {
+			continue
+		}
+		if internal := net.ParseIP(address.Address); internal != nil && addressTypeFor(internal) == addressTypeFor(ip) {
+			return internal
+		}
+	}
+	return nil
+}
+
+// mapNodeAddresses publishes addresses of mgr hosts that are also Kubernetes
+// Nodes as the Node's InternalIP, and records the Node name.
+func mapNodeAddresses(base string, groups []endpointGroup, nodes map[string]*corev1.Node) []endpointGroup {
+	return mapEndpointGroups(base, groups, func(addr *endpointAddress) {
+		node, ok := nodes[addr.ip.String()]
+		if !ok {
+			return
+		}
+		addr.nodeName = node.Name
+		if internal := nodeInternalIP(node, addr.ip); internal != nil {
+			addr.ip = internal
+		}
+	})
+}
+
+// withNodeAddresses applies the Node address mapping for kube's cluster when
+// it is enabled. Nodes are listed once per cluster and cached in nodes.
+func withNodeAddresses(ctx context.Context, cfg config, kube *kubeClient, m mapping, groups []endpointGroup, nodes map[string]map[string]*corev1.Node) ([]endpointGroup, error) {
+	if !cfg.nodeAddresses {
+		return groups, nil
+	}
+	index, ok := nodes[kube.name]
+	if !ok {
+		if err := cfg.kubeRetry.do(ctx, func() (err error) {
+			index, err = listNodeAddresses(ctx, kube)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		nodes[kube.name] = index
+	}
+	return mapNodeAddresses(m.slice, groups, index), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// applyGeneratedObject creates or updates a custom resource that the
+// controller generates for a mapping, such as a Route. Only the top-level
+// spec fields the controller sets are compared, so defaults filled in by
+// the API server do not cause an update. It returns whether the object was
+// applied.
+func applyGeneratedObject(ctx context.Context, kube *kubeClient, gvr schema.GroupVersionResource, kind, namespace, name string, spec map[string]any) (bool, error) {
+	client := kube.dynamic.Resource(gvr).Namespace(namespace)
+	existing, err := client.Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return false, fmt.Errorf("get %s: %w", kind, err)
+	}
+	if err == nil {
+		current, _, _ := unstructured.NestedMap(existing.Object, "spec")
+		matches := true
+		for key, want := range spec {
+			matches = matches && reflect.DeepEqual(current[key], want)
+		}
+		if matches {
+			return false, nil
+		}
+	}
+
+	obj := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": gvr.GroupVersion().String(),
+		"kind":       kind,
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": namespace,
+			"labels": map[string]any{
+				"app.kubernetes.io/managed-by": fieldManager,
+			},
+		},
+		"spec": spec,
+	}}
+	_, err = client.Apply(ctx, name, obj, metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+	auditMutation(kube, "apply", gvr.Resource, namespace, name, fieldManager, nil, err)
+	if err != nil {
+		return false, fmt.Errorf("apply %s: %w", kind, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// onceSummary is the JSON line printed by --once.
+type onceSummary struct {
+	Outcome string `json:"outcome"`
+	Changes int    `json:"changes"`
+	Reason  string `json:"reason,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// reportOnceFailure prints the outcome of a --once run that failed with err
+// before its reconcile, and returns the exit code of err's category.
+func reportOnceFailure(out io.Writer, err error) int {
+	return reportOnce(out, &runState{lastErr: err})
+}
+
+// reportOnce prints the outcome of the single reconcile of --once to out:
+// "unchanged", "changed" or "failed". It returns 0 unless the reconcile
+// failed, and the exit code of its failure category otherwise.
+func reportOnce(out io.Writer, state *runState) int {
+	summary := onceSummary{Outcome: "unchanged", Changes: state.changes}
+	code := 0
+	switch {
+	case !state.succeeded:
+		summary.Outcome = "failed"
+		summary.Reason = errorReason(state.lastErr)
+		if state.lastErr != nil {
+			summary.Error = state.lastErr.Error()
+		}
+		code = exitCode(state.lastErr)
+	case state.changes > 0:
+		summary.Outcome = "changed"
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return 1
+	}
+	fmt.Fprintln(out, string(data))
+	return code
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+type orchPsCommand struct {
+	Prefix     string `json:"prefix"`
+	DaemonType string `json:"daemon_type"`
+	Format     string `json:"format"`
+}
+
+type orchDaemon struct {
+	DaemonType string `json:"daemon_type"`
+	DaemonName string `json:"daemon_name"`
+	Hostname   string `json:"hostname"`
+	IP         string `json:"ip"`
+	Ports      []int  `json:"ports"`
+	Status     int    `json:"status"`
+}
+
+type orchHost struct {
+	Hostname string `json:"hostname"`
+	Addr     string `json:"addr"`
+}
+
+var orchHostLsCommand = monCommand{Prefix: "orch host ls", Format: "json"}
+
+type orchDaemonDefault struct {
+	scheme string
+	port   int
+}
+
+// orchDaemonDefaults describes daemon types that do not serve plain HTTP or
+// that may not report their ports in orch ps.
+var orchDaemonDefaults = map[string]orchDaemonDefault{
+	"grafana": {scheme: "https"},
+	"smb":     {scheme: "smb", port: 445},
+}
+
+func getOrchHosts(conn discoverer) (map[string]net.IP, error) {
+	buf, err := execMgrCommand(conn, orchHostLsCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []orchHost
+	if err := json.Unmarshal(buf, &entries); err != nil {
+		return nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	hosts := make(map[string]net.IP, len(entries))
+	for _, entry := range entries {
+		if ip := net.ParseIP(entry.Addr); ip != nil {
+			hosts[entry.Hostname] = ip
+		}
+	}
+	return hosts, nil
+}
+
+// getOrchDaemonAddresses returns the address and port of every running
+// orchestrator daemon of the given type.
+func getOrchDaemonAddresses(conn discoverer, daemonType string) ([]*endpointAddress, error) {
+	buf, err := execMgrCommand(conn, orchPsCommand{Prefix: "orch ps", DaemonType: daemonType, Format: "json"})
+	if err != nil {
+		return nil, err
+	}
+
+	var daemons []orchDaemon
+	if err := json.Unmarshal(buf, &daemons); err != nil {
+		return nil, fmt.Errorf("unmarshal response: %w", err)
+	}
+
+	defaults := orchDaemonDefaults[daemonType]
+	if defaults.scheme == "" {
+		defaults.scheme = "http"
+	}
+
+	var hosts map[string]net.IP
+	var addrs []*endpointAddress
+	for _, daemon := range daemons {
+		if daemon.Status != 1 {
+			continue
+		}
+		port := defaults.port
+		if len(daemon.Ports) > 0 {
+			port = daemon.Ports[0]
+		}
+		if port == 0 {
+			continue
+		}
+		ip := net.ParseIP(daemon.IP)
+		if ip == nil {
+			if hosts == nil {
+				if hosts, err = getOrchHosts(conn); err != nil {
+					return nil, fmt.Errorf("list orchestrator hosts: %w", err)
+				}
+			}
+			ip = hosts[daemon.Hostname]
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("no address for %s on host %s", daemon.DaemonName, daemon.Hostname)
+		}
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("port out of range for %s: %d", daemon.DaemonName, port)
+		}
+		addrs = append(addrs, &endpointAddress{
+			ip:   ip,
+			port: int32(port),
+			url:  (&url.URL{Scheme: defaults.scheme, Host: net.JoinHostPort(ip.String(), strconv.Itoa(port)), Path: "/"}).String(),
+			path: "/",
+		})
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no running %s daemons found", daemonType)
+	}
+	return addrs, nil
+}
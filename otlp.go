@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// processStart is the start time of the cumulative OTLP sums and histograms.
+var processStart = time.Now()
+
+// The OTLP/HTTP JSON encoding, limited to what the controller exports.
+// 64-bit integers are encoded as strings, as protobuf JSON requires.
+type (
+	otlpRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpScope    `json:"scope"`
+		Metrics []otlpMetric `json:"metrics"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpAttribute struct {
+		Key   string            `json:"key"`
+		Value map[string]string `json:"value"`
+	}
+	otlpMetric struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Gauge       *otlpGauge     `json:"gauge,omitempty"`
+		Sum         *otlpSum       `json:"sum,omitempty"`
+		Histogram   *otlpHistogram `json:"histogram,omitempty"`
+		Summary     *otlpSummary   `json:"summary,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpNumberPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpNumberPoint `json:"dataPoints"`
+		AggregationTemporality int               `json:"aggregationTemporality"`
+		IsMonotonic            bool              `json:"isMonotonic"`
+	}
+	otlpNumberPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsDouble          float64         `json:"asDouble"`
+	}
+	otlpHistogram struct {
+		DataPoints             []otlpHistogramPoint `json:"dataPoints"`
+		AggregationTemporality int                  `json:"aggregationTemporality"`
+	}
+	otlpHistogramPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               float64         `json:"sum"`
+		BucketCounts      []string        `json:"bucketCounts"`
+		ExplicitBounds    []float64       `json:"explicitBounds"`
+	}
+	otlpSummary struct {
+		DataPoints []otlpSummaryPoint `json:"dataPoints"`
+	}
+	otlpSummaryPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               float64         `json:"sum"`
+		QuantileValues    []otlpQuantile  `json:"quantileValues"`
+	}
+	otlpQuantile struct {
+		Quantile float64 `json:"quantile"`
+		Value    float64 `json:"value"`
+	}
+)
+
+// otlpCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpCumulative = 2
+
+func otlpAttributes(labels [][2]string, skip string) []otlpAttribute {
+	var attrs []otlpAttribute
+	for _, l := range labels {
+		if l[0] != skip {
+			attrs = append(attrs, otlpAttribute{Key: l[0], Value: map[string]string{"stringValue": l[1]}})
+		}
+	}
+	return attrs
+}
+
+func labelValue(labels [][2]string, name string) string {
+	for _, l := range labels {
+		if l[0] == name {
+			return l[1]
+		}
+	}
+	return ""
+}
+
+// labelsKey identifies the series of a histogram or summary sample, apart
+// from its le or quantile label.
+func labelsKey(labels [][2]string, skip string) string {
+	var b strings.Builder
+	for _, l := range labels {
+		if l[0] != skip {
+			fmt.Fprintf(&b, "%s=%q,", l[0], l[1])
+		}
+	}
+	return b.String()
+}
+
+// otlpMetrics converts metric families to OTLP metrics: gauges to gauges, counters to cumulative sums, and histograms
+// and summaries to their OTLP counterparts.
+func otlpMetrics(families []*metricFamily, now time.Time) []otlpMetric {
+	start := strconv.FormatInt(processStart.UnixNano(), 10)
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+	var metrics []otlpMetric
+	for _, f := range families {
+		if len(f.samples) == 0 {
+			continue
+		}
+		m := otlpMetric{Name: f.name, Description: f.help}
+		switch f.typ {
+		case "counter":
+			m.Sum = &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true, DataPoints: []otlpNumberPoint{}}
+			for _, s := range f.samples {
+				m.Sum.DataPoints = append(m.Sum.DataPoints, otlpNumberPoint{Attributes: otlpAttributes(s.labels, ""), StartTimeUnixNano: start, TimeUnixNano: ts, AsDouble: s.value})
+			}
+		case "histogram":
+			m.Histogram = &otlpHistogram{AggregationTemporality: otlpCumulative, DataPoints: []otlpHistogramPoint{}}
+			points := make(map[string]*otlpHistogramPoint)
+			var order []string
+			// Bucket counts are cumulative in the text format and per
+			// bucket in OTLP.
+			below := make(map[string]float64)
+			for _, s := range f.samples {
+				key := labelsKey(s.labels, "le")
+				p, ok := points[key]
+				if !ok {
+					p = &otlpHistogramPoint{Attributes: otlpAttributes(s.labels, "le"), StartTimeUnixNano: start, TimeUnixNano: ts}
+					points[key] = p
+					order = append(order, key)
+				}
+				switch s.name {
+				case f.name + "_bucket":
+					p.BucketCounts = append(p.BucketCounts, strconv.FormatFloat(s.value-below[key], 'f', 0, 64))
+					below[key] = s.value
+					if le := labelValue(s.labels, "le"); le != "+Inf" {
+						bound, _ := strconv.ParseFloat(le, 64)
+						p.ExplicitBounds = append(p.ExplicitBounds, bound)
+					}
+				case f.name + "_sum":
+					p.Sum = s.value
+				case f.name + "_count":
+					p.Count = strconv.FormatFloat(s.value, 'f', 0, 64)
+				}
+			}
+			for _, key := range order {
+				m.Histogram.DataPoints = append(m.Histogram.DataPoints, *points[key])
+			}
+		case "summary":
+			m.Summary = &otlpSummary{DataPoints: []otlpSummaryPoint{}}
+			points := make(map[string]*otlpSummaryPoint)
+			var order []string
+			for _, s := range f.samples {
+				key := labelsKey(s.labels, "quantile")
+				p, ok := points[key]
+				if !ok {
+					p = &otlpSummaryPoint{Attributes: otlpAttributes(s.labels, "quantile"), StartTimeUnixNano: start, TimeUnixNano: ts}
+					points[key] = p
+					order = append(order, key)
+				}
+				switch s.name {
+				case f.name:
+					q, _ := strconv.ParseFloat(labelValue(s.labels, "quantile"), 64)
+					p.QuantileValues = append(p.QuantileValues, otlpQuantile{Quantile: q, Value: s.value})
+				case f.name + "_sum":
+					p.Sum = s.value
+				case f.name + "_count":
+					p.Count = strconv.FormatFloat(s.value, 'f', 0, 64)
+				}
+			}
+			for _, key := range order {
+				m.Summary.DataPoints = append(m.Summary.DataPoints, *points[key])
+			}
+		default:
+			m.Gauge = &otlpGauge{DataPoints: []otlpNumberPoint{}}
+			for _, s := range f.samples {
+				m.Gauge.DataPoints = append(m.Gauge.DataPoints, otlpNumberPoint{Attributes: otlpAttributes(s.labels, ""), TimeUnixNano: ts, AsDouble: s.value})
+			}
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// exportOTLP sends the metrics served on /metrics to an OTLP/HTTP collector.
+func exportOTLP(ctx context.Context, cfg otlpConfig) error {
+	headers, err := readOTLPHeaders(cfg.headersDir)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: otlpAttributes([][2]string{{"service.name", fieldManager}, {"service.version", version}}, "")},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: fieldManager, Version: version},
+			Metrics: otlpMetrics(allMetrics(), time.Now()),
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for _, name := range slices.Sorted(maps.Keys(headers)) {
+		req.Header.Set(name, headers[name])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("export metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("export metrics: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// readOTLPHeaders reads the headers sent to the collector from dir, one file
+// per header named after it, as a mounted Secret lays out its keys. Hidden
+// files, such as the ..data link of a Secret volume, are skipped. The
+// directory is read before every export, so that rotated credentials take
+// effect without a restart.
+func readOTLPHeaders(dir string) (map[string]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("read otlp headers: %w", err)
+	}
+	headers := make(map[string]string)
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("read otlp header %s: %w", entry.Name(), err)
+		}
+		headers[entry.Name()] = strings.TrimSpace(string(data))
+	}
+	return headers, nil
+}
+
+// otlpExporter runs the OTLP export loop and restarts it when its settings
+// change on reload.
+type otlpExporter struct {
+	cfg  otlpConfig
+	stop context.CancelFunc
+	done chan struct{}
+}
+
+// update stops the running export loop when cfg differs from its settings
+// and starts one with cfg, unless no endpoint is set.
+func (e *otlpExporter) update(ctx context.Context, cfg otlpConfig) {
+	if e.stop != nil && e.cfg == cfg {
+		return
+	}
+	if e.stop != nil {
+		e.stop()
+		<-e.done
+		e.stop = nil
+	}
+	e.cfg = cfg
+	if cfg.endpoint == "" {
+		return
+	}
+	loopCtx, stop := context.WithCancel(ctx)
+	done := make(chan struct{})
+	e.stop, e.done = stop, done
+	go func() {
+		defer close(done)
+		runOTLPExporter(loopCtx, cfg)
+	}()
+}
+
+// runOTLPExporter exports the metrics every cfg.interval until ctx is done.
+func runOTLPExporter(ctx context.Context, cfg otlpConfig) {
+	ticker := time.NewTicker(cfg.interval)
+	defer ticker.Stop()
+	slog.Info("exporting metrics over OTLP", "endpoint", cfg.endpoint, "interval", cfg.interval)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := exportOTLP(ctx, cfg); err != nil {
+				slog.Warn("failed to export metrics over OTLP", "endpoint", cfg.endpoint, "error", err)
+			}
+		}
+	}
+}
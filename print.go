@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// desiredSlice is an EndpointSlice the controller would apply for m, in
+// cluster when desiredSlices was given clusters.
+type desiredSlice struct {
+	m       mapping
+	cluster string
+	name    string
+	addrs   []*endpointAddress
+}
+
+// printObjects writes the EndpointSlices the controller would apply for the
+// configured mappings as YAML, without contacting Kubernetes. Owner
+// references and Node addresses need the API server and are left out.
+func printObjects(ctx context.Context, cfg config, conn discoverer, out io.Writer) error {
+	_, desired, err := desiredSlices(ctx, cfg, conn, nil)
+	if err != nil {
+		return err
+	}
+	for _, d := range desired {
+		data, err := yaml.Marshal(endpointSliceApply(d.m, d.name, d.addrs))
+		if err != nil {
+			return fmt.Errorf("encode EndpointSlice %s/%s: %w", d.m.namespace, d.name, err)
+		}
+		fmt.Fprintf(out, "---\n%s", data)
+	}
+	return nil
+}
+
+// desiredSlices returns the mappings a reconcile would handle and the
+// EndpointSlices it would apply for them, reading Ceph and Kubernetes the way
+// a reconcile does but changing nothing. With kubes, the mappings derived
+// from Services and CephMgrEndpoints are included and Node addresses are
+// mapped in every cluster; without, only the configured mappings are, for no
+// cluster in particular. A mapping that a reconcile would fail fails the
+// call, and one it would refuse to publish is logged and left out.
+func desiredSlices(ctx context.Context, cfg config, conn discoverer, kubes []*kubeClient) ([]mapping, []desiredSlice, error) {
+	mappings := slices.Clone(cfg.mappings)
+	if len(kubes) > 0 {
+		serviceMappings, err := discoverServiceMappings(ctx, cfg, kubes)
+		if err != nil {
+			return nil, nil, withCategory(errKubernetes, fmt.Errorf("failed to discover Services: %w", err))
+		}
+		resourceMappings, _, _, err := discoverResourceMappings(ctx, cfg, kubes)
+		if err != nil {
+			return nil, nil, withCategory(errKubernetes, fmt.Errorf("failed to discover CephMgrEndpoints: %w", err))
+		}
+		mappings = slices.Concat(mappings, serviceMappings, resourceMappings)
+	}
+
+	var mgr *mgrMap
+	var err error
+	if cfg.verifyActiveMgr || cfg.dualStack {
+		if mgr, err = getMgrMap(conn); err != nil {
+			return nil, nil, withCategory(errCephUnreachable, fmt.Errorf("failed to get mgr map: %w", err))
+		}
+	}
+	services, err := getMgrServices(conn)
+	if err != nil {
+		return nil, nil, withCategory(errCephUnreachable, fmt.Errorf("failed to get mgr services: %w", err))
+	}
+	if cfg.verifyActiveMgr {
+		reason, err := verifyActiveMgr(conn, mgr, services)
+		if err != nil {
+			return nil, nil, withCategory(errCephUnreachable, fmt.Errorf("failed to verify active mgr: %w", err))
+		}
+		if reason != "" {
+			return nil, nil, withCategory(errInconsistentMgr, fmt.Errorf("holding EndpointSlice updates: %s", reason))
+		}
+	}
+	if cfg.configFallback {
+		if err := fillServicesFromConfig(conn, services, cfg.mappings, cfg.preferredNets); err != nil {
+			slog.Warn("failed to derive mgr services from config", "error", err)
+		}
+	}
+	if ip := cfg.simulation.address(time.Now()); ip != nil {
+		if services, err = simulateServices(services, ip); err != nil {
+			return nil, nil, fmt.Errorf("failed to simulate failover: %w", err)
+		}
+	}
+
+	var desired []desiredSlice
+	resolver := newHostResolver(cfg.resolve)
+	addrs := make(map[string][]*endpointAddress)
+	nodes := make(map[string]map[string]*corev1.Node)
+	var dashboardPorts map[string]int32
+	for _, m := range mappings {
+		if m.disabled {
+			continue
+		}
+		if plan, ok := planService(m, services); !ok {
+			if plan.err != nil {
+				return nil, nil, plan.err
+			}
+			continue
+		}
+		groups, err := discoverGroups(ctx, cfg, conn, resolver, m, services, mgr, addrs)
+		if err != nil {
+			return nil, nil, err
+		}
+		if m.module == "dashboard" && cfg.dashboardPorts && dashboardPorts == nil {
+			if dashboardPorts, err = getDashboardPorts(conn); err != nil {
+				return nil, nil, fmt.Errorf("failed to get dashboard ports: %w", err)
+			}
+		}
+		plan := planMapping(cfg, m, groups, dashboardPorts)
+		if plan.err != nil {
+			return nil, nil, fmt.Errorf("%s/%s: %w", m.namespace, m.slice, plan.err)
+		}
+		if plan.refused != nil {
+			slog.Warn("refusing to publish address outside allowed CIDRs", "namespace", m.namespace, "slice", m.slice, "ip", plan.refused)
+			continue
+		}
+		if len(kubes) == 0 {
+			for _, group := range plan.groups {
+				desired = append(desired, desiredSlice{m: m, name: group.name, addrs: group.addrs})
+			}
+			continue
+		}
+		for _, kube := range kubes {
+			if !m.appliesTo(kube.name) {
+				continue
+			}
+			published, err := withNodeAddresses(ctx, cfg, kube, m, plan.groups, nodes)
+			if err != nil {
+				return nil, nil, withCategory(errKubernetes, fmt.Errorf("failed to map Node addresses in %s: %w", kube.name, err))
+			}
+			for _, group := range published {
+				desired = append(desired, desiredSlice{m: m, cluster: kube.name, name: group.name, addrs: group.addrs})
+			}
+		}
+	}
+	return mappings, desired, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const probeTimeout = 10 * time.Second
+
+// probeTLSConfig returns the TLS configuration for probes: the system roots
+// plus the certificates in caFile, or no verification when insecure.
+func probeTLSConfig(caFile string, insecure bool) (*tls.Config, error) {
+	if insecure {
+		return &tls.Config{InsecureSkipVerify: true}, nil
+	}
+	if caFile == "" {
+		return &tls.Config{}, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read CA file: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in CA file %s", caFile)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+// probeServiceURLs requests the URL of every address the configured mappings
+// would publish, before Node addresses are mapped, connecting to the published IP and port, and logs whether it
+// answered. Any HTTP response counts, and redirects are not followed, since
+// standby dashboards redirect to the active mgr. It returns whether any
+// address could not be reached.
+func probeServiceURLs(ctx context.Context, cfg config, conn discoverer, tlsConfig *tls.Config) (bool, error) {
+	_, desired, err := desiredSlices(ctx, cfg, conn, nil)
+	if err != nil {
+		return false, err
+	}
+	unreachable := false
+	seen := make(map[string]bool)
+	for _, d := range desired {
+		for _, addr := range d.addrs {
+			target := net.JoinHostPort(addr.ip.String(), strconv.Itoa(int(addr.port)))
+			if seen[addr.url+" "+target] {
+				continue
+			}
+			seen[addr.url+" "+target] = true
+			attrs := []any{"module", d.m.module, "url", addr.url, "address", target}
+			status, err := probeURL(ctx, addr.url, target, tlsConfig)
+			var verifyErr *tls.CertificateVerificationError
+			switch {
+			case errors.As(err, &verifyErr):
+				slog.Warn("service URL certificate not trusted", append(attrs, "error", verifyErr.Err)...)
+			case err != nil:
+				slog.Warn("service URL unreachable", append(attrs, "error", err)...)
+			default:
+				slog.Info("service URL reachable", append(attrs, "status", status)...)
+				continue
+			}
+			unreachable = true
+		}
+	}
+	return unreachable, nil
+}
+
+// probeURL sends a GET request for rawURL to target and returns the response
+// status.
+func probeURL(ctx context.Context, rawURL, target string, tlsConfig *tls.Config) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	dialer := &net.Dialer{}
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, target)
+			},
+			TLSClientConfig:   tlsConfig,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
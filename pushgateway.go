@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pushMetrics replaces the metrics of the job on the Pushgateway with those
+// of a --once run: its duration, outcome and published endpoints, and the
+// controller metrics it gathered. Runtime and process metrics are left out,
+// since they describe a process that is about to exit.
+func pushMetrics(ctx context.Context, cfg pushgatewayConfig, state *runState, duration time.Duration) error {
+	success := 0.0
+	if state.succeeded {
+		success = 1
+	}
+	published := &metricFamily{name: "ceph_mgr_endpoint_controller_published_endpoint_info", help: "Addresses published for a mapping by the last one-shot run.", typ: "gauge"}
+	for _, key := range slices.Sorted(maps.Keys(state.published)) {
+		for _, group := range state.published[key] {
+			for _, addr := range group.addrs {
+				published.add(1, "mapping", key, "slice", group.name, "ip", addr.ip.String(), "port", strconv.Itoa(int(addr.port)))
+			}
+		}
+	}
+	var b strings.Builder
+	writeExposition(&b, append(controllerMetrics(),
+		singleSample("ceph_mgr_endpoint_controller_last_run_duration_seconds", "Duration of the last one-shot run.", "gauge", duration.Seconds()),
+		singleSample("ceph_mgr_endpoint_controller_last_run_success", "Whether the last one-shot run succeeded.", "gauge", success),
+		singleSample("ceph_mgr_endpoint_controller_last_run_changes", "Objects and Ceph settings the last one-shot run changed.", "gauge", float64(state.changes)),
+		singleSample("ceph_mgr_endpoint_controller_last_run_timestamp_seconds", "When the last one-shot run finished.", "gauge", float64(time.Now().Unix())),
+		published,
+	))
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, cfg.url+"/metrics/job/"+url.PathEscape(cfg.job), strings.NewReader(b.String()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("push metrics: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("push metrics: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+// permission is an RBAC rule the controller needs, cluster-wide when
+// namespace is empty.
+type permission struct {
+	namespace   string
+	group       string
+	resource    string
+	subresource string
+	verbs       []string
+}
+
+func (p permission) resourceName() string {
+	if p.subresource != "" {
+		return p.resource + "/" + p.subresource
+	}
+	return p.resource
+}
+
+// requiredPermissions lists the permissions the controller needs for cfg,
+// mirroring the chart's Roles.
+func requiredPermissions(cfg config) []permission {
+	var perms []permission
+	add := func(namespace, group, resource, subresource string, verbs ...string) {
+		for i, p := range perms {
+			if p.namespace == namespace && p.group == group && p.resource == resource && p.subresource == subresource {
+				for _, verb := range verbs {
+					if !slices.Contains(p.verbs, verb) {
+						perms[i].verbs = append(perms[i].verbs, verb)
+					}
+				}
+				return
+			}
+		}
+		perms = append(perms, permission{namespace: namespace, group: group, resource: resource, subresource: subresource, verbs: verbs})
+	}
+	for _, namespace := range cfg.mappingNamespaces() {
+		add(namespace, "", "services", "", "get", "list", "watch", "patch")
+		add(namespace, "discovery.k8s.io", "endpointslices", "", "get", "list", "watch", "create", "patch", "delete")
+		add(namespace, "", "events", "", "create", "patch")
+		if cfg.restfulSecret != "" {
+			add(namespace, "", "secrets", "", "get", "create", "patch")
+		}
+		if cfg.serviceExport {
+			add(namespace, "multicluster.x-k8s.io", "serviceexports", "", "get", "create", "patch")
+		}
+		if cfg.route.termination != "" {
+			add(namespace, "route.openshift.io", "routes", "", "get", "create", "patch")
+			add(namespace, "route.openshift.io", "routes", "custom-host", "create", "update")
+		}
+		if cfg.traefik.host != "" {
+			resource := "ingressroutes"
+			if cfg.traefik.passthrough {
+				resource = "ingressroutetcps"
+			}
+			add(namespace, "traefik.io", resource, "", "get", "create", "patch")
+		}
+		if cfg.scrapeConfig.jobName != "" {
+			add(namespace, "", "configmaps", "", "get", "create", "patch")
+		}
+		if cfg.vmScrape.enabled {
+			add(namespace, "operator.victoriametrics.com", "vmservicescrapes", "", "get", "create", "patch")
+		}
+		if cfg.grafana.enabled {
+			add(namespace, "grafana.integreatly.org", "grafanadatasources", "", "get", "create", "patch")
+		}
+		if slices.Contains(cfg.crdNamespaces, namespace) {
+			add(namespace, "ceph.io", "cephmgrendpoints", "", "get", "list", "watch")
+			add(namespace, "ceph.io", "cephmgrendpoints", "status", "get", "patch", "update")
+		}
+	}
+	if cfg.moduleTargets != "" || cfg.statusConfigMap != "" || cfg.serviceURLs != "" {
+		add(cfg.namespace, "", "configmaps", "", "get", "create", "patch")
+	}
+	if cfg.shards > 0 {
+		add(cfg.namespace, "coordination.k8s.io", "leases", "", "get", "list", "create", "update", "delete")
+	}
+	if cfg.heartbeatLease != "" {
+		add(cfg.namespace, "coordination.k8s.io", "leases", "", "get", "create", "patch")
+	}
+	if cfg.nodeAddresses {
+		add("", "", "nodes", "", "list")
+	}
+	if cfg.cleanupOnExit {
+		for i, p := range perms {
+			if p.resource != "events" && p.subresource == "" && slices.Contains(p.verbs, "create") && !slices.Contains(p.verbs, "delete") {
+				perms[i].verbs = append(perms[i].verbs, "delete")
+			}
+		}
+	}
+	return perms
+}
+
+// missingPermissions asks the API server which of perms the controller's
+// identity lacks, returning only the missing verbs.
+func missingPermissions(ctx context.Context, clientset kubernetes.Interface, perms []permission) ([]permission, error) {
+	var missing []permission
+	for _, p := range perms {
+		var verbs []string
+		for _, verb := range p.verbs {
+			review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Namespace:   p.namespace,
+						Verb:        verb,
+						Group:       p.group,
+						Resource:    p.resource,
+						Subresource: p.subresource,
+					},
+				},
+			}, metav1.CreateOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("review %s %s in %s: %w", verb, p.resourceName(), p.namespace, err)
+			}
+			if !review.Status.Allowed {
+				verbs = append(verbs, verb)
+			}
+		}
+		if len(verbs) > 0 {
+			p.verbs = verbs
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
+
+// checkRBAC reports the permissions missing in every cluster. It returns
+// whether any are missing.
+func checkRBAC(ctx context.Context, cfg config, out io.Writer) (bool, error) {
+	perms := requiredPermissions(cfg)
+	gaps := false
+	for _, cl := range cfg.clusters {
+		config, err := restConfig(cfg, cl)
+		if err != nil {
+			return false, fmt.Errorf("cluster %s: %w", cl.name, err)
+		}
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return false, fmt.Errorf("cluster %s: create clientset: %w", cl.name, err)
+		}
+		missing, err := missingPermissions(ctx, clientset, perms)
+		if err != nil {
+			return false, fmt.Errorf("cluster %s: %w", cl.name, err)
+		}
+		for _, p := range missing {
+			slog.Warn("missing RBAC permission", "cluster", cl.name, "namespace", p.namespace, "resource", p.resourceName(), "verbs", p.verbs)
+		}
+		if len(missing) == 0 {
+			slog.Info("RBAC permissions complete", "cluster", cl.name, "rules", len(perms))
+			continue
+		}
+		gaps = true
+		if out == nil {
+			continue
+		}
+		review, err := clientset.AuthenticationV1().SelfSubjectReviews().Create(ctx, &authenticationv1.SelfSubjectReview{}, metav1.CreateOptions{})
+		if err != nil {
+			return false, fmt.Errorf("cluster %s: review identity: %w", cl.name, err)
+		}
+		fmt.Fprintf(out, "# cluster: %s\n", cl.name)
+		if err := writeRBACManifest(out, missing, review.Status.UserInfo.Username); err != nil {
+			return false, err
+		}
+	}
+	return gaps, nil
+}
+
+// writeRBACManifest writes a Role and RoleBinding per namespace granting the
+// missing permissions to username, and a ClusterRole and ClusterRoleBinding
+// for cluster-wide ones.
+func writeRBACManifest(out io.Writer, missing []permission, username string) error {
+	subject := rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: username}
+	if parts := strings.Split(username, ":"); len(parts) == 4 && parts[0] == "system" && parts[1] == "serviceaccount" {
+		subject = rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Namespace: parts[2], Name: parts[3]}
+	}
+	name := fieldManager + "-rbac-gaps"
+	var namespaces []string
+	for _, p := range missing {
+		if !slices.Contains(namespaces, p.namespace) {
+			namespaces = append(namespaces, p.namespace)
+		}
+	}
+	for _, namespace := range namespaces {
+		roleKind, bindingKind := "Role", "RoleBinding"
+		if namespace == "" {
+			roleKind, bindingKind = "ClusterRole", "ClusterRoleBinding"
+		}
+		role := rbacv1.Role{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: roleKind},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		}
+		for _, p := range missing {
+			if p.namespace == namespace {
+				role.Rules = append(role.Rules, rbacv1.PolicyRule{APIGroups: []string{p.group}, Resources: []string{p.resourceName()}, Verbs: p.verbs})
+			}
+		}
+		binding := rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: bindingKind},
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: roleKind, Name: name},
+			Subjects:   []rbacv1.Subject{subject},
+		}
+		for _, obj := range []any{role, binding} {
+			data, err := yaml.Marshal(obj)
+			if err != nil {
+				return fmt.Errorf("encode manifest: %w", err)
+			}
+			fmt.Fprintf(out, "---\n%s", data)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+// recordedCommand is one Ceph command and its outcome, stored as a JSON line.
+type recordedCommand struct {
+	Kind     string          `json:"kind"`
+	Request  json.RawMessage `json:"request"`
+	Response string          `json:"response"`
+	Info     string          `json:"info,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+func (c recordedCommand) key() string {
+	return c.Kind + " " + string(c.Request)
+}
+
+// recordingConn passes commands to conn and appends every request and its
+// raw response to a file.
+type recordingConn struct {
+	conn discoverer
+	mu   sync.Mutex
+	file *os.File
+}
+
+func newRecordingConn(conn discoverer, path string) (*recordingConn, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("open Ceph recording: %w", err)
+	}
+	return &recordingConn{conn: conn, file: file}, nil
+}
+
+func (r *recordingConn) record(kind string, request []byte, response []byte, info string, err error) {
+	entry := recordedCommand{Kind: kind, Request: request, Response: string(response), Info: info}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if !json.Valid(request) {
+		entry.Request, _ = json.Marshal(string(request))
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		r.mu.Lock()
+		_, err = r.file.Write(append(line, '\n'))
+		r.mu.Unlock()
+	}
+	if err != nil {
+		slog.Warn("failed to record Ceph command", "kind", kind, "error", err)
+	}
+}
+
+func (r *recordingConn) MonCommand(args []byte) ([]byte, string, error) {
+	buf, info, err := r.conn.MonCommand(args)
+	r.record("mon", args, buf, info, err)
+	return buf, info, err
+}
+
+func (r *recordingConn) MgrCommand(args [][]byte) ([]byte, string, error) {
+	buf, info, err := r.conn.MgrCommand(args)
+	for _, arg := range args {
+		r.record("mgr", arg, buf, info, err)
+	}
+	return buf, info, err
+}
+
+// replayConn answers commands from a recording. Repeated requests get the
+// recorded responses in order, and the last one once they run out, so a
+// recording spanning several reconciles replays them in sequence.
+type replayConn struct {
+	mu        sync.Mutex
+	responses map[string][]recordedCommand
+}
+
+func newReplayConn(path string) (*replayConn, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open Ceph recording: %w", err)
+	}
+	defer file.Close()
+	r := &replayConn{responses: make(map[string][]recordedCommand)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var entry recordedCommand
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("parse Ceph recording line %d: %w", line, err)
+		}
+		r.responses[entry.key()] = append(r.responses[entry.key()], entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read Ceph recording: %w", err)
+	}
+	return r, nil
+}
+
+func (r *replayConn) replay(kind string, request []byte) ([]byte, string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := recordedCommand{Kind: kind, Request: request}.key()
+	queue := r.responses[key]
+	if len(queue) == 0 {
+		return nil, "", fmt.Errorf("%s command not in Ceph recording: %s", kind, request)
+	}
+	entry := queue[0]
+	if len(queue) > 1 {
+		r.responses[key] = queue[1:]
+	}
+	if entry.Error != "" {
+		return nil, entry.Info, errors.New(entry.Error)
+	}
+	return []byte(entry.Response), entry.Info, nil
+}
+
+func (r *replayConn) MonCommand(args []byte) ([]byte, string, error) {
+	return r.replay("mon", args)
+}
+
+func (r *replayConn) MgrCommand(args [][]byte) ([]byte, string, error) {
+	if len(args) != 1 {
+		return nil, "", fmt.Errorf("expected one command, got %d", len(args))
+	}
+	return r.replay("mgr", args[0])
+}
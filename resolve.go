@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+)
+
+// hostResolver resolves hostnames in mgr service URLs. Go's resolver does
+// not expose record TTLs, so addresses are cached for a configured ttl and
+// resolved again once it expires. It lives in runState rather than config,
+// so that the cache survives configuration reloads.
+type hostResolver struct {
+	resolveConfig
+	resolver *net.Resolver
+	cache    map[string]resolvedHost
+}
+
+type resolvedHost struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// newHostResolver returns a resolver for cfg that queries the DNS server at
+// cfg.address, or the system resolver when it is empty. It returns nil when
+// resolving is not enabled.
+func newHostResolver(cfg resolveConfig) *hostResolver {
+	if !cfg.enabled {
+		return nil
+	}
+	resolver := &net.Resolver{}
+	if cfg.address != "" {
+		resolver.PreferGo = true
+		resolver.Dial = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, cfg.address)
+		}
+	}
+	return &hostResolver{resolveConfig: cfg, resolver: resolver, cache: make(map[string]resolvedHost)}
+}
+
+// reset forgets every cached hostname.
+func (r *hostResolver) reset() {
+	clear(r.cache)
+}
+
+// lookup returns the addresses of host in a stable order, preferred family
+// first, from the cache while they are fresh.
+func (r *hostResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if entry, ok := r.cache[host]; ok && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+	return r.resolve(ctx, host)
+}
+
+func (r *hostResolver) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	addrs, err := r.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("resolve %s: no addresses", host)
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	slices.SortFunc(ips, func(a, b net.IP) int { return bytes.Compare(a.To16(), b.To16()) })
+	if r.prefer != "" {
+		slices.SortStableFunc(ips, func(a, b net.IP) int { return cmp.Compare(r.rank(a), r.rank(b)) })
+	}
+	ips = preferNetworks(ips, r.networks)
+	r.cache[host] = resolvedHost{ips: ips, expires: time.Now().Add(r.ttl)}
+	slog.DebugContext(ctx, "resolved mgr hostname", "host", host, "addresses", ips)
+	return ips, nil
+}
+
+// rank orders addresses of the preferred family before the others.
+func (r *hostResolver) rank(ip net.IP) int {
+	if (ip.To4() != nil) == (r.prefer == "ipv4") {
+		return 0
+	}
+	return 1
+}
+
+// refresh resolves the cached hostnames whose addresses have expired again,
+// and reports whether any of them changed or failed to resolve.
+func (r *hostResolver) refresh(ctx context.Context) bool {
+	changed := false
+	now := time.Now()
+	for host, entry := range r.cache {
+		if now.Before(entry.expires) {
+			continue
+		}
+		ips, err := r.resolve(ctx, host)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to resolve mgr hostname", "host", host, "error", err)
+			delete(r.cache, host)
+			changed = true
+			continue
+		}
+		if !slices.EqualFunc(ips, entry.ips, net.IP.Equal) {
+			slog.InfoContext(ctx, "mgr hostname addresses changed", "host", host, "before", entry.ips, "after", ips)
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+type restfulKeyCommand struct {
+	Prefix  string `json:"prefix"`
+	KeyName string `json:"key_name"`
+}
+
+var restfulListKeysCommand = monCommand{Prefix: "restful list-keys", Format: "json"}
+
+// getRestfulKey returns the restful module API key for user, creating it
+// when it does not exist yet.
+func getRestfulKey(conn discoverer, user string) (string, error) {
+	buf, err := execMgrCommand(conn, restfulListKeysCommand)
+	if err != nil {
+		return "", fmt.Errorf("list keys: %w", err)
+	}
+
+	var keys map[string]string
+	if err := json.Unmarshal(buf, &keys); err != nil {
+		return "", fmt.Errorf("unmarshal response: %w", err)
+	}
+	if key, ok := keys[user]; ok {
+		return key, nil
+	}
+
+	buf, err = execMgrCommand(conn, restfulKeyCommand{Prefix: "restful create-key", KeyName: user})
+	if err != nil {
+		return "", fmt.Errorf("create key: %w", err)
+	}
+	key := strings.TrimSpace(string(buf))
+	if key == "" {
+		return "", fmt.Errorf("create key: empty response")
+	}
+	slog.Info("created restful API key", "user", user)
+	return key, nil
+}
+
+func updateRestfulSecret(ctx context.Context, kube *kubeClient, namespace, name string, data map[string][]byte) error {
+	secrets := kube.clientset.CoreV1().Secrets(namespace)
+
+	existing, err := secrets.Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("get Secret: %w", err)
+	}
+	if err == nil && maps.EqualFunc(existing.Data, data, bytes.Equal) {
+		slog.DebugContext(ctx, "Secret already up-to-date", "cluster", kube.name, "namespace", namespace, "name", name)
+		return nil
+	}
+
+	secret := corev1apply.Secret(name, namespace).
+		WithLabels(map[string]string{
+			"app.kubernetes.io/managed-by": fieldManager,
+		}).
+		WithType(corev1.SecretTypeOpaque).
+		WithData(data)
+	var before map[string][]byte
+	if existing != nil {
+		before = existing.Data
+	}
+	_, err = secrets.Apply(ctx, secret, metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+	auditMutation(kube, "apply", "secrets", namespace, name, fieldManager, changedKeys(before, data, bytes.Equal), err)
+	if err != nil {
+		return fmt.Errorf("apply Secret: %w", err)
+	}
+
+	slog.InfoContext(ctx, "applied restful API key Secret", "cluster", kube.name, "namespace", namespace, "name", name, "user", string(data["username"]))
+	return nil
+}
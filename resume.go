@@ -0,0 +1,105 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"time"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// seedRunState fills the state of a starting controller from the
+// EndpointSlices it published before, so that its first reconcile starts
+// from what the clusters hold: the published endpoints of each configured
+// mapping and, with skipUnchanged, the fingerprint every slice was last
+// applied under. The fingerprint is only taken when all mappings have slices
+// and they agree on it, since a slice that was not rewritten by the last
+// reconcile carries an older one.
+func seedRunState(ctx context.Context, cfg config, kubes []*kubeClient, state *runState) {
+	hashes := make(map[string]bool)
+	complete := true
+	for _, kube := range kubes {
+		for _, m := range cfg.mappings {
+			if m.disabled {
+				continue
+			}
+			existing, err := kube.listEndpointSlices(ctx, m.namespace, labels.Set{managedByLabel: fieldManager, sliceGroupLabel: m.slice}.AsSelector())
+			if err != nil {
+				slog.Warn("failed to list existing EndpointSlices", "cluster", kube.name, "namespace", m.namespace, "slice", m.slice, "error", err)
+				complete = false
+				continue
+			}
+			slog.Info("loaded existing EndpointSlices", "cluster", kube.name, "namespace", m.namespace, "slice", m.slice, "count", len(existing))
+			if len(existing) == 0 {
+				complete = false
+				continue
+			}
+			for _, slice := range existing {
+				hashes[slice.Annotations[servicesHashAnnotation]] = true
+			}
+			// Slices carry Node addresses rather than the discovered ones
+			// when those are mapped.
+			if _, ok := state.published[stateKey(m)]; ok || cfg.nodeAddresses {
+				continue
+			}
+			if groups := sliceGroups(m, existing); len(groups) > 0 {
+				if state.published == nil {
+					state.published = make(map[string][]endpointGroup)
+				}
+				state.published[stateKey(m)] = groups
+			}
+		}
+	}
+	if cfg.skipUnchanged && complete && len(hashes) == 1 {
+		for hash := range hashes {
+			state.lastHash = hash
+		}
+	}
+}
+
+// sliceGroups returns the endpoint groups that the existing slices of m
+// publish, as endpointSliceApply wrote them. Only the first address of a
+// group has its URL, which is all a slice records.
+func sliceGroups(m mapping, existing []*discoveryv1.EndpointSlice) []endpointGroup {
+	var groups []endpointGroup
+	for _, slice := range existing {
+		if slice.Labels["kubernetes.io/service-name"] != m.serviceName {
+			continue
+		}
+		var port int32
+		var extraPorts map[string]int32
+		for _, p := range slice.Ports {
+			if p.Name == nil || p.Port == nil {
+				continue
+			}
+			if *p.Name == m.module {
+				port = *p.Port
+				continue
+			}
+			if extraPorts == nil {
+				extraPorts = make(map[string]int32)
+			}
+			extraPorts[*p.Name] = *p.Port
+		}
+		staleSince, _ := time.Parse(time.RFC3339, slice.Annotations[staleAnnotation])
+		group := endpointGroup{name: slice.Name}
+		for _, endpoint := range slice.Endpoints {
+			for _, address := range endpoint.Addresses {
+				if ip := net.ParseIP(address); ip != nil {
+					group.addrs = append(group.addrs, &endpointAddress{ip: ip, port: port, path: slice.Annotations[urlPrefixAnnotation], extraPorts: extraPorts, staleSince: staleSince})
+				}
+			}
+		}
+		if len(group.addrs) == 0 {
+			continue
+		}
+		group.addrs[0].url = slice.Annotations[urlAnnotation]
+		groups = append(groups, group)
+	}
+	slices.SortFunc(groups, func(a, b endpointGroup) int { return cmp.Compare(a.name, b.name) })
+	return groups
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// fullResyncDue reports whether the reconcile at now should be a full resync
+// and schedules the next one. The first is due a full interval after the
+// controller started.
+func fullResyncDue(cfg config, state *runState, now time.Time) bool {
+	if cfg.fullResync == 0 {
+		return false
+	}
+	if state.nextResync.IsZero() {
+		state.nextResync = now.Add(cfg.fullResync)
+		return false
+	}
+	if now.Before(state.nextResync) {
+		return false
+	}
+	state.nextResync = now.Add(cfg.fullResync)
+	return true
+}
+
+// startFullResync makes the current reconcile re-apply the desired state of
+// every mapping and global object, regardless of the unchanged-data hash,
+// per-mapping intervals and the informer cache. The returned function ends
+// the resync.
+func startFullResync(kubes []*kubeClient, state *runState) func() {
+	slog.Info("starting full resync")
+	state.lastHash = ""
+	state.due = nil
+	state.globalDue = time.Time{}
+	for _, kube := range kubes {
+		kube.forceApply = true
+	}
+	return func() {
+		for _, kube := range kubes {
+			kube.forceApply = false
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// retryPolicy describes how often a failing operation is attempted within a
+// single reconcile before the error is returned.
+type retryPolicy struct {
+	initialDelay time.Duration
+	multiplier   float64
+	maxDelay     time.Duration
+	maxAttempts  int
+}
+
+// defaultRetryPolicy attempts every operation once, leaving retries to the
+// next tick.
+var defaultRetryPolicy = retryPolicy{
+	initialDelay: time.Second,
+	multiplier:   2,
+	maxDelay:     30 * time.Second,
+	maxAttempts:  1,
+}
+
+// do calls fn until it succeeds, the attempts are exhausted or ctx is done,
+// sleeping with exponential backoff between attempts. Forbidden errors are
+// not retried since they will not resolve within a reconcile.
+func (p retryPolicy) do(ctx context.Context, fn func() error) error {
+	delay := p.initialDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.maxAttempts || errors.IsForbidden(err) {
+			return err
+		}
+		slog.WarnContext(ctx, "operation failed, retrying", "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(time.Duration(float64(delay)*p.multiplier), p.maxDelay)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var routeResource = schema.GroupVersionResource{Group: "route.openshift.io", Version: "v1", Resource: "routes"}
+
+// routeSpec builds the OpenShift Route spec exposing the mapping's Service.
+func routeSpec(cfg routeConfig, m mapping) map[string]any {
+	tls := map[string]any{
+		"termination":                   cfg.termination,
+		"insecureEdgeTerminationPolicy": "Redirect",
+	}
+	if cfg.destinationCA != "" {
+		tls["destinationCACertificate"] = cfg.destinationCA
+	}
+	spec := map[string]any{
+		"to": map[string]any{
+			"kind":   "Service",
+			"name":   m.serviceName,
+			"weight": int64(100),
+		},
+		"port": map[string]any{
+			"targetPort": m.module,
+		},
+		"tls": tls,
+	}
+	if cfg.host != "" {
+		spec["host"] = cfg.host
+	}
+	return spec
+}
+
+// applyRoute creates or updates an OpenShift Route named after the mapping's
+// Service. The host assigned by OpenShift is kept when none is configured.
+func applyRoute(ctx context.Context, kube *kubeClient, cfg routeConfig, m mapping) error {
+	applied, err := applyGeneratedObject(ctx, kube, routeResource, "Route", m.namespace, m.serviceName, routeSpec(cfg, m))
+	if err != nil {
+		return err
+	}
+	if applied {
+		slog.InfoContext(ctx, "applied Route", "cluster", kube.name, "namespace", m.namespace, "name", m.serviceName, "host", cfg.host, "termination", cfg.termination)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// userHZ is the unit of the CPU times in /proc, fixed at 100 on Linux.
+const userHZ = 100
+
+// runtimeMetrics returns the Go runtime metrics under the names the
+// Prometheus Go client uses, so existing dashboards work unchanged.
+func runtimeMetrics() []*metricFamily {
+	var families []*metricFamily
+	gauge := func(name, help string, value float64) {
+		families = append(families, singleSample(name, help, "gauge", value))
+	}
+	counter := func(name, help string, value float64) {
+		families = append(families, singleSample(name, help, "counter", value))
+	}
+
+	info := &metricFamily{name: "go_info", help: "Information about the Go environment.", typ: "gauge"}
+	info.add(1, "version", runtime.Version())
+	families = append(families, info)
+	gauge("go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	threads, _ := runtime.ThreadCreateProfile(nil)
+	gauge("go_threads", "Number of OS threads created.", float64(threads))
+
+	var gc debug.GCStats
+	gc.PauseQuantiles = make([]time.Duration, 5)
+	debug.ReadGCStats(&gc)
+	pauses := &metricFamily{name: "go_gc_duration_seconds", help: "A summary of the pause duration of garbage collection cycles.", typ: "summary"}
+	for i, q := range []string{"0", "0.25", "0.5", "0.75", "1"} {
+		pauses.add(gc.PauseQuantiles[i].Seconds(), "quantile", q)
+	}
+	pauses.addSample(pauses.name+"_sum", gc.PauseTotal.Seconds())
+	pauses.addSample(pauses.name+"_count", float64(gc.NumGC))
+	families = append(families, pauses)
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	gauge("go_memstats_alloc_bytes", "Number of bytes allocated in heap and currently in use.", float64(mem.Alloc))
+	counter("go_memstats_alloc_bytes_total", "Total number of bytes allocated in heap until now, even if released already.", float64(mem.TotalAlloc))
+	gauge("go_memstats_sys_bytes", "Number of bytes obtained from system.", float64(mem.Sys))
+	gauge("go_memstats_heap_alloc_bytes", "Number of heap bytes allocated and currently in use.", float64(mem.HeapAlloc))
+	gauge("go_memstats_heap_inuse_bytes", "Number of heap bytes that are in use.", float64(mem.HeapInuse))
+	gauge("go_memstats_heap_idle_bytes", "Number of heap bytes waiting to be used.", float64(mem.HeapIdle))
+	gauge("go_memstats_heap_released_bytes", "Number of heap bytes released to OS.", float64(mem.HeapReleased))
+	gauge("go_memstats_heap_sys_bytes", "Number of heap bytes obtained from system.", float64(mem.HeapSys))
+	gauge("go_memstats_heap_objects", "Number of currently allocated objects.", float64(mem.HeapObjects))
+	gauge("go_memstats_stack_inuse_bytes", "Number of bytes in use by the stack allocator.", float64(mem.StackInuse))
+	counter("go_memstats_mallocs_total", "Total number of heap objects allocated.", float64(mem.Mallocs))
+	counter("go_memstats_frees_total", "Total number of heap objects frees.", float64(mem.Frees))
+	gauge("go_memstats_next_gc_bytes", "Number of heap bytes when next garbage collection will take place.", float64(mem.NextGC))
+	gauge("go_memstats_last_gc_time_seconds", "Number of seconds since 1970 of last garbage collection.", float64(mem.LastGC)/1e9)
+	return families
+}
+
+// processMetrics returns the process metrics under the names the Prometheus
+// Go client uses. They are read from /proc and left out where it is not
+// available.
+func processMetrics() []*metricFamily {
+	var families []*metricFamily
+	gauge := func(name, help string, value float64) {
+		families = append(families, singleSample(name, help, "gauge", value))
+	}
+
+	if stat, err := readProcStat(); err == nil {
+		families = append(families, singleSample("process_cpu_seconds_total", "Total user and system CPU time spent in seconds.", "counter", stat.cpuSeconds))
+		gauge("process_virtual_memory_bytes", "Virtual memory size in bytes.", stat.virtualBytes)
+		gauge("process_resident_memory_bytes", "Resident memory size in bytes.", stat.residentBytes)
+		if stat.startTime > 0 {
+			gauge("process_start_time_seconds", "Start time of the process since unix epoch in seconds.", stat.startTime)
+		}
+	}
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		gauge("process_open_fds", "Number of open file descriptors.", float64(len(fds)))
+	}
+	var limit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit); err == nil {
+		gauge("process_max_fds", "Maximum number of open file descriptors.", float64(limit.Cur))
+	}
+	return families
+}
+
+type procStat struct {
+	cpuSeconds    float64
+	virtualBytes  float64
+	residentBytes float64
+	startTime     float64
+}
+
+// readProcStat reads CPU time, memory and start time from /proc/self/stat.
+func readProcStat() (procStat, error) {
+	data, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return procStat{}, err
+	}
+	// The command name in parentheses may contain spaces, so the fields
+	// are counted from after it, starting with the state as field 3.
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return procStat{}, fmt.Errorf("malformed /proc/self/stat")
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 22 {
+		return procStat{}, fmt.Errorf("malformed /proc/self/stat")
+	}
+	field := func(n int) float64 {
+		v, _ := strconv.ParseFloat(fields[n-3], 64)
+		return v
+	}
+	stat := procStat{
+		cpuSeconds:    (field(14) + field(15)) / userHZ,
+		virtualBytes:  field(23),
+		residentBytes: field(24) * float64(os.Getpagesize()),
+	}
+	if boot, err := bootTime(); err == nil {
+		stat.startTime = boot + field(22)/userHZ
+	}
+	return stat, nil
+}
+
+// bootTime returns the system boot time in seconds since the epoch.
+func bootTime() (float64, error) {
+	data, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, "btime "); ok {
+			return strconv.ParseFloat(strings.TrimSpace(value), 64)
+		}
+	}
+	return 0, fmt.Errorf("no btime in /proc/stat")
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+const scrapeConfigKey = "scrape_configs.yml"
+
+// scrapeConfigMapName returns the ConfigMap holding the scrape configuration
+// for a mapping's Service.
+func scrapeConfigMapName(m mapping) string {
+	return m.serviceName + "-scrape-config"
+}
+
+// scrapeConfigs renders a Prometheus scrape_configs fragment with a single
+// job scraping the mapping's Service by its cluster DNS name, so that it
+// keeps working across mgr failovers.
+func scrapeConfigs(ctx context.Context, kube *kubeClient, cfg scrapeConfig, m mapping, addr *endpointAddress) (string, error) {
+	target, err := serviceHostPort(ctx, kube, m, addr)
+	if err != nil {
+		return "", err
+	}
+
+	job := map[string]any{
+		"job_name":     cfg.jobName,
+		"honor_labels": true,
+		"static_configs": []any{map[string]any{
+			"targets": []any{target},
+		}},
+	}
+	if strings.HasPrefix(addr.url, "https://") {
+		job["scheme"] = "https"
+		tls := map[string]any{}
+		if cfg.caFile != "" {
+			tls["ca_file"] = cfg.caFile
+		}
+		if cfg.insecure {
+			tls["insecure_skip_verify"] = true
+		}
+		if len(tls) > 0 {
+			job["tls_config"] = tls
+		}
+	}
+	data, err := yaml.Marshal([]any{job})
+	if err != nil {
+		return "", fmt.Errorf("encode scrape config: %w", err)
+	}
+	return string(data), nil
+}
+
+// updateScrapeConfig maintains a ConfigMap next to the mapping's Service with
+// a scrape_configs fragment for Prometheus installations without the
+// operator.
+func updateScrapeConfig(ctx context.Context, kube *kubeClient, cfg scrapeConfig, m mapping, addr *endpointAddress) error {
+	fragment, err := scrapeConfigs(ctx, kube, cfg, m, addr)
+	if err != nil {
+		return err
+	}
+
+	name := scrapeConfigMapName(m)
+	configMaps := kube.clientset.CoreV1().ConfigMaps(m.namespace)
+	existing, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("get ConfigMap: %w", err)
+	}
+	if err == nil && existing.Data[scrapeConfigKey] == fragment {
+		return nil
+	}
+
+	configMap := corev1apply.ConfigMap(name, m.namespace).
+		WithLabels(map[string]string{
+			"app.kubernetes.io/managed-by": fieldManager,
+		}).
+		WithData(map[string]string{scrapeConfigKey: fragment})
+	_, err = configMaps.Apply(ctx, configMap, metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+	auditMutation(kube, "apply", "configmaps", m.namespace, name, fieldManager, []any{"keys", []string{scrapeConfigKey}}, err)
+	if err != nil {
+		return fmt.Errorf("apply ConfigMap: %w", err)
+	}
+	slog.InfoContext(ctx, "applied scrape config ConfigMap", "cluster", kube.name, "namespace", m.namespace, "name", name)
+	return nil
+}
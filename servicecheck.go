@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// checkServices verifies the Service of every mapping, configured or
+// discovered, in every cluster: that it exists, has no selector, since the EndpointSlice
+// controller then publishes the Pods it selects alongside the controller's
+// endpoints, is not an ExternalName Service, and has a port named after every
+// port the controller would publish for it, which is how traffic to a Service
+// without a selector finds its EndpointSlice ports. It returns whether any
+// Service has a problem.
+func checkServices(ctx context.Context, cfg config, conn discoverer, kubes []*kubeClient) (bool, error) {
+	mappings, desired, err := desiredSlices(ctx, cfg, conn, kubes)
+	if err != nil {
+		return false, err
+	}
+	problems := false
+	for _, kube := range kubes {
+		for _, m := range mappings {
+			if m.disabled || !m.appliesTo(kube.name) {
+				continue
+			}
+			attrs := []any{"cluster", kube.name, "namespace", m.namespace, "service", m.serviceName}
+			svc, err := kube.getService(ctx, m.namespace, m.serviceName)
+			if errors.IsNotFound(err) {
+				slog.Warn("Service missing", attrs...)
+				problems = true
+				continue
+			}
+			if err != nil {
+				return false, fmt.Errorf("cluster %s: get Service %s/%s: %w", kube.name, m.namespace, m.serviceName, err)
+			}
+
+			ok := true
+			if len(svc.Spec.Selector) > 0 {
+				slog.Warn("Service has a selector", append(attrs, "selector", svc.Spec.Selector)...)
+				ok = false
+			}
+			if svc.Spec.Type == corev1.ServiceTypeExternalName {
+				slog.Warn("Service is of type ExternalName and ignores EndpointSlices", attrs...)
+				ok = false
+			}
+			var names []string
+			for _, d := range desired {
+				if d.cluster != kube.name || d.m.namespace != m.namespace || d.m.slice != m.slice {
+					continue
+				}
+				for _, addr := range d.addrs {
+					for _, port := range endpointPorts(d.m, addr) {
+						if slices.Contains(names, *port.Name) {
+							continue
+						}
+						names = append(names, *port.Name)
+						if !slices.ContainsFunc(svc.Spec.Ports, func(p corev1.ServicePort) bool {
+							return p.Name == *port.Name && p.Protocol == *port.Protocol
+						}) {
+							slog.Warn("Service has no port matching EndpointSlice port", append(attrs, "name", *port.Name, "port", *port.Port, "protocol", *port.Protocol)...)
+							ok = false
+						}
+					}
+				}
+			}
+			if ok {
+				slog.Info("Service configuration valid", append(attrs, "ports", names)...)
+			} else {
+				problems = true
+			}
+		}
+	}
+	return problems, nil
+}
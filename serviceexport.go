@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var serviceExportResource = schema.GroupVersionResource{Group: "multicluster.x-k8s.io", Version: "v1alpha1", Resource: "serviceexports"}
+
+// ensureServiceExport creates a Multi-Cluster Services ServiceExport for the
+// mapping's Service so that it is reachable across the cluster set. An
+// existing export is left alone.
+func ensureServiceExport(ctx context.Context, kube *kubeClient, m mapping) error {
+	exports := kube.dynamic.Resource(serviceExportResource).Namespace(m.namespace)
+	_, err := exports.Get(ctx, m.serviceName, metav1.GetOptions{})
+	if err == nil {
+		return nil
+	}
+	if !errors.IsNotFound(err) {
+		return fmt.Errorf("get ServiceExport: %w", err)
+	}
+	export := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": serviceExportResource.GroupVersion().String(),
+		"kind":       "ServiceExport",
+		"metadata": map[string]any{
+			"name":      m.serviceName,
+			"namespace": m.namespace,
+			"labels": map[string]any{
+				"app.kubernetes.io/managed-by": fieldManager,
+			},
+		},
+	}}
+	_, err = exports.Apply(ctx, m.serviceName, export, metav1.ApplyOptions{FieldManager: fieldManager})
+	auditMutation(kube, "apply", "serviceexports", m.namespace, m.serviceName, fieldManager, nil, err)
+	if err != nil {
+		return fmt.Errorf("apply ServiceExport: %w", err)
+	}
+	slog.InfoContext(ctx, "created ServiceExport", "cluster", kube.name, "namespace", m.namespace, "name", m.serviceName)
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	mgrServiceAnnotation = "ceph.io/mgr-service"
+	sliceNameAnnotation  = "ceph.io/slice-name"
+)
+
+// discoverServiceMappings builds mappings from Services rather than the
+// configuration. For Services matching the selector, a port named after a mgr
+// module is published to the slice <service>-<port>. Services annotated with
+// ceph.io/mgr-service publish that module to the slice named by
+// ceph.io/slice-name, or <service>-<module> by default. Mappings that would
+// collide with a configured mapping are skipped.
+func discoverServiceMappings(ctx context.Context, cfg config, kubes []*kubeClient) ([]mapping, error) {
+	var mappings []mapping
+	add := func(kube *kubeClient, m mapping) {
+		if slices.ContainsFunc(cfg.mappings, func(c mapping) bool {
+			return c.namespace == m.namespace && c.slice == m.slice && c.appliesTo(kube.name)
+		}) {
+			slog.Warn("Service slice collides with a configured mapping, skipping", "cluster", kube.name, "namespace", m.namespace, "slice", m.slice)
+			return
+		}
+		if slices.ContainsFunc(mappings, func(c mapping) bool {
+			return c.namespace == m.namespace && c.slice == m.slice && c.cluster == m.cluster
+		}) {
+			return
+		}
+		mappings = append(mappings, m)
+	}
+
+	if cfg.selector.selector != "" {
+		selector, err := labels.Parse(cfg.selector.selector)
+		if err != nil {
+			return nil, fmt.Errorf("parse service selector: %w", err)
+		}
+		for _, kube := range kubes {
+			for _, namespace := range cfg.selector.namespaces {
+				services, err := kube.listServices(ctx, namespace, selector)
+				if err != nil {
+					return nil, fmt.Errorf("list Services in %s/%s: %w", kube.name, namespace, err)
+				}
+				for _, svc := range services {
+					for _, port := range svc.Spec.Ports {
+						if port.Name == "" {
+							continue
+						}
+						add(kube, serviceMapping(kube, svc, port.Name, svc.Name+"-"+port.Name))
+					}
+				}
+			}
+		}
+	}
+
+	for _, kube := range kubes {
+		for _, namespace := range cfg.watchNamespaces {
+			services, err := kube.listServices(ctx, namespace, labels.Everything())
+			if err != nil {
+				return nil, fmt.Errorf("list Services in %s/%s: %w", kube.name, namespace, err)
+			}
+			for _, svc := range services {
+				module := svc.Annotations[mgrServiceAnnotation]
+				if module == "" {
+					continue
+				}
+				slice := svc.Annotations[sliceNameAnnotation]
+				if slice == "" {
+					slice = svc.Name + "-" + module
+				}
+				if errs := validation.IsDNS1123Subdomain(slice); len(errs) > 0 {
+					slog.Warn("invalid slice name on annotated Service, skipping", "cluster", kube.name, "namespace", svc.Namespace, "service", svc.Name, "slice", slice, "error", strings.Join(errs, ", "))
+					kube.recorder.Eventf(svc, corev1.EventTypeWarning, "InvalidSliceName", "Invalid %s %q: %s", sliceNameAnnotation, slice, strings.Join(errs, ", "))
+					continue
+				}
+				add(kube, serviceMapping(kube, svc, module, slice))
+			}
+		}
+	}
+	return mappings, nil
+}
+
+func serviceMapping(kube *kubeClient, svc *corev1.Service, module, slice string) mapping {
+	return mapping{
+		module:      module,
+		namespace:   svc.Namespace,
+		serviceName: svc.Name,
+		slice:       slice,
+		cluster:     kube.name,
+		discovered:  true,
+	}
+}
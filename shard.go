@@ -0,0 +1,276 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	shardGroupLabel = "ceph.io/shard-group"
+	shardRoleLabel  = "ceph.io/shard-role"
+)
+
+// shardManager splits mappings between replicas. Each replica keeps a
+// member Lease alive and claims its fair share of the shard Leases, based on
+// the number of live members.
+type shardManager struct {
+	identity string
+	owned    map[int]bool
+}
+
+func newShardManager() (*shardManager, error) {
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("get hostname: %w", err)
+	}
+	return &shardManager{identity: identity}, nil
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func shardOf(key string, shards int) int {
+	return int(hashKey(key) % uint32(shards))
+}
+
+// owns reports whether this replica is responsible for publishing mapping m
+// into the named cluster.
+func (s *shardManager) owns(cfg config, m mapping, cluster string) bool {
+	if cfg.shards == 0 {
+		return true
+	}
+	key := m.key()
+	if cfg.shardBy == "cluster" {
+		key = cluster
+	}
+	return s.owned[shardOf(key, cfg.shards)]
+}
+
+// targets returns the clusters that mapping m publishes into and that this
+// replica is responsible for.
+func (s *shardManager) targets(cfg config, m mapping, kubes []*kubeClient) []*kubeClient {
+	var targets []*kubeClient
+	for _, kube := range kubes {
+		if m.appliesTo(kube.name) && s.owns(cfg, m, kube.name) {
+			targets = append(targets, kube)
+		}
+	}
+	return targets
+}
+
+// ownsGlobal reports whether this replica handles work that is not tied to
+// a mapping, such as mgr configuration and module targets.
+func (s *shardManager) ownsGlobal(cfg config) bool {
+	return cfg.shards == 0 || s.owned[0]
+}
+
+func leaseExpired(lease *coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity == "" {
+		return true
+	}
+	if lease.Spec.RenewTime == nil || lease.Spec.LeaseDurationSeconds == nil {
+		return true
+	}
+	return lease.Spec.RenewTime.Add(time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second).Before(now)
+}
+
+// sync renews the member Lease, then renews, releases and acquires shard
+// Leases so that this replica holds its fair share. It returns whether the
+// set of owned shards changed.
+func (s *shardManager) sync(ctx context.Context, kube *kubeClient, cfg config) (bool, error) {
+	client := kube.clientset.CoordinationV1().Leases(cfg.namespace)
+	now := time.Now()
+	duration := int32(cfg.leaseDuration / time.Second)
+
+	member := cfg.shardLease + "-member-" + s.identity
+	if err := s.claim(ctx, kube, cfg, member, "member", nil, now, duration); err != nil {
+		return false, fmt.Errorf("renew member Lease: %w", err)
+	}
+
+	list, err := client.List(ctx, metav1.ListOptions{LabelSelector: labels.Set{shardGroupLabel: cfg.shardLease}.String()})
+	if err != nil {
+		return false, fmt.Errorf("list Leases: %w", err)
+	}
+	members := 0
+	leases := make(map[string]*coordinationv1.Lease)
+	for i := range list.Items {
+		lease := &list.Items[i]
+		switch lease.Labels[shardRoleLabel] {
+		case "member":
+			if !leaseExpired(lease, now) {
+				members++
+			}
+		case "shard":
+			leases[lease.Name] = lease
+		}
+	}
+	fair := (cfg.shards + max(members, 1) - 1) / max(members, 1)
+
+	// Visit shards in an order unique to this replica so that concurrent
+	// replicas spread out instead of racing for the same Leases.
+	order := make([]int, cfg.shards)
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortFunc(order, func(a, b int) int {
+		return cmp.Compare(hashKey(s.identity+"/"+strconv.Itoa(a)), hashKey(s.identity+"/"+strconv.Itoa(b)))
+	})
+
+	owned := make(map[int]bool)
+	for _, i := range order {
+		lease := leases[shardLeaseName(cfg, i)]
+		if lease == nil || leaseExpired(lease, now) || *lease.Spec.HolderIdentity != s.identity {
+			continue
+		}
+		if len(owned) >= fair {
+			if err := s.release(ctx, kube, lease); err != nil {
+				slog.Warn("failed to release shard Lease", "lease", lease.Name, "error", err)
+			}
+			continue
+		}
+		if err := s.claim(ctx, kube, cfg, lease.Name, "shard", lease, now, duration); err != nil {
+			slog.Warn("failed to renew shard Lease", "lease", lease.Name, "error", err)
+			continue
+		}
+		owned[i] = true
+	}
+	for _, i := range order {
+		if len(owned) >= fair {
+			break
+		}
+		lease := leases[shardLeaseName(cfg, i)]
+		if owned[i] || (lease != nil && !leaseExpired(lease, now)) {
+			continue
+		}
+		if err := s.claim(ctx, kube, cfg, shardLeaseName(cfg, i), "shard", lease, now, duration); err != nil {
+			if !errors.IsConflict(err) && !errors.IsAlreadyExists(err) {
+				slog.Warn("failed to acquire shard Lease", "lease", shardLeaseName(cfg, i), "error", err)
+			}
+			continue
+		}
+		owned[i] = true
+	}
+
+	changed := len(owned) != len(s.owned)
+	for i := range owned {
+		changed = changed || !s.owned[i]
+	}
+	if changed {
+		slog.Info("shard ownership changed", "identity", s.identity, "shards", sortedShards(owned), "members", members)
+	}
+	s.owned = owned
+	return changed, nil
+}
+
+func shardLeaseName(cfg config, i int) string {
+	return cfg.shardLease + "-shard-" + strconv.Itoa(i)
+}
+
+func sortedShards(owned map[int]bool) []int {
+	var shards []int
+	for i := range owned {
+		shards = append(shards, i)
+	}
+	slices.Sort(shards)
+	return shards
+}
+
+// claim creates or takes over the named Lease for this replica. An existing
+// Lease is updated with its resourceVersion, so a concurrent claim fails
+// with a conflict.
+func (s *shardManager) claim(ctx context.Context, kube *kubeClient, cfg config, name, role string, existing *coordinationv1.Lease, now time.Time, duration int32) error {
+	client := kube.clientset.CoordinationV1().Leases(cfg.namespace)
+	if existing == nil {
+		var err error
+		existing, err = client.Get(ctx, name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			renew := metav1.NewMicroTime(now)
+			_, err = client.Create(ctx, &coordinationv1.Lease{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   name,
+					Labels: map[string]string{shardGroupLabel: cfg.shardLease, shardRoleLabel: role},
+				},
+				Spec: coordinationv1.LeaseSpec{
+					HolderIdentity:       &s.identity,
+					LeaseDurationSeconds: &duration,
+					AcquireTime:          &renew,
+					RenewTime:            &renew,
+				},
+			}, metav1.CreateOptions{})
+			auditMutation(kube, "create", "leases", cfg.namespace, name, fieldManager, []any{"holder", s.identity}, err)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+	}
+	lease := existing.DeepCopy()
+	renew := metav1.NewMicroTime(now)
+	if lease.Spec.HolderIdentity == nil || *lease.Spec.HolderIdentity != s.identity {
+		lease.Spec.AcquireTime = &renew
+		transitions := int32(0)
+		if lease.Spec.LeaseTransitions != nil {
+			transitions = *lease.Spec.LeaseTransitions + 1
+		}
+		lease.Spec.LeaseTransitions = &transitions
+	}
+	lease.Spec.HolderIdentity = &s.identity
+	lease.Spec.LeaseDurationSeconds = &duration
+	lease.Spec.RenewTime = &renew
+	_, err := client.Update(ctx, lease, metav1.UpdateOptions{})
+	if previous := existing.Spec.HolderIdentity; previous == nil || *previous != s.identity {
+		// Renewals are not audited, only changes of holder.
+		var from string
+		if previous != nil {
+			from = *previous
+		}
+		auditMutation(kube, "update", "leases", cfg.namespace, name, fieldManager, []any{"holder", slog.GroupValue(slog.String("from", from), slog.String("to", s.identity))}, err)
+	}
+	return err
+}
+
+func (s *shardManager) release(ctx context.Context, kube *kubeClient, lease *coordinationv1.Lease) error {
+	lease = lease.DeepCopy()
+	lease.Spec.HolderIdentity = nil
+	lease.Spec.RenewTime = nil
+	_, err := kube.clientset.CoordinationV1().Leases(lease.Namespace).Update(ctx, lease, metav1.UpdateOptions{})
+	auditMutation(kube, "update", "leases", lease.Namespace, lease.Name, fieldManager, []any{"holder", slog.GroupValue(slog.String("from", s.identity), slog.String("to", ""))}, err)
+	return err
+}
+
+// releaseAll gives up the member Lease and every owned shard Lease so that
+// other replicas can take over without waiting for them to expire.
+func (s *shardManager) releaseAll(ctx context.Context, kube *kubeClient, cfg config) {
+	client := kube.clientset.CoordinationV1().Leases(cfg.namespace)
+	for i := range s.owned {
+		lease, err := client.Get(ctx, shardLeaseName(cfg, i), metav1.GetOptions{})
+		if err == nil && lease.Spec.HolderIdentity != nil && *lease.Spec.HolderIdentity == s.identity {
+			err = s.release(ctx, kube, lease)
+		}
+		if err != nil {
+			slog.Warn("failed to release shard Lease", "lease", shardLeaseName(cfg, i), "error", err)
+		}
+	}
+	member := cfg.shardLease + "-member-" + s.identity
+	err := client.Delete(ctx, member, metav1.DeleteOptions{})
+	auditMutation(kube, "delete", "leases", cfg.namespace, member, fieldManager, nil, err)
+	if err != nil && !errors.IsNotFound(err) {
+		slog.Warn("failed to delete member Lease", "lease", member, "error", err)
+	}
+	s.owned = nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"net/url"
+	"time"
+)
+
+// failoverSimulation publishes fake mgr addresses that take turns for
+// interval each, so consumers can be tested against a mgr failover.
+type failoverSimulation struct {
+	addresses []net.IP
+	interval  time.Duration
+}
+
+// address returns the simulated mgr address at now, or nil when no
+// simulation is configured. Turns are counted from the Unix epoch so that
+// replicas agree.
+func (s failoverSimulation) address(now time.Time) net.IP {
+	if len(s.addresses) == 0 {
+		return nil
+	}
+	turn := now.UnixNano() / int64(s.interval)
+	return s.addresses[turn%int64(len(s.addresses))]
+}
+
+// simulateServices returns services with the host of every URL replaced by
+// ip, keeping the ports and paths.
+func simulateServices(services mgrServices, ip net.IP) (mgrServices, error) {
+	simulated := maps.Clone(services)
+	for module, rawURL := range services {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s URL: %w", module, err)
+		}
+		if port := u.Port(); port != "" {
+			u.Host = net.JoinHostPort(ip.String(), port)
+		} else if ip.To4() == nil {
+			u.Host = "[" + ip.String() + "]"
+		} else {
+			u.Host = ip.String()
+		}
+		simulated[module] = u.String()
+	}
+	return simulated, nil
+}
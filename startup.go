@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// startupRetryPolicy backs off between attempts to reach Ceph at startup.
+var startupRetryPolicy = retryPolicy{
+	initialDelay: time.Second,
+	multiplier:   2,
+	maxDelay:     30 * time.Second,
+}
+
+// waitForCeph connects to Ceph and, when a startup window is configured,
+// checks that it answers mgr commands. Failures are retried with backoff for
+// up to cfg.startupTimeout or cfg.startupRetries retries, whichever ends
+// first, so that a momentary mon outage does not fail startup. It reports
+// whether the connection was established, and the last error.
+func waitForCeph(ctx context.Context, cfg config, conn discoverer, connect func() error) (bool, error) {
+	if cfg.startupTimeout == 0 && cfg.startupRetries == 0 {
+		err := connect()
+		return err == nil, err
+	}
+	policy := startupRetryPolicy
+	policy.maxAttempts = math.MaxInt
+	if cfg.startupRetries > 0 {
+		policy.maxAttempts = cfg.startupRetries + 1
+	}
+	if cfg.startupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.startupTimeout)
+		defer cancel()
+	}
+	connected := false
+	err := policy.do(ctx, func() error {
+		if !connected {
+			if err := connect(); err != nil {
+				return err
+			}
+			connected = true
+		}
+		_, err := getMgrServices(conn)
+		return err
+	})
+	return connected, err
+}
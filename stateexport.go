@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var endpointSliceResource = schema.GroupVersionResource{Group: "discovery.k8s.io", Version: "v1", Resource: "endpointslices"}
+
+// stateExport is the document written by `state export` and read by
+// `state import`.
+type stateExport struct {
+	Exported  time.Time        `json:"exported"`
+	Endpoints *savedState      `json:"endpoints,omitempty"`
+	Objects   []exportedObject `json:"objects"`
+}
+
+// exportedObject is a managed object without its server-set metadata.
+type exportedObject struct {
+	Cluster  string         `json:"cluster"`
+	Resource string         `json:"resource"`
+	Object   map[string]any `json:"object"`
+}
+
+// stateCommand runs `state export` or `state import` and returns the exit
+// code.
+func stateCommand(args []string) int {
+	usage := "usage: ceph-mgr-endpoint-controller state export|import [--file path]"
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	flags := flag.NewFlagSet("state "+args[0], flag.ContinueOnError)
+	file := flags.String("file", "-", "file to write or read, - for standard output or input")
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("failed to load config", "error", err)
+		return exitCode(err)
+	}
+	kubes, err := newKubeClients(cfg)
+	if err != nil {
+		slog.Error("failed to connect to kubernetes", "error", err)
+		return exitCode(errKubernetes)
+	}
+	defer shutdownKubeClients(kubes)
+	ctx := context.Background()
+
+	if args[0] == "export" {
+		out := os.Stdout
+		if *file != "-" {
+			if out, err = os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600); err != nil {
+				slog.Error("failed to create export", "error", err)
+				return 1
+			}
+			defer out.Close()
+		}
+		if err := exportState(ctx, cfg, kubes, out); err != nil {
+			slog.Error("failed to export state", "error", err)
+			return 1
+		}
+		return 0
+	}
+	audit, err := openAuditLog(cfg.auditLog)
+	if err != nil {
+		slog.Error("failed to open audit log", "error", err)
+		return exitCode(err)
+	}
+	defer audit.Close()
+	in := os.Stdin
+	if *file != "-" {
+		if in, err = os.Open(*file); err != nil {
+			slog.Error("failed to open export", "error", err)
+			return 1
+		}
+		defer in.Close()
+	}
+	if err := importState(ctx, cfg, kubes, in, os.Stderr); err != nil {
+		slog.Error("failed to import state", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// exportState writes the last-known endpoints from the state file and the
+// objects the controller manages for the configured mappings to out.
+// Secrets and the per-replica status ConfigMaps and Leases are left out.
+func exportState(ctx context.Context, cfg config, kubes []*kubeClient, out io.Writer) error {
+	doc := stateExport{Exported: time.Now().UTC(), Objects: []exportedObject{}}
+	if cfg.stateFile != "" {
+		data, err := os.ReadFile(cfg.stateFile)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("read state file: %w", err)
+		}
+		if err == nil {
+			doc.Endpoints = &savedState{}
+			if err := json.Unmarshal(data, doc.Endpoints); err != nil {
+				return fmt.Errorf("unmarshal state: %w", err)
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	add := func(kube *kubeClient, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) {
+		key := kube.name + "/" + gvr.String() + "/" + obj.GetNamespace() + "/" + obj.GetName()
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		obj = obj.DeepCopy()
+		for _, field := range []string{"uid", "resourceVersion", "generation", "creationTimestamp", "managedFields", "ownerReferences", "selfLink"} {
+			unstructured.RemoveNestedField(obj.Object, "metadata", field)
+		}
+		unstructured.RemoveNestedField(obj.Object, "status")
+		doc.Objects = append(doc.Objects, exportedObject{Cluster: kube.name, Resource: gvr.Resource, Object: obj.Object})
+	}
+	get := func(kube *kubeClient, ref objectRef) error {
+		obj, err := kube.dynamic.Resource(ref.gvr).Namespace(ref.namespace).Get(ctx, ref.name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("get %s %s/%s in %s: %w", ref.gvr.Resource, ref.namespace, ref.name, kube.name, err)
+		}
+		if obj.GetLabels()["app.kubernetes.io/managed-by"] == fieldManager {
+			add(kube, ref.gvr, obj)
+		}
+		return nil
+	}
+
+	for _, kube := range kubes {
+		for _, m := range cfg.mappings {
+			if !m.appliesTo(kube.name) {
+				continue
+			}
+			selector := labels.Set{managedByLabel: fieldManager, sliceGroupLabel: m.slice}.String()
+			list, err := kube.dynamic.Resource(endpointSliceResource).Namespace(m.namespace).List(ctx, metav1.ListOptions{LabelSelector: selector})
+			if err != nil {
+				return fmt.Errorf("list EndpointSlices in %s: %w", kube.name, err)
+			}
+			for i := range list.Items {
+				add(kube, endpointSliceResource, &list.Items[i])
+			}
+			for _, ref := range mappingObjects(cfg, m) {
+				if ref.gvr == secretResource {
+					continue
+				}
+				if err := get(kube, ref); err != nil {
+					return err
+				}
+			}
+		}
+		for _, ref := range globalConfigMaps(cfg) {
+			if err := get(kube, ref); err != nil {
+				return err
+			}
+		}
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(doc)
+}
+
+// importState restores an export: the last-known endpoints replace the state
+// file, and the objects are applied to the cluster of the same name, or to
+// the only configured cluster. Owner references are dropped, since the UIDs
+// differ between clusters, and are set again by the next reconcile. Progress
+// is reported to out.
+func importState(ctx context.Context, cfg config, kubes []*kubeClient, in io.Reader, out io.Writer) error {
+	var doc stateExport
+	if err := json.NewDecoder(in).Decode(&doc); err != nil {
+		return fmt.Errorf("decode export: %w", err)
+	}
+	if doc.Endpoints != nil {
+		if cfg.stateFile == "" {
+			fmt.Fprintln(out, "skipped last-known endpoints: no stateFile configured")
+		} else {
+			if err := writeSavedState(cfg.stateFile, *doc.Endpoints); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "restored last-known endpoints of %d mappings to %s\n", len(doc.Endpoints.Mappings), cfg.stateFile)
+		}
+	}
+
+	for _, exported := range doc.Objects {
+		kube := kubes[0]
+		if len(kubes) > 1 {
+			kube = nil
+			for _, k := range kubes {
+				if k.name == exported.Cluster {
+					kube = k
+				}
+			}
+			if kube == nil {
+				return fmt.Errorf("cluster %s is not configured", exported.Cluster)
+			}
+		}
+		obj := &unstructured.Unstructured{Object: exported.Object}
+		if obj.GetLabels()["app.kubernetes.io/managed-by"] != fieldManager && obj.GetLabels()[managedByLabel] != fieldManager {
+			fmt.Fprintf(out, "skipped %s %s/%s: not managed by %s\n", exported.Resource, obj.GetNamespace(), obj.GetName(), fieldManager)
+			continue
+		}
+		gv, err := schema.ParseGroupVersion(obj.GetAPIVersion())
+		if err != nil {
+			return fmt.Errorf("%s %s/%s: %w", exported.Resource, obj.GetNamespace(), obj.GetName(), err)
+		}
+		obj.SetOwnerReferences(nil)
+		_, err = kube.dynamic.Resource(gv.WithResource(exported.Resource)).Namespace(obj.GetNamespace()).Apply(ctx, obj.GetName(), obj, metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+		auditMutation(kube, "apply", exported.Resource, obj.GetNamespace(), obj.GetName(), fieldManager, []any{"imported", doc.Exported}, err)
+		if err != nil {
+			return fmt.Errorf("apply %s %s/%s in %s: %w", exported.Resource, obj.GetNamespace(), obj.GetName(), kube.name, err)
+		}
+		fmt.Fprintf(out, "applied %s %s/%s in %s\n", exported.Resource, obj.GetNamespace(), obj.GetName(), kube.name)
+	}
+	return nil
+}
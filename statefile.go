@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const staleAnnotation = "ceph.io/stale-since"
+
+// savedState is the on-disk record of the last successful discovery.
+type savedState struct {
+	Time     time.Time               `json:"time"`
+	FSID     string                  `json:"fsid,omitempty"`
+	Mappings map[string][]savedGroup `json:"mappings"`
+}
+
+type savedGroup struct {
+	Slice string         `json:"slice"`
+	Addrs []savedAddress `json:"addrs"`
+}
+
+type savedAddress struct {
+	IP    string           `json:"ip"`
+	Port  int32            `json:"port"`
+	Ports map[string]int32 `json:"ports,omitempty"`
+	URL   string           `json:"url"`
+	Path  string           `json:"path"`
+}
+
+func stateKey(m mapping) string {
+	return m.namespace + "/" + m.slice
+}
+
+func writeStateFile(path, fsid string, discovered map[string][]endpointGroup) error {
+	saved := savedState{Time: time.Now().UTC(), FSID: fsid, Mappings: make(map[string][]savedGroup)}
+	for key, groups := range discovered {
+		for _, group := range groups {
+			sg := savedGroup{Slice: group.name}
+			for _, a := range group.addrs {
+				sg.Addrs = append(sg.Addrs, savedAddress{IP: a.ip.String(), Port: a.port, Ports: a.extraPorts, URL: a.url, Path: a.path})
+			}
+			saved.Mappings[key] = append(saved.Mappings[key], sg)
+		}
+	}
+	return writeSavedState(path, saved)
+}
+
+// writeSavedState replaces the state file at path with saved.
+func writeSavedState(path string, saved savedState) error {
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return fmt.Errorf("marshal state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".state-*")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temp file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("rename state file: %w", err)
+	}
+	return nil
+}
+
+// readStateFile returns the groups recorded for each mapping, with every
+// address marked stale as of the time they were discovered.
+func readStateFile(path string) (map[string][]endpointGroup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var saved savedState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("unmarshal state: %w", err)
+	}
+	groups := make(map[string][]endpointGroup)
+	for key, sgs := range saved.Mappings {
+		for _, sg := range sgs {
+			group := endpointGroup{name: sg.Slice}
+			for _, sa := range sg.Addrs {
+				ip := net.ParseIP(sa.IP)
+				if ip == nil {
+					return nil, fmt.Errorf("invalid address in state file: %s", sa.IP)
+				}
+				group.addrs = append(group.addrs, &endpointAddress{ip: ip, port: sa.Port, extraPorts: sa.Ports, url: sa.URL, path: sa.Path, staleSince: saved.Time})
+			}
+			if len(group.addrs) > 0 {
+				groups[key] = append(groups[key], group)
+			}
+		}
+	}
+	return groups, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+// Controller health conditions reported in the status ConfigMap.
+const (
+	conditionCephReachable     = "CephReachable"
+	conditionServiceDiscovered = "ServiceDiscovered"
+	conditionEndpointPublished = "EndpointPublished"
+	conditionDegraded          = "Degraded"
+)
+
+// setCondition records a controller condition, keeping its transition time
+// when the status is unchanged.
+func (s *runState) setCondition(condType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&s.conditions, metav1.Condition{
+		Type:    condType,
+		Status:  status,
+		Reason:  reason,
+		Message: message,
+	})
+}
+
+// updateDegraded derives the Degraded condition from the outcome of the last
+// reconcile and the other conditions.
+func (s *runState) updateDegraded(err error) {
+	if err != nil {
+		reason := errorReason(err)
+		if reason == "" {
+			reason = "ReconcileFailed"
+		}
+		s.setCondition(conditionDegraded, metav1.ConditionTrue, reason, err.Error())
+		return
+	}
+	for _, condType := range []string{conditionCephReachable, conditionServiceDiscovered, conditionEndpointPublished} {
+		if c := meta.FindStatusCondition(s.conditions, condType); c != nil && c.Status == metav1.ConditionFalse {
+			s.setCondition(conditionDegraded, metav1.ConditionTrue, c.Reason, c.Message)
+			return
+		}
+	}
+	s.setCondition(conditionDegraded, metav1.ConditionFalse, "AsExpected", "")
+}
+
+// statusConfigMapName returns the status ConfigMap for this replica. Sharded
+// replicas each report their own conditions.
+func statusConfigMapName(cfg config, state *runState) string {
+	if cfg.shards > 0 {
+		return cfg.statusConfigMap + "-" + state.shards.identity
+	}
+	return cfg.statusConfigMap
+}
+
+// publishStatus writes the controller conditions as JSON to the status
+// ConfigMap in each cluster.
+func publishStatus(ctx context.Context, cfg config, kubes []*kubeClient, state *runState) {
+	if cfg.statusConfigMap == "" {
+		return
+	}
+	conditions, err := json.Marshal(state.conditions)
+	if err != nil {
+		slog.Warn("failed to encode status conditions", "error", err)
+		return
+	}
+	name := statusConfigMapName(cfg, state)
+	for _, kube := range kubes {
+		if err := updateStatusConfigMap(ctx, kube, cfg.namespace, name, string(conditions)); err != nil {
+			slog.Warn("failed to update status ConfigMap", "cluster", kube.name, "namespace", cfg.namespace, "name", name, "error", err)
+		}
+	}
+}
+
+func updateStatusConfigMap(ctx context.Context, kube *kubeClient, namespace, name, conditions string) error {
+	configMaps := kube.clientset.CoreV1().ConfigMaps(namespace)
+
+	existing, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("get ConfigMap: %w", err)
+	}
+	if err == nil && existing.Data["conditions"] == conditions {
+		return nil
+	}
+
+	configMap := corev1apply.ConfigMap(name, namespace).
+		WithLabels(map[string]string{
+			"app.kubernetes.io/managed-by": fieldManager,
+		}).
+		WithData(map[string]string{"conditions": conditions})
+	_, err = configMaps.Apply(ctx, configMap, metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+	auditMutation(kube, "apply", "configmaps", namespace, name, fieldManager, []any{"keys", []string{"conditions"}}, err)
+	if err != nil {
+		return fmt.Errorf("apply ConfigMap: %w", err)
+	}
+	slog.Debug("applied status ConfigMap", "cluster", kube.name, "namespace", namespace, "name", name)
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// stubConn answers Ceph commands from a JSON fixture instead of librados.
+// The fixture maps command prefixes such as "mgr services" to their JSON
+// responses; "config get" maps each daemon to its option values, with daemons
+// such as mgr.x falling back to mgr. The fixture is read for every command,
+// so editing it simulates changes such as a failover.
+type stubConn struct {
+	path string
+}
+
+type stubCommand struct {
+	Prefix string `json:"prefix"`
+	Who    string `json:"who"`
+	Key    string `json:"key"`
+}
+
+// connect checks that the fixture can be read.
+func (s *stubConn) connect() error {
+	_, err := s.load()
+	return err
+}
+
+func (s *stubConn) load() (map[string]json.RawMessage, error) {
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("read Ceph stub fixture: %w", err)
+	}
+	var fixture map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("parse Ceph stub fixture: %w", err)
+	}
+	return fixture, nil
+}
+
+func (s *stubConn) command(args []byte) ([]byte, string, error) {
+	var cmd stubCommand
+	if err := json.Unmarshal(args, &cmd); err != nil {
+		return nil, "", fmt.Errorf("parse command: %w", err)
+	}
+	fixture, err := s.load()
+	if err != nil {
+		return nil, "", err
+	}
+	response, ok := fixture[cmd.Prefix]
+	if !ok {
+		return nil, "", fmt.Errorf("command %q not in Ceph stub fixture", cmd.Prefix)
+	}
+	if cmd.Prefix != "config get" {
+		return response, "", nil
+	}
+	var options map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(response, &options); err != nil {
+		return nil, "", fmt.Errorf("parse config get in Ceph stub fixture: %w", err)
+	}
+	value, ok := options[cmd.Who][cmd.Key]
+	if !ok {
+		value, ok = options["mgr"][cmd.Key]
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("option %s for %s not in Ceph stub fixture", cmd.Key, cmd.Who)
+	}
+	return value, "", nil
+}
+
+func (s *stubConn) MonCommand(args []byte) ([]byte, string, error) {
+	return s.command(args)
+}
+
+func (s *stubConn) MgrCommand(args [][]byte) ([]byte, string, error) {
+	if len(args) != 1 {
+		return nil, "", fmt.Errorf("expected one command, got %d", len(args))
+	}
+	return s.command(args[0])
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// sdNotify sends state to the systemd notification socket. It does nothing
+// when the controller is not run by systemd with Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("dial notify socket: %w", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("write notify socket: %w", err)
+	}
+	return nil
+}
+
+// watchdogTimeout returns the systemd watchdog timeout for this process, or
+// zero when WatchdogSec is not set.
+func watchdogTimeout() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC: %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
+
+// tickLimit returns how long a tick may take before it counts as hung. A
+// reconcile is bounded by its timeout, and reloading the configuration,
+// recreating clients and publishing status get as much again plus the cache
+// sync timeout.
+func tickLimit(cfg config) time.Duration {
+	return 2*cfg.runTimeout() + cacheSyncTimeout
+}
+
+// watchdog pings the systemd watchdog while the main loop is responsive. A
+// tick counts as hung once it runs longer than the limit passed to begin.
+type watchdog struct {
+	busySince atomic.Int64
+	limit     atomic.Int64
+}
+
+// begin records that a tick started, which may take up to limit.
+func (w *watchdog) begin(limit time.Duration) {
+	w.limit.Store(int64(limit))
+	w.busySince.Store(time.Now().UnixNano())
+}
+
+// end records that the tick finished.
+func (w *watchdog) end() {
+	w.busySince.Store(0)
+}
+
+func (w *watchdog) stalled(now time.Time) bool {
+	since := w.busySince.Load()
+	return since != 0 && now.Sub(time.Unix(0, since)) > time.Duration(w.limit.Load())
+}
+
+// run pings the watchdog at half of timeout until ctx is done, and stops
+// pinging while a tick is hung so that systemd restarts the controller.
+func (w *watchdog) run(ctx context.Context, timeout time.Duration) {
+	ticker := time.NewTicker(timeout / 2)
+	defer ticker.Stop()
+	warned := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if w.stalled(now) {
+				if !warned {
+					slog.Error("reconcile hung, withholding systemd watchdog pings", "busy", now.Sub(time.Unix(0, w.busySince.Load())).Round(time.Second))
+					warned = true
+				}
+				continue
+			}
+			warned = false
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("failed to ping systemd watchdog", "error", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1apply "k8s.io/client-go/applyconfigurations/core/v1"
+)
+
+// moduleTargetOptions lists the mgr module options that describe where the
+// push-based monitoring modules send their data.
+var moduleTargetOptions = map[string][]string{
+	"influx":   {"hostname", "port", "database", "ssl"},
+	"telegraf": {"address", "interval"},
+	"zabbix":   {"zabbix_host", "zabbix_port", "identifier"},
+}
+
+func getModuleTargets(conn discoverer) (map[string]string, error) {
+	modules, err := getMgrModules(conn)
+	if err != nil {
+		return nil, fmt.Errorf("list mgr modules: %w", err)
+	}
+
+	targets := make(map[string]string)
+	for _, module := range slices.Sorted(maps.Keys(moduleTargetOptions)) {
+		if !slices.Contains(modules.EnabledModules, module) {
+			continue
+		}
+		for _, option := range moduleTargetOptions[module] {
+			value, err := getMgrConfig(conn, "mgr", "mgr/"+module+"/"+option)
+			if err != nil {
+				return nil, fmt.Errorf("get %s %s: %w", module, option, err)
+			}
+			targets[module+"."+option] = value
+		}
+	}
+	return targets, nil
+}
+
+func updateModuleTargets(ctx context.Context, kube *kubeClient, namespace, name string, targets map[string]string) error {
+	applied, err := applyConfigMapData(ctx, kube, namespace, name, targets)
+	if err != nil {
+		return err
+	}
+	if applied {
+		slog.Info("applied module targets ConfigMap", "cluster", kube.name, "namespace", namespace, "name", name, "modules", len(targets))
+	}
+	return nil
+}
+
+// applyConfigMapData makes data the full contents of a ConfigMap owned by
+// the controller. It returns whether the ConfigMap was applied.
+func applyConfigMapData(ctx context.Context, kube *kubeClient, namespace, name string, data map[string]string) (bool, error) {
+	configMaps := kube.clientset.CoreV1().ConfigMaps(namespace)
+
+	existing, err := configMaps.Get(ctx, name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return false, fmt.Errorf("get ConfigMap: %w", err)
+	}
+	if err == nil && maps.Equal(existing.Data, data) {
+		slog.Debug("ConfigMap already up-to-date", "cluster", kube.name, "namespace", namespace, "name", name)
+		return false, nil
+	}
+
+	configMap := corev1apply.ConfigMap(name, namespace).
+		WithLabels(map[string]string{
+			"app.kubernetes.io/managed-by": fieldManager,
+		}).
+		WithData(data)
+	var before map[string]string
+	if existing != nil {
+		before = existing.Data
+	}
+	_, err = configMaps.Apply(ctx, configMap, metav1.ApplyOptions{FieldManager: fieldManager, Force: true})
+	auditMutation(kube, "apply", "configmaps", namespace, name, fieldManager, changedKeys(before, data, func(a, b string) bool { return a == b }), err)
+	if err != nil {
+		return false, fmt.Errorf("apply ConfigMap: %w", err)
+	}
+	return true, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var (
+	ingressRouteResource    = schema.GroupVersionResource{Group: "traefik.io", Version: "v1alpha1", Resource: "ingressroutes"}
+	ingressRouteTCPResource = schema.GroupVersionResource{Group: "traefik.io", Version: "v1alpha1", Resource: "ingressroutetcps"}
+)
+
+// traefikSpec builds the Traefik route for the mapping's Service. With
+// passthrough, an IngressRouteTCP routes by SNI to the dashboard's own TLS;
+// otherwise an IngressRoute terminates TLS at Traefik.
+func traefikSpec(cfg traefikConfig, m mapping, addr *endpointAddress) (schema.GroupVersionResource, string, map[string]any) {
+	var entryPoints []any
+	for _, entryPoint := range cfg.entryPoints {
+		entryPoints = append(entryPoints, entryPoint)
+	}
+	service := map[string]any{
+		"name": m.serviceName,
+		"port": m.module,
+	}
+	spec := map[string]any{}
+	if len(entryPoints) > 0 {
+		spec["entryPoints"] = entryPoints
+	}
+
+	if cfg.passthrough {
+		spec["routes"] = []any{map[string]any{
+			"match":    "HostSNI(`" + cfg.host + "`)",
+			"services": []any{service},
+		}}
+		spec["tls"] = map[string]any{"passthrough": true}
+		return ingressRouteTCPResource, "IngressRouteTCP", spec
+	}
+
+	if strings.HasPrefix(addr.url, "https://") {
+		service["scheme"] = "https"
+		if cfg.serversTransport != "" {
+			service["serversTransport"] = cfg.serversTransport
+		}
+	}
+	spec["routes"] = []any{map[string]any{
+		"match":    "Host(`" + cfg.host + "`)",
+		"kind":     "Rule",
+		"services": []any{service},
+	}}
+	tls := map[string]any{}
+	if cfg.secretName != "" {
+		tls["secretName"] = cfg.secretName
+	}
+	if cfg.certResolver != "" {
+		tls["certResolver"] = cfg.certResolver
+	}
+	spec["tls"] = tls
+	return ingressRouteResource, "IngressRoute", spec
+}
+
+// applyTraefikRoute creates or updates the Traefik route named after the
+// mapping's Service.
+func applyTraefikRoute(ctx context.Context, kube *kubeClient, cfg traefikConfig, m mapping, addr *endpointAddress) error {
+	gvr, kind, spec := traefikSpec(cfg, m, addr)
+	applied, err := applyGeneratedObject(ctx, kube, gvr, kind, m.namespace, m.serviceName, spec)
+	if err != nil {
+		return err
+	}
+	if applied {
+		slog.InfoContext(ctx, "applied Traefik route", "cluster", kube.name, "namespace", m.namespace, "kind", kind, "name", m.serviceName, "host", cfg.host)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+)
+
+// serviceURLData describes every mgr service URL by its parts, keyed by
+// module, so that consumers need not parse the URL.
+func serviceURLData(services mgrServices) map[string]string {
+	data := make(map[string]string)
+	for module, rawURL := range services {
+		u, err := url.Parse(rawURL)
+		if err != nil || rawURL == "" {
+			slog.Debug("skipping unparsable mgr service URL", "service", module, "url", rawURL)
+			continue
+		}
+		path := u.Path
+		if path == "" {
+			path = "/"
+		}
+		data[module+".url"] = rawURL
+		data[module+".scheme"] = u.Scheme
+		data[module+".host"] = u.Hostname()
+		data[module+".port"] = u.Port()
+		data[module+".path"] = path
+	}
+	return data
+}
+
+// updateServiceURLs writes the mgr service URLs to a ConfigMap.
+func updateServiceURLs(ctx context.Context, kube *kubeClient, namespace, name string, services mgrServices) error {
+	applied, err := applyConfigMapData(ctx, kube, namespace, name, serviceURLData(services))
+	if err != nil {
+		return err
+	}
+	if applied {
+		slog.Info("applied service URLs ConfigMap", "cluster", kube.name, "namespace", namespace, "name", name, "services", len(services))
+	}
+	return nil
+}
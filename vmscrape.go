@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var vmServiceScrapeResource = schema.GroupVersionResource{Group: "operator.victoriametrics.com", Version: "v1beta1", Resource: "vmservicescrapes"}
+
+// applyVMServiceScrape creates or updates a VictoriaMetrics VMServiceScrape
+// named after the mapping's Service. It selects the Service by its labels
+// and scrapes the port named after the module through the EndpointSlices the
+// controller publishes.
+func applyVMServiceScrape(ctx context.Context, kube *kubeClient, cfg vmScrapeConfig, m mapping, addr *endpointAddress) error {
+	svc, err := kube.getService(ctx, m.namespace, m.serviceName)
+	if err != nil {
+		return fmt.Errorf("get Service: %w", err)
+	}
+	if len(svc.Labels) == 0 {
+		return fmt.Errorf("service has no labels to select it by")
+	}
+	matchLabels := make(map[string]any, len(svc.Labels))
+	for key, value := range svc.Labels {
+		matchLabels[key] = value
+	}
+
+	endpoint := map[string]any{
+		"port":        m.module,
+		"honorLabels": true,
+	}
+	if cfg.interval != "" {
+		endpoint["interval"] = cfg.interval
+	}
+	if strings.HasPrefix(addr.url, "https://") {
+		endpoint["scheme"] = "https"
+		if cfg.insecure {
+			endpoint["tlsConfig"] = map[string]any{"insecureSkipVerify": true}
+		}
+	}
+	spec := map[string]any{
+		"discoveryRole":     "endpointslices",
+		"selector":          map[string]any{"matchLabels": matchLabels},
+		"namespaceSelector": map[string]any{"matchNames": []any{m.namespace}},
+		"endpoints":         []any{endpoint},
+	}
+
+	applied, err := applyGeneratedObject(ctx, kube, vmServiceScrapeResource, "VMServiceScrape", m.namespace, m.serviceName, spec)
+	if err != nil {
+		return err
+	}
+	if applied {
+		slog.InfoContext(ctx, "applied VMServiceScrape", "cluster", kube.name, "namespace", m.namespace, "name", m.serviceName)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// webhookServer validates CephMgrEndpoint resources at admission time
+// against the controller's current configuration.
+type webhookServer struct {
+	mu    sync.Mutex
+	cfg   config
+	kubes []*kubeClient
+}
+
+// update swaps in the configuration and clients after a reload.
+func (w *webhookServer) update(cfg config, kubes []*kubeClient) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cfg = cfg
+	w.kubes = kubes
+}
+
+// snapshot returns the configuration and the client of the named cluster,
+// or of the first cluster when name is empty.
+func (w *webhookServer) snapshot(name string) (config, *kubeClient) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, kube := range w.kubes {
+		if name == "" || kube.name == name {
+			return w.cfg, kube
+		}
+	}
+	return w.cfg, nil
+}
+
+// serve runs the HTTPS server until ctx is done. The certificate is read from
+// certDir on every handshake so that rotated certificates are picked up.
+// With a client CA, callers must present a certificate signed by it.
+func (w *webhookServer) serve(ctx context.Context, cfg webhookConfig) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate-cephmgrendpoint", w.handleValidate)
+	mux.HandleFunc("/validate-cephmgrendpoint/{cluster}", w.handleValidate)
+	tlsConfig, err := serverTLSConfig(filepath.Join(cfg.certDir, "tls.crt"), filepath.Join(cfg.certDir, "tls.key"), cfg.clientCA)
+	if err != nil {
+		return fmt.Errorf("webhook TLS: %w", err)
+	}
+	server := &http.Server{
+		Addr:              cfg.addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		TLSConfig:         tlsConfig,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	slog.Info("serving admission webhook", "addr", cfg.addr, "clientAuth", cfg.clientCA != "")
+	if err := server.ListenAndServeTLS("", ""); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (w *webhookServer) handleValidate(rw http.ResponseWriter, r *http.Request) {
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(rw, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+	response := &admissionv1.AdmissionResponse{UID: review.Request.UID, Allowed: true}
+
+	res := &cephMgrEndpoint{}
+	var obj map[string]any
+	err := json.Unmarshal(review.Request.Object.Raw, &obj)
+	if err == nil {
+		err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj, res)
+	}
+	if err != nil {
+		response.Allowed = false
+		response.Result = &metav1.Status{Message: fmt.Sprintf("decode CephMgrEndpoint: %v", err)}
+	} else {
+		if res.Namespace == "" {
+			res.Namespace = review.Request.Namespace
+		}
+		if problems := w.validate(r.Context(), r.PathValue("cluster"), res); len(problems) > 0 {
+			response.Allowed = false
+			response.Result = &metav1.Status{Message: strings.Join(problems, "; ")}
+		}
+	}
+
+	review.Response = response
+	review.Request = nil
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(&review); err != nil {
+		slog.Warn("failed to write admission response", "error", err)
+	}
+}
+
+// validate returns the reasons res would fail to publish into the named
+// cluster, or the first cluster when the request path names none, checking
+// for duplicates among the resources already in that cluster.
+func (w *webhookServer) validate(ctx context.Context, cluster string, res *cephMgrEndpoint) []string {
+	cfg, kube := w.snapshot(cluster)
+	if kube == nil {
+		return []string{fmt.Sprintf("cluster %q is not configured", cluster)}
+	}
+	var others []*cephMgrEndpoint
+	list, err := kube.dynamic.Resource(cephMgrEndpointResource).Namespace(res.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		slog.Warn("failed to list CephMgrEndpoints for validation", "cluster", kube.name, "namespace", res.Namespace, "error", err)
+	} else {
+		for _, item := range list.Items {
+			other := &cephMgrEndpoint{}
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, other); err != nil {
+				continue
+			}
+			others = append(others, other)
+		}
+	}
+	return validateCephMgrEndpoint(cfg, kube.name, res, others)
+}